@@ -5,50 +5,73 @@ import (
 	"errors"
 	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
+	"github.com/macrosiak/rspi-timelaps-manager-go/auth"
+	"github.com/macrosiak/rspi-timelaps-manager-go/catalog"
 	. "github.com/macrosiak/rspi-timelaps-manager-go/commands"
 	"github.com/macrosiak/rspi-timelaps-manager-go/config"
+	"github.com/macrosiak/rspi-timelaps-manager-go/derivatives"
+	"github.com/macrosiak/rspi-timelaps-manager-go/render"
+	"github.com/macrosiak/rspi-timelaps-manager-go/retention"
+	"github.com/macrosiak/rspi-timelaps-manager-go/safeguard"
+	"github.com/macrosiak/rspi-timelaps-manager-go/schedule"
+	"github.com/macrosiak/rspi-timelaps-manager-go/session"
+	"github.com/macrosiak/rspi-timelaps-manager-go/settings"
+	"github.com/macrosiak/rspi-timelaps-manager-go/stream"
 	. "github.com/macrosiak/rspi-timelaps-manager-go/system_stats"
 	"github.com/rs/zerolog/log"
 	"time"
 )
 
 type Api struct {
-	cfg               *config.Config
-	systemStatsSrv    *StatisticsService
-	connectionsAuthed map[*websocket.Conn]bool
-	commandsService   *CommendsService
-	pubSub            *PubSub
+	cfg             *config.Config
+	systemStatsSrv  *StatisticsService
+	authenticator   *auth.Authenticator
+	signer          *auth.Signer
+	commandsService *CommendsService
+	pubSub          *PubSub
+	renderer        *render.Renderer
+	schedule        *schedule.Store
+	photoCatalog    *catalog.Catalog
+	capturer        Capturer
+	settings        *settings.Store
+	sessions        *session.Manager
+	retention       *retention.Enforcer
+	liveStream      *stream.Hub
+	derivatives     *derivatives.Cache
+	holders         *holders
 }
 
-func (a Api) authApiKey(c *websocket.Conn, key string) bool {
-	if key == a.cfg.Password {
-		a.connectionsAuthed[c] = true
-		return true
-	}
-	return false
-}
-
-func (a Api) isUserAuthorised(c *websocket.Conn) bool {
-	return a.connectionsAuthed[c]
-}
-
-func NewApi(app *fiber.App, systemStatsSrv *StatisticsService, pubSub *PubSub) *Api {
+func NewApi(app *fiber.App, systemStatsSrv *StatisticsService, pubSub *PubSub, photoCatalog *catalog.Catalog, scheduleStore *schedule.Store, capturer Capturer, settingsStore *settings.Store, sessions *session.Manager, retentionEnforcer *retention.Enforcer, guard *safeguard.Guard, authenticator *auth.Authenticator, signer *auth.Signer, liveStream *stream.Hub, derivativesCache *derivatives.Cache) *Api {
 	cfg := config.New()
-	api := &Api{cfg: cfg, systemStatsSrv: systemStatsSrv, connectionsAuthed: make(map[*websocket.Conn]bool), pubSub: pubSub, commandsService: NewCommendsService(cfg)}
+	api := &Api{cfg: cfg, systemStatsSrv: systemStatsSrv, authenticator: authenticator, signer: signer, pubSub: pubSub, commandsService: NewCommendsService(cfg, photoCatalog, sessions, derivativesCache), schedule: scheduleStore, photoCatalog: photoCatalog, capturer: capturer, settings: settingsStore, sessions: sessions, retention: retentionEnforcer, liveStream: liveStream, derivatives: derivativesCache, holders: newHolders(authenticator)}
+	api.renderer = render.NewRenderer(cfg, photoCatalog, api.publishRenderProgress)
+	settingsStore.OnChange(api.publishSettings)
+	sessions.OnChange(api.publishSessionStatus)
+	guard.OnChange(api.publishDiskState)
+	authenticator.OnLockout(api.publishLockout)
 	app.Use("/ws", func(c *fiber.Ctx) error {
 		if websocket.IsWebSocketUpgrade(c) {
 			c.Locals("allowed", true)
+			c.Locals(ipLocal, c.IP())
 			return c.Next()
 		}
 		return fiber.ErrUpgradeRequired
 	})
 
+	api.registerRestRoutes(app)
+	// photos, their derivatives and renders require a token or a signed url
+	app.Use("/photos", api.fileAuth)
+	app.Use("/renders", api.fileAuth)
+	app.Get(derivativesPath+"/:kind/:name", api.fileAuth, api.serveDerivative)
+	app.Get(streamPath, api.fileAuth, api.streamMjpeg)
 	app.Static("/", api.cfg.WebInterfaceFilesPath, fiber.Static{
 		CacheDuration: time.Hour * 24,
 	})
 	app.Static("/photos", api.cfg.OutputDir)
+	app.Static("/renders", api.cfg.RenderOutputDir)
 	app.Get("/ws/", websocket.New(api.WebsocketHandler))
 	go api.StatisticsWorker()
+	go api.holders.run(tokenCheckInterval)
 	return api
 }
 
@@ -67,68 +90,473 @@ func (a Api) StatisticsWorker() {
 	}
 }
 
-func (a Api) WebsocketHandler(c *websocket.Conn) {
+func (a Api) publishRenderProgress(job render.Job) {
+	err := a.pubSub.PublishJson(RendersTopic, NewRenderJobResponse(job, a.signer))
+	if err != nil {
+		log.Err(err).Msg("publish render progress")
+	}
+}
+
+func (a Api) publishSettings(current settings.Settings) {
+	err := a.pubSub.PublishJson(SettingsTopic, current)
+	if err != nil {
+		log.Err(err).Msg("publish settings")
+	}
+}
+
+func (a Api) publishSessionStatus(status session.Status) {
+	err := a.pubSub.PublishJson(StatusTopic, status)
+	if err != nil {
+		log.Err(err).Msg("publish session status")
+	}
+}
+
+// publishDiskState warns subscribers when free space crosses a safeguard threshold
+func (a Api) publishDiskState(state safeguard.State) {
+	err := a.pubSub.PublishJson(DiskTopic, state)
+	if err != nil {
+		log.Err(err).Msg("publish disk safeguard state")
+	}
+}
+
+func captureErrorStatus(err error) ActionStatus {
+	if errors.Is(err, safeguard.ErrCapturePaused) {
+		return ActionStatusCapturePaused
+	}
+	return ActionStatusUnknownError
+}
+
+func sessionErrorStatus(err error) ActionStatus {
+	if errors.Is(err, session.ErrInvalidName) {
+		return ActionStatusInvalidValue
+	}
+	if errors.Is(err, session.ErrNotFound) {
+		return ActionStatusNotFound
+	}
+	if errors.Is(err, session.ErrAlreadyStarted) || errors.Is(err, session.ErrNotRunning) ||
+		errors.Is(err, session.ErrNotPaused) || errors.Is(err, session.ErrNoSession) ||
+		errors.Is(err, session.ErrSessionActive) {
+		return ActionStatusInvalidState
+	}
+	return ActionStatusUnknownError
+}
+
+func (a Api) listSessions() (SessionsResponse, error) {
+	sessions, err := a.sessions.Sessions()
+	if err != nil {
+		return SessionsResponse{}, err
+	}
+	summaries, err := a.photoCatalog.Summaries()
+	if err != nil {
+		return SessionsResponse{}, err
+	}
+
+	current := a.sessions.Status().Session
+	response := SessionsResponse{Sessions: []SessionResponse{}}
+	for _, s := range sessions {
+		response.Sessions = append(response.Sessions, SessionResponse{
+			Session: s,
+			Photos:  summaries[s.Id],
+			Active:  current != nil && current.Id == s.Id,
+		})
+	}
+	return response, nil
+}
+
+func (a Api) sendSessionTransition(r ActionRequest, err error) {
+	if err != nil {
+		msg := err.Error()
+		SendStatus(r, sessionErrorStatus(err), &msg)
+		return
+	}
+	SendStatus(r, ActionStatusSuccess, nil)
+}
+
+func (a Api) WebsocketHandler(ws *websocket.Conn) {
+	c := a.pubSub.Connect(ws)
+	defer a.pubSub.Disconnect(c)
+
 	var (
 		mt  int
 		msg []byte
 		err error
+		// token lives only as long as the connection, nothing about it is kept after close
+		token *auth.Token
+		// held closes the connection when the token is revoked or expires while the client is idle
+		held  *holder
+		ip, _ = ws.Locals(ipLocal).(string)
 	)
+	defer func() { a.holders.remove(held) }()
 	for {
-		if mt, msg, err = c.ReadMessage(); err != nil {
+		if mt, msg, err = ws.ReadMessage(); err != nil {
 			log.Err(err).Msg("read message")
 			break
 		}
 
 		if len(msg) > 0 {
-			actionPayload := ActionPayload{}
-			err := json.Unmarshal(msg, &actionPayload)
+			r := ActionRequest{conn: c, mt: mt}
+			err := json.Unmarshal(msg, &r.ActionPayload)
 			if err != nil {
 				log.Err(err).Str("msg", string(msg)).Msg("unmarshal")
+				SendError(r, ActionStatusInvalidValue)
+				continue
+			}
+			// unknown actions are told apart before roles, which would refuse them as admin only
+			if !supportedActions[r.Action] {
+				SendError(r, ActionStatusNotSupported)
+				continue
 			}
 
-			if !a.isUserAuthorised(c) && actionPayload.Action != ActionAuth {
-				SendError(c, mt, ActionStatusNotAuthorisedError)
+			if !a.validToken(token) && !publicActions[r.Action] {
+				if token != nil {
+					// the token expired or was revoked, stop sending topics to the connection
+					token = nil
+					a.holders.remove(held)
+					a.pubSub.UnsubscribeFromAll(c)
+				}
+				SendError(r, ActionStatusNotAuthorisedError)
+				continue
+			}
+			if !publicActions[r.Action] && !a.allowed(*token, actionRole(r.Action)) {
+				SendStatus(r, ActionStatusForbidden, nil)
 				continue
 			}
 
-			switch actionPayload.Action {
-			case ActionAuth:
-				if !a.authApiKey(c, actionPayload.Value) {
-					SendStatus(c, mt, ActionAuth, ActionStatusWrongCredentials, nil)
-					time.Sleep(5 * time.Second) // Sleep to slow down brute force attacks
-					// TODO: implement amount of attempts before being kicked, or make it sleep longer every attempt
-					continue
-				} else {
-					SendStatus(c, mt, ActionAuth, ActionStatusSuccess, nil)
-					err := a.pubSub.Subscribe(c, mt, StatisticsTopic)
-					if err != nil {
-						log.Err(err).Msg("subscribe to stats topic after auth")
+			switch r.Action {
+			case ActionHello:
+				params := HelloParams{}
+				if len(r.raw()) > 0 {
+					if err := r.Decode(&params); err != nil {
+						SendError(r, ActionStatusInvalidValue)
+						continue
 					}
+				}
+				sendStruct(r, a.hello(params))
+				continue
+			case ActionAuth:
+				issued, err := a.authenticate(string(r.raw()), ip)
+				if err != nil {
+					status, msg := authErrorStatus(err)
+					SendStatus(r, status, msg)
 					continue
 				}
+				token = &issued
+				a.holders.remove(held)
+				held = a.holders.add(issued.Value, func() {
+					log.Info().Str("user", issued.Username).Msg("token revoked, websocket closed")
+					a.pubSub.UnsubscribeFromAll(c)
+					c.close()
+				})
+				role, _ := a.authenticator.Role(issued)
+				sendStruct(r, AuthResponse{ActionResponse: ActionResponse{Action: ActionAuth, Status: ActionStatusSuccess}, Token: issued, Role: role})
+				err = a.pubSub.Subscribe(c, mt, StatisticsTopic)
+				if err != nil {
+					log.Err(err).Msg("subscribe to stats topic after auth")
+				}
+				continue
+			case ActionLogout:
+				// the connection stays open for another AUTH, so it's forgotten before the token is revoked
+				a.holders.remove(held)
+				a.authenticator.Logout(token.Value)
+				token = nil
+				a.pubSub.UnsubscribeFromAll(c)
+				SendStatus(r, ActionStatusSuccess, nil)
+				continue
 			case ActionRemoveAllImages:
-				err := a.commandsService.RemoveAllPhotos()
+				// optional session limits removal to one session
+				params := SessionParams{}
+				if err := r.Decode(&params); err != nil {
+					SendError(r, ActionStatusInvalidValue)
+					continue
+				}
+				err := a.commandsService.RemoveAllPhotos(params.Session)
 				if err != nil {
 					log.Err(err).Msg("remove all images")
-				} else {
-					log.Debug().Msg("removed all images")
-					SendStatus(c, mt, ActionRemoveAllImages, ActionStatusSuccess, nil)
+					msg := err.Error()
+					SendStatus(r, ActionStatusUnknownError, &msg)
+					continue
 				}
+				log.Debug().Msg("removed all images")
+				SendStatus(r, ActionStatusSuccess, nil)
+				continue
+			case ActionRenderTimelapse:
+				request := render.Request{}
+				if err := r.Decode(&request); err != nil {
+					SendError(r, ActionStatusInvalidValue)
+					continue
+				}
+
+				job, err := a.renderer.Enqueue(request)
+				if errors.Is(err, render.ErrQueueFull) {
+					SendStatus(r, ActionStatusBusy, nil)
+					continue
+				} else if err != nil {
+					msg := err.Error()
+					SendStatus(r, ActionStatusInvalidValue, &msg)
+					continue
+				}
+				SendStatus(r, ActionStatusSuccess, &job.Id)
+				continue
+			case ActionListRenders:
+				response := RenderJobsResponse{Renders: []RenderJobResponse{}}
+				for _, job := range a.renderer.Jobs() {
+					response.Renders = append(response.Renders, NewRenderJobResponse(job, a.signer))
+				}
+				sendStruct(r, response)
+				continue
+			case ActionGetSchedule:
+				sendStruct(r, NewScheduleResponse(a.schedule.Get()))
+				continue
+			case ActionSetSchedule:
+				newSchedule := schedule.Schedule{}
+				if err := r.Decode(&newSchedule); err != nil {
+					SendError(r, ActionStatusInvalidValue)
+					continue
+				}
+
+				if err := a.schedule.Set(newSchedule); err != nil {
+					msg := err.Error()
+					SendStatus(r, ActionStatusInvalidValue, &msg)
+					continue
+				}
+				SendStatus(r, ActionStatusSuccess, nil)
+				continue
+			case ActionGetSettings:
+				sendStruct(r, a.settings.Get())
+				continue
+			case ActionUpdateSettings:
+				patch := settings.Patch{}
+				if err := r.Decode(&patch); err != nil {
+					SendError(r, ActionStatusInvalidValue)
+					continue
+				}
+
+				if _, err := a.settings.Update(patch); err != nil {
+					msg := err.Error()
+					SendStatus(r, ActionStatusInvalidValue, &msg)
+					continue
+				}
+				SendStatus(r, ActionStatusSuccess, nil)
+				continue
+			case ActionGetTimelapseStatus:
+				sendStruct(r, a.sessions.Status())
+				continue
+			case ActionStartTimelapse:
+				params := StartTimelapseParams{}
+				if err := r.Decode(&params); err != nil {
+					SendError(r, ActionStatusInvalidValue)
+					continue
+				}
+				_, err := a.sessions.Start(params.Name)
+				a.sendSessionTransition(r, err)
+				continue
+			case ActionPauseTimelapse:
+				_, err := a.sessions.Pause()
+				a.sendSessionTransition(r, err)
+				continue
+			case ActionResumeTimelapse:
+				_, err := a.sessions.Resume()
+				a.sendSessionTransition(r, err)
+				continue
+			case ActionStopTimelapse:
+				_, err := a.sessions.Stop()
+				a.sendSessionTransition(r, err)
+				continue
+			case ActionListSessions:
+				response, err := a.listSessions()
+				if err != nil {
+					log.Err(err).Msg("list sessions")
+					SendError(r, ActionStatusUnknownError)
+					continue
+				}
+				sendStruct(r, response)
+				continue
+			case ActionRemoveSession:
+				params := SessionParams{}
+				if err := r.Decode(&params); err != nil {
+					SendError(r, ActionStatusInvalidValue)
+					continue
+				}
+				_, err := a.commandsService.RemoveSession(params.Session)
+				a.sendSessionTransition(r, err)
+				continue
+			case ActionImportLegacyPhotos:
+				_, err := a.commandsService.ImportLegacyPhotos()
+				a.sendSessionTransition(r, err)
+				continue
+			case ActionTakePhoto:
+				request, err := a.parseTakePhotoRequest(r.raw())
+				if err != nil {
+					msg := err.Error()
+					SendStatus(r, ActionStatusInvalidValue, &msg)
+					continue
+				}
+
+				photo, err := a.capturer.Capture(request)
+				if err != nil {
+					log.Err(err).Msg("take photo")
+					msg := err.Error()
+					SendStatus(r, captureErrorStatus(err), &msg)
+					continue
+				}
+				sendStruct(r, NewPhotoDetailsResponse(photo, a.signer))
+				continue
+			case ActionGetRetention:
+				sendStruct(r, a.retention.Policy())
+				continue
+			case ActionSetRetention:
+				policy := retention.Policy{}
+				if err := r.Decode(&policy); err != nil {
+					SendError(r, ActionStatusInvalidValue)
+					continue
+				}
+
+				if err := a.retention.SetPolicy(policy); err != nil {
+					msg := err.Error()
+					SendStatus(r, ActionStatusInvalidValue, &msg)
+					continue
+				}
+				SendStatus(r, ActionStatusSuccess, nil)
+				continue
+			case ActionRunRetention:
+				// dry run only reports what would be removed
+				params := RunRetentionParams{}
+				if err := r.Decode(&params); err != nil {
+					SendError(r, ActionStatusInvalidValue)
+					continue
+				}
+				report, err := a.retention.Enforce(params.DryRun)
+				if err != nil {
+					log.Err(err).Msg("enforce retention")
+					msg := err.Error()
+					SendStatus(r, ActionStatusUnknownError, &msg)
+					continue
+				}
+				sendStruct(r, report)
+				continue
+			case ActionShareFile:
+				request := ShareRequest{}
+				if err := r.Decode(&request); err != nil {
+					SendError(r, ActionStatusInvalidValue)
+					continue
+				}
+
+				response, status, err := a.shareFile(request)
+				if err != nil {
+					msg := err.Error()
+					SendStatus(r, status, &msg)
+					continue
+				}
+				sendStruct(r, response)
+				continue
+			case ActionListUsers:
+				sendStruct(r, a.listUsers())
+				continue
+			case ActionCreateUser:
+				request := CreateUserRequest{}
+				if err := r.Decode(&request); err != nil {
+					SendError(r, ActionStatusInvalidValue)
+					continue
+				}
+
+				user, err := a.authenticator.CreateUser(request.Username, request.Password, request.Role)
+				if err != nil {
+					msg := err.Error()
+					SendStatus(r, userErrorStatus(err), &msg)
+					continue
+				}
+				sendStruct(r, NewUserResponse(user))
+				continue
+			case ActionUpdateUser:
+				request := UpdateUserRequest{}
+				if err := r.Decode(&request); err != nil {
+					SendError(r, ActionStatusInvalidValue)
+					continue
+				}
+
+				user, err := a.authenticator.UpdateUser(request.Username, request.UserPatch)
+				if err != nil {
+					msg := err.Error()
+					SendStatus(r, userErrorStatus(err), &msg)
+					continue
+				}
+				sendStruct(r, NewUserResponse(user))
+				continue
+			case ActionDeleteUser:
+				params := UsernameParams{}
+				if err := r.Decode(&params); err != nil {
+					SendError(r, ActionStatusInvalidValue)
+					continue
+				}
+				if err := a.authenticator.DeleteUser(params.Username); err != nil {
+					msg := err.Error()
+					SendStatus(r, userErrorStatus(err), &msg)
+					continue
+				}
+				SendStatus(r, ActionStatusSuccess, nil)
 				continue
 			case ActionSubscribe:
-				err := a.pubSub.Subscribe(c, mt, Topic(actionPayload.Value))
+				params := TopicParams{}
+				if err := r.Decode(&params); err != nil {
+					SendError(r, ActionStatusInvalidValue)
+					continue
+				}
+				if !a.allowed(*token, topicRole(params.Topic)) {
+					SendStatus(r, ActionStatusForbidden, nil)
+					continue
+				}
+				err := a.pubSub.Subscribe(c, mt, params.Topic)
 				if err != nil {
 					if errors.Is(err, TopicNotWhitelistedErr) {
-						SendError(c, mt, ActionStatusInvalidTopic)
+						SendError(r, ActionStatusInvalidTopic)
 						continue
 					}
-					SendError(c, mt, ActionStatusUnknownError)
+					SendError(r, ActionStatusUnknownError)
 					continue
 				}
+				sendStruct(r, SubscriptionsResponse{
+					ActionResponse: ActionResponse{Action: ActionSubscribe, Status: ActionStatusSuccess},
+					Topics:         a.pubSub.Subscriptions(c),
+				})
+				continue
+			case ActionUnsubscribe:
+				// an empty topic unsubscribes from all topics
+				params := TopicParams{}
+				if err := r.Decode(&params); err != nil {
+					SendError(r, ActionStatusInvalidValue)
+					continue
+				}
+				topic := params.Topic.ToUpper()
+				if topic == "" {
+					a.pubSub.UnsubscribeFromAll(c)
+				} else if WhitelistedTopics.Contains(topic) {
+					a.pubSub.Unsubscribe(c, topic)
+				} else {
+					SendStatus(r, ActionStatusInvalidTopic, nil)
+					continue
+				}
+				sendStruct(r, SubscriptionsResponse{
+					ActionResponse: ActionResponse{Action: ActionUnsubscribe, Status: ActionStatusSuccess},
+					Topics:         a.pubSub.Subscriptions(c),
+				})
+				continue
+			case ActionListSubscriptions:
+				sendStruct(r, SubscriptionsResponse{
+					ActionResponse: ActionResponse{Action: ActionListSubscriptions, Status: ActionStatusSuccess},
+					Topics:         a.pubSub.Subscriptions(c),
+				})
+				continue
+			case ActionListTopics:
+				sendStruct(r, NewTopicsResponse())
+				continue
+			default:
+				SendError(r, ActionStatusNotSupported)
+				continue
 			}
 		} else {
-			if !a.isUserAuthorised(c) {
-				SendError(c, mt, ActionStatusNotAuthorisedError)
+			r := ActionRequest{conn: c, mt: mt}
+			if !a.validToken(token) {
+				SendError(r, ActionStatusNotAuthorisedError)
 				continue
 			}
 		}
@@ -0,0 +1,187 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gofiber/fiber/v2"
+	"github.com/macrosiak/rspi-timelaps-manager-go/auth"
+	"github.com/rs/zerolog/log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tokenLocal = "authToken"
+	ipLocal    = "ip"
+	// tokenCheckInterval is how often tokens of open websockets and streams are checked for expiry
+	tokenCheckInterval = 30 * time.Second
+)
+
+// AuthRequest is the value of AUTH action and the body of POST /auth/login,
+// a token issued earlier may be sent instead of the credentials
+type AuthRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Token    string `json:"token"`
+}
+
+const AuditEventLockout = "LOCKOUT"
+
+// AuditEvent is published to the audit topic
+type AuditEvent struct {
+	Event   string        `json:"event"`
+	Lockout *auth.Lockout `json:"lockout,omitempty"`
+}
+
+// AuthResponse tells the client which token to send with HTTP requests or after reconnecting
+type AuthResponse struct {
+	ActionResponse
+	auth.Token
+	Role auth.Role `json:"role"`
+}
+
+// authenticate handles AUTH action value sent from the remote address ip, a plain string, either bare
+// or JSON encoded, is tried as a token and then as the password of the default account, which is what older clients send
+func (a Api) authenticate(value, ip string) (auth.Token, error) {
+	request := AuthRequest{}
+	if err := json.Unmarshal([]byte(value), &request); err != nil {
+		secret := value
+		_ = json.Unmarshal([]byte(value), &secret)
+		if token, err := a.authenticator.Authenticate(secret); err == nil {
+			return token, nil
+		}
+		return a.authenticator.Login(auth.DefaultUsername, secret, ip)
+	}
+
+	if request.Token != "" {
+		return a.authenticator.Resume(request.Token, ip)
+	}
+	return a.authenticator.Login(request.Username, request.Password, ip)
+}
+
+// authErrorStatus tells apart wrong credentials from attempts refused by the limiter
+func authErrorStatus(err error) (ActionStatus, *string) {
+	var limit *auth.LimitError
+	if errors.As(err, &limit) {
+		msg := limit.Error()
+		return ActionStatusTooManyAttempts, &msg
+	}
+	return ActionStatusWrongCredentials, nil
+}
+
+// publishLockout sends audit event to subscribers and the log when an address or an account is banned
+func (a Api) publishLockout(lockout auth.Lockout) {
+	log.Warn().Str("kind", string(lockout.Kind)).Str("key", lockout.Key).Int("failures", lockout.Failures).
+		Time("until", time.Unix(lockout.Until, 0)).Msg("login locked out")
+	err := a.pubSub.PublishJson(AuditTopic, AuditEvent{Event: AuditEventLockout, Lockout: &lockout})
+	if err != nil {
+		log.Err(err).Msg("publish lockout")
+	}
+}
+
+// validToken checks the token of a websocket connection again, so expired and revoked tokens stop working
+func (a Api) validToken(token *auth.Token) bool {
+	if token == nil {
+		return false
+	}
+	_, err := a.authenticator.Authenticate(token.Value)
+	return err == nil
+}
+
+// holder is an open websocket or stream authenticated with a token, revoke is called once the token stops working
+type holder struct {
+	token  string
+	revoke func()
+}
+
+// holders keeps connections which stay open after authentication, so revoked and expired tokens close them
+// instead of being noticed only with the next message
+type holders struct {
+	authenticator *auth.Authenticator
+
+	mu      sync.Mutex
+	holders map[*holder]struct{}
+}
+
+func newHolders(authenticator *auth.Authenticator) *holders {
+	h := &holders{authenticator: authenticator, holders: make(map[*holder]struct{})}
+	authenticator.OnRevoke(h.check)
+	return h
+}
+
+func (h *holders) add(token string, revoke func()) *holder {
+	held := &holder{token: token, revoke: revoke}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.holders[held] = struct{}{}
+	return held
+}
+
+// remove forgets the holder, it's safe to call with nil
+func (h *holders) remove(held *holder) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.holders, held)
+}
+
+// check revokes holders whose tokens aren't valid anymore
+func (h *holders) check() {
+	var revoked []*holder
+	h.mu.Lock()
+	for held := range h.holders {
+		if _, err := h.authenticator.Authenticate(held.token); err != nil {
+			delete(h.holders, held)
+			revoked = append(revoked, held)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, held := range revoked {
+		held.revoke()
+	}
+}
+
+// run checks tokens every interval, so expired ones are noticed too, it never returns
+func (h *holders) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		h.check()
+	}
+}
+
+// restAuth requires token issued by POST /api/v1/auth/login or AUTH websocket action, passed as "Authorization: Bearer <token>"
+func (a Api) restAuth(c *fiber.Ctx) error {
+	token, err := a.authenticator.Authenticate(strings.TrimPrefix(c.Get(fiber.HeaderAuthorization), "Bearer "))
+	if err != nil {
+		return SendRestError(c, ActionStatusNotAuthorisedError, nil)
+	}
+	c.Locals(tokenLocal, token)
+	return c.Next()
+}
+
+func (a Api) restLogin(c *fiber.Ctx) error {
+	request := AuthRequest{}
+	if err := c.BodyParser(&request); err != nil {
+		return sendRestErr(c, ActionStatusInvalidValue, err)
+	}
+
+	token, err := a.authenticator.Login(request.Username, request.Password, c.IP())
+	if err != nil {
+		status, msg := authErrorStatus(err)
+		var limit *auth.LimitError
+		if errors.As(err, &limit) {
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(time.Until(limit.Until).Seconds())+1))
+		}
+		return SendRestError(c, status, msg)
+	}
+	return c.JSON(token)
+}
+
+func (a Api) restLogout(c *fiber.Ctx) error {
+	token := c.Locals(tokenLocal).(auth.Token)
+	a.authenticator.Logout(token.Value)
+	return c.SendStatus(fiber.StatusNoContent)
+}
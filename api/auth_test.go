@@ -0,0 +1,45 @@
+package api
+
+import (
+	"github.com/macrosiak/rspi-timelaps-manager-go/auth"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRevokedTokensCloseHolders(t *testing.T) {
+	users, err := auth.NewUsers(filepath.Join(t.TempDir(), "users.json"), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator := auth.NewAuthenticator(users, auth.NewTokens(time.Hour), auth.NewLimiter(auth.LimiterConfig{}))
+	h := newHolders(authenticator)
+
+	login := func() auth.Token {
+		token, err := authenticator.Login(auth.DefaultUsername, "secret", "127.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	first, second := login(), login()
+	revoked := make(map[string]bool)
+	for _, token := range []auth.Token{first, second} {
+		value := token.Value
+		h.add(value, func() { revoked[value] = true })
+	}
+
+	authenticator.Logout(first.Value)
+	if !revoked[first.Value] || revoked[second.Value] {
+		t.Fatalf("expected only the logged out token to be revoked, got %v", revoked)
+	}
+
+	// a new password logs the user out everywhere
+	password := "another secret"
+	if _, err = authenticator.UpdateUser(auth.DefaultUsername, auth.UserPatch{Password: &password}); err != nil {
+		t.Fatal(err)
+	}
+	if !revoked[second.Value] {
+		t.Error("expected the token to be revoked after the password change")
+	}
+}
@@ -0,0 +1,132 @@
+package api
+
+import (
+	"errors"
+	"github.com/gofiber/fiber/v2"
+	"github.com/macrosiak/rspi-timelaps-manager-go/catalog"
+	"github.com/macrosiak/rspi-timelaps-manager-go/derivatives"
+	"github.com/macrosiak/rspi-timelaps-manager-go/lib"
+	"github.com/rs/zerolog/log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	derivativesPath = "/derivatives"
+	// derivatives are always jpegs, the extension is appended to the name of the photo
+	derivativeExt = ".jpg"
+)
+
+// ShareRequest asks for a link to one photo or one render, zero Ttl uses the default lifetime of signed urls
+type ShareRequest struct {
+	Photo  string       `json:"photo"`
+	Render string       `json:"render"`
+	Ttl    lib.Duration `json:"ttl"`
+}
+
+type ShareResponse struct {
+	Url       string `json:"url"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+// fileAuth lets requests for photos and renders through with a signed url, a bearer token
+// or a token query parameter, every access is logged
+func (a Api) fileAuth(c *fiber.Ctx) error {
+	query, _ := url.ParseQuery(string(c.Request().URI().QueryString()))
+	user := ""
+	if err := a.signer.Verify(c.Path(), query); err == nil {
+		user = "signed url"
+	} else {
+		value := query.Get("token")
+		if header := c.Get(fiber.HeaderAuthorization); header != "" {
+			value = strings.TrimPrefix(header, "Bearer ")
+		}
+		token, err := a.authenticator.Authenticate(value)
+		if err != nil {
+			log.Warn().Str("path", c.Path()).Str("ip", c.IP()).Msg("file access denied")
+			return SendRestError(c, ActionStatusNotAuthorisedError, nil)
+		}
+		user = token.Username
+		c.Locals(tokenLocal, token)
+	}
+
+	log.Info().Str("path", c.Path()).Str("user", user).Str("ip", c.IP()).Msg("file access")
+	return c.Next()
+}
+
+// serveDerivative sends thumbnail or web preview of a photo, missing ones are generated first
+func (a Api) serveDerivative(c *fiber.Ctx) error {
+	kind := derivatives.Kind(c.Params("kind"))
+	name := strings.TrimSuffix(c.Params("name"), derivativeExt)
+	photo, err := a.photoCatalog.Get(name)
+	if errors.Is(err, catalog.ErrNotFound) {
+		return sendRestErr(c, ActionStatusNotFound, err)
+	} else if err != nil {
+		return sendRestErr(c, ActionStatusUnknownError, err)
+	}
+
+	path, err := a.derivatives.Ensure(*photo, kind)
+	if errors.Is(err, derivatives.ErrUnknownKind) || errors.Is(err, derivatives.ErrUnsupported) {
+		return sendRestErr(c, ActionStatusInvalidValue, err)
+	} else if errors.Is(err, os.ErrNotExist) {
+		return sendRestErr(c, ActionStatusNotFound, err)
+	} else if err != nil {
+		log.Err(err).Str("file", photo.FileName).Msg("generate derivatives")
+		return sendRestErr(c, ActionStatusUnknownError, err)
+	}
+	c.Set(fiber.HeaderCacheControl, "private, max-age=86400")
+	return c.SendFile(path)
+}
+
+// shareFile signs link to the requested photo or render, status describes the error
+func (a Api) shareFile(request ShareRequest) (ShareResponse, ActionStatus, error) {
+	ttl := time.Duration(request.Ttl)
+	if ttl == 0 {
+		ttl = a.cfg.SignedUrlTtl
+	}
+	if ttl < 0 || ttl > a.cfg.ShareMaxTtl {
+		return ShareResponse{}, ActionStatusInvalidValue, errors.New("ttl must be positive and at most " + a.cfg.ShareMaxTtl.String())
+	}
+
+	var path string
+	switch {
+	case request.Photo != "" && request.Render == "":
+		photo, err := a.photoCatalog.Get(request.Photo)
+		if errors.Is(err, catalog.ErrNotFound) {
+			return ShareResponse{}, ActionStatusNotFound, err
+		} else if err != nil {
+			return ShareResponse{}, ActionStatusUnknownError, err
+		}
+		path = PhotoPath(photo)
+	case request.Render != "" && request.Photo == "":
+		if filepath.Base(request.Render) != request.Render {
+			return ShareResponse{}, ActionStatusInvalidValue, errors.New("invalid render name")
+		}
+		if _, err := os.Stat(filepath.Join(a.cfg.RenderOutputDir, request.Render)); err != nil {
+			return ShareResponse{}, ActionStatusNotFound, errors.New("render not found")
+		}
+		path = RenderPath(request.Render)
+	default:
+		return ShareResponse{}, ActionStatusInvalidValue, errors.New("either photo or render is required")
+	}
+
+	expires := time.Now().Add(ttl)
+	log.Info().Str("path", path).Time("expires", expires).Msg("file shared")
+	return ShareResponse{Url: a.signer.Sign(path, expires), ExpiresAt: expires.Unix()}, ActionStatusSuccess, nil
+}
+
+func (a Api) restShareFile(c *fiber.Ctx) error {
+	request := ShareRequest{}
+	if err := c.BodyParser(&request); err != nil {
+		return sendRestErr(c, ActionStatusInvalidValue, err)
+	}
+
+	response, status, err := a.shareFile(request)
+	if err != nil {
+		return sendRestErr(c, status, err)
+	}
+	return c.JSON(response)
+}
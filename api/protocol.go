@@ -0,0 +1,214 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/macrosiak/rspi-timelaps-manager-go/auth"
+	"os/exec"
+)
+
+// MessageType tells clients whether a websocket message answers their action or was published to a topic
+type MessageType string
+
+const (
+	MessageTypeResponse MessageType = "RESPONSE"
+	MessageTypeEvent    MessageType = "EVENT"
+)
+
+// Envelope fields are added next to the fields of every message sent over the websocket,
+// so clients which don't know them keep reading messages as before
+type Envelope struct {
+	Type MessageType `json:"type"`
+	// Id is the id of the action the message answers, echoed as sent by the client
+	Id    json.RawMessage `json:"id,omitempty"`
+	Topic Topic           `json:"topic,omitempty"`
+}
+
+// envelopeFields are keys of Envelope, a body having any of them is put into the data field
+var envelopeFields = []string{"type", "id", "topic"}
+
+// wrap merges the envelope into a JSON object, anything else and objects whose keys collide
+// with the envelope are put into the data field
+func (e Envelope) wrap(body []byte) ([]byte, error) {
+	envelope, err := json.Marshal(e)
+	if err != nil {
+		return nil, fmt.Errorf("json marshal: %w", err)
+	}
+
+	body = bytes.TrimSpace(body)
+	if len(body) < 2 || body[0] != '{' || collides(body) {
+		data := append(envelope[:len(envelope)-1], `,"data":`...)
+		return append(append(data, body...), '}'), nil
+	}
+	if bytes.Equal(body, []byte("{}")) {
+		return envelope, nil
+	}
+	return append(append(envelope[:len(envelope)-1], ','), body[1:]...), nil
+}
+
+func collides(body []byte) bool {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return true
+	}
+	for _, field := range envelopeFields {
+		if _, ok := fields[field]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ActionRequest is an action received over a connection, replies to it carry the same message type and id
+type ActionRequest struct {
+	ActionPayload
+	conn *Connection
+	mt   int
+}
+
+// raw returns params, or the value for clients which send the older shape
+func (p ActionPayload) raw() []byte {
+	if len(p.Params) > 0 {
+		return p.Params
+	}
+	return []byte(p.Value)
+}
+
+// Decode reads params of the action into v, older clients send them JSON encoded in value,
+// or a plain string in value for params implementing valueParams
+func (p ActionPayload) Decode(v interface{}) error {
+	if params, ok := v.(valueParams); ok && len(p.Params) == 0 {
+		params.setValue(p.Value)
+		return nil
+	}
+	return json.Unmarshal(p.raw(), v)
+}
+
+// valueParams are params which older clients send as a plain string value
+type valueParams interface {
+	setValue(value string)
+}
+
+// TopicParams are params of SUBSCRIBE and UNSUBSCRIBE
+type TopicParams struct {
+	Topic Topic `json:"topic"`
+}
+
+func (p *TopicParams) setValue(value string) {
+	p.Topic = Topic(value)
+}
+
+// SessionParams are params of REMOVE_SESSION and REMOVE_ALL_IMAGES
+type SessionParams struct {
+	Session string `json:"session"`
+}
+
+func (p *SessionParams) setValue(value string) {
+	p.Session = value
+}
+
+// StartTimelapseParams are params of START_TIMELAPSE
+type StartTimelapseParams struct {
+	Name string `json:"name"`
+}
+
+func (p *StartTimelapseParams) setValue(value string) {
+	p.Name = value
+}
+
+// UsernameParams are params of DELETE_USER
+type UsernameParams struct {
+	Username string `json:"username"`
+}
+
+func (p *UsernameParams) setValue(value string) {
+	p.Username = value
+}
+
+// RunRetentionParams are params of RUN_RETENTION, older clients send value "dryRun"
+type RunRetentionParams struct {
+	DryRun bool `json:"dryRun"`
+}
+
+func (p *RunRetentionParams) setValue(value string) {
+	p.DryRun = value == "dryRun"
+}
+
+// ProtocolVersion is raised on every change of the websocket protocol, version 1 had no ids, params nor envelope
+const ProtocolVersion = 2
+
+// Feature is an optional part of the server which clients may check before offering it
+type Feature string
+
+const (
+	FeatureStreaming  Feature = "STREAMING"
+	FeaturePreview    Feature = "PREVIEW"
+	FeatureRendering  Feature = "RENDERING"
+	FeatureMp4        Feature = "MP4"
+	FeatureUpload     Feature = "UPLOAD"
+	FeatureSignedUrls Feature = "SIGNED_URLS"
+)
+
+// HelloParams are params of HELLO, clients report the newest protocol version they speak
+type HelloParams struct {
+	ProtocolVersion int    `json:"protocolVersion"`
+	Client          string `json:"client"`
+}
+
+type SupportedAction struct {
+	Action Action    `json:"action"`
+	Role   auth.Role `json:"role,omitempty"`
+}
+
+// HelloResponse tells the client what the server supports, status is NOT_SUPPORTED
+// when the client needs a newer protocol than the server speaks
+type HelloResponse struct {
+	ActionResponse
+	ProtocolVersion int               `json:"protocolVersion"`
+	Actions         []SupportedAction `json:"actions"`
+	Topics          []TopicResponse   `json:"topics"`
+	Features        []Feature         `json:"features"`
+	SchemaUrl       string            `json:"schemaUrl"`
+	// StreamUrl plays the live stream when streaming is enabled, pass the token in the query
+	StreamUrl string `json:"streamUrl,omitempty"`
+}
+
+func (a Api) hello(params HelloParams) HelloResponse {
+	response := HelloResponse{
+		ActionResponse:  ActionResponse{Action: ActionHello, Status: ActionStatusSuccess},
+		ProtocolVersion: ProtocolVersion,
+		Topics:          NewTopicsResponse().Topics,
+		Features:        a.features(),
+		SchemaUrl:       "/api/v1/schema",
+	}
+	if a.settings.Get().Streaming {
+		response.StreamUrl = streamPath
+	}
+	if params.ProtocolVersion > ProtocolVersion {
+		msg := fmt.Sprintf("server speaks protocol version %d", ProtocolVersion)
+		response.Status, response.Message = ActionStatusNotSupported, &msg
+	}
+	for _, spec := range actionSpecs {
+		action := SupportedAction{Action: spec.Action}
+		if !publicActions[spec.Action] {
+			action.Role = actionRole(spec.Action)
+		}
+		response.Actions = append(response.Actions, action)
+	}
+	return response
+}
+
+func (a Api) features() []Feature {
+	features := []Feature{FeaturePreview, FeatureRendering, FeatureSignedUrls}
+	if a.settings.Get().Streaming {
+		features = append(features, FeatureStreaming)
+	}
+	if _, err := exec.LookPath(a.cfg.RenderFfmpegPath); err == nil {
+		features = append(features, FeatureMp4)
+	}
+	if a.cfg.UploadBackend != "" {
+		features = append(features, FeatureUpload)
+	}
+	return features
+}
@@ -0,0 +1,39 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestEnvelope(t *testing.T) {
+	cases := map[string]string{
+		`{"status":"SUCCESS"}`: `{"type":"RESPONSE","id":7,"status":"SUCCESS"}`,
+		`{}`:                   `{"type":"RESPONSE","id":7}`,
+		`[1,2]`:                `{"type":"RESPONSE","id":7,"data":[1,2]}`,
+		`{"id":"job"}`:         `{"type":"RESPONSE","id":7,"data":{"id":"job"}}`,
+	}
+	for body, expected := range cases {
+		wrapped, err := Envelope{Type: MessageTypeResponse, Id: []byte("7")}.wrap([]byte(body))
+		if err != nil || string(wrapped) != expected {
+			t.Errorf("%s: expected %s, got %s %v", body, expected, wrapped, err)
+		}
+	}
+}
+
+func TestDecodeParams(t *testing.T) {
+	legacy, params := ActionPayload{}, ActionPayload{}
+	_ = json.Unmarshal([]byte(`{"action":"SUBSCRIBE","value":"photos"}`), &legacy)
+	_ = json.Unmarshal([]byte(`{"id":"a","action":"SUBSCRIBE","params":{"topic":"photos"}}`), &params)
+	for _, payload := range []ActionPayload{legacy, params} {
+		topic := TopicParams{}
+		if err := payload.Decode(&topic); err != nil || topic.Topic != "photos" {
+			t.Errorf("expected photos topic, got %q %v", topic.Topic, err)
+		}
+	}
+
+	retention := RunRetentionParams{}
+	_ = ActionPayload{Value: "dryRun"}.Decode(&retention)
+	if !retention.DryRun {
+		t.Error("expected legacy dryRun value to be read")
+	}
+}
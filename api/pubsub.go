@@ -2,10 +2,14 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gofiber/contrib/websocket"
 	"github.com/rs/zerolog/log"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Topic string
@@ -17,6 +21,12 @@ func (t Topic) ToUpper() Topic {
 const (
 	StatisticsTopic Topic = "STATISTICS"
 	PhotosTopic     Topic = "PHOTOS"
+	RendersTopic    Topic = "RENDERS"
+	SettingsTopic   Topic = "SETTINGS"
+	StatusTopic     Topic = "STATUS"
+	DiskTopic       Topic = "DISK"
+	AuditTopic      Topic = "AUDIT"
+	PreviewTopic    Topic = "PREVIEW"
 )
 
 type TopicsWhitelist []Topic
@@ -30,68 +40,258 @@ func (w TopicsWhitelist) Contains(topic Topic) bool {
 	return false
 }
 
-var WhitelistedTopics = TopicsWhitelist{StatisticsTopic, PhotosTopic}
+var WhitelistedTopics = TopicsWhitelist{StatisticsTopic, PhotosTopic, RendersTopic, SettingsTopic, StatusTopic, DiskTopic, AuditTopic, PreviewTopic}
 
+// TopicDescriptions tells clients what is published to each whitelisted topic
+var TopicDescriptions = map[Topic]string{
+	StatisticsTopic: "System statistics, published periodically",
+	PhotosTopic:     "Every photo taken",
+	RendersTopic:    "Progress and result of timelapse renders",
+	SettingsTopic:   "Camera settings after each change",
+	StatusTopic:     "Timelapse session state after each transition",
+	DiskTopic:       "Free disk space state after it changes",
+	AuditTopic:      "Security events like banned logins",
+	PreviewTopic:    "Small jpeg snapshots in binary messages, taken periodically while somebody is subscribed",
+}
+
+// SlowConsumerPolicy decides what happens to a topic message when the queue of a connection is full
+type SlowConsumerPolicy string
+
+const (
+	// PolicyDrop drops the message, the connection gets the next one which fits into the queue
+	PolicyDrop SlowConsumerPolicy = "drop"
+	// PolicyDisconnect closes the connection, the client is expected to reconnect
+	PolicyDisconnect SlowConsumerPolicy = "disconnect"
+)
+
+const (
+	writeTimeout = 10 * time.Second
+	// responses to actions wait this long for a place in a full queue before the connection is closed
+	sendTimeout = 5 * time.Second
+)
+
+var (
+	TopicNotWhitelistedErr = fmt.Errorf("topic not whitelisted")
+	ErrConnectionClosed    = errors.New("connection closed")
+)
+
+type outbound struct {
+	messageType int
+	data        []byte
+}
+
+// Connection is a websocket with its own writer goroutine, everything written to the socket goes through its queue,
+// so responses and topic messages are never written concurrently
 type Connection struct {
-	Conn        *websocket.Conn
-	MessageType int // the type of message for websocket
+	Conn *websocket.Conn
+
+	queue     chan outbound
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+	dropped   atomic.Int64
+}
+
+func (c *Connection) write() {
+	defer close(c.stopped)
+	for {
+		select {
+		case msg := <-c.queue:
+			_ = c.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := c.Conn.WriteMessage(msg.messageType, msg.data); err != nil {
+				log.Err(err).Msg("write message")
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// close stops the writer and closes the socket, so the read loop of the handler ends too
+func (c *Connection) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		_ = c.Conn.Close()
+	})
+}
+
+// Send queues a response, it waits for a while when the queue is full and closes the connection if it stays full
+func (c *Connection) Send(messageType int, data []byte) error {
+	timer := time.NewTimer(sendTimeout)
+	defer timer.Stop()
+	select {
+	case c.queue <- outbound{messageType: messageType, data: data}:
+		return nil
+	case <-c.done:
+		return ErrConnectionClosed
+	case <-timer.C:
+		log.Warn().Msg("websocket client doesn't read responses, closing connection")
+		c.close()
+		return ErrConnectionClosed
+	}
+}
+
+// offer queues a topic message without waiting, false means the queue is full or the connection closed
+func (c *Connection) offer(messageType int, data []byte) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	select {
+	case c.queue <- outbound{messageType: messageType, data: data}:
+		return true
+	default:
+		return false
+	}
 }
 
+// Dropped returns how many topic messages didn't fit into the queue
+func (c *Connection) Dropped() int64 {
+	return c.dropped.Load()
+}
+
+// PubSub sends topic messages to subscribed connections, it's safe to use from any goroutine
 type PubSub struct {
-	Subscribers map[Topic][]*Connection
+	queueSize int
+	policy    SlowConsumerPolicy
+
+	mu          sync.RWMutex
+	subscribers map[Topic]map[*Connection]int // message type of each subscriber
 }
 
-func NewPubSub() *PubSub {
+func NewPubSub(queueSize int, policy SlowConsumerPolicy) *PubSub {
 	return &PubSub{
-		Subscribers: make(map[Topic][]*Connection),
+		queueSize:   queueSize,
+		policy:      policy,
+		subscribers: make(map[Topic]map[*Connection]int),
 	}
 }
 
-var TopicNotWhitelistedErr = fmt.Errorf("topic not whitelisted")
+// Connect starts the writer of the websocket, Disconnect must be called once the connection is closed
+func (p *PubSub) Connect(c *websocket.Conn) *Connection {
+	conn := &Connection{
+		Conn:    c,
+		queue:   make(chan outbound, p.queueSize),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go conn.write()
+	return conn
+}
+
+// Disconnect removes all subscriptions of the connection and waits for its writer to stop
+func (p *PubSub) Disconnect(conn *Connection) {
+	p.UnsubscribeFromAll(conn)
+	conn.close()
+	<-conn.stopped
+}
 
-func (p *PubSub) Subscribe(c *websocket.Conn, messageType int, topic Topic) error {
+func (p *PubSub) Subscribe(conn *Connection, messageType int, topic Topic) error {
 	topic = topic.ToUpper()
 	if !WhitelistedTopics.Contains(topic) {
 		return TopicNotWhitelistedErr
 	}
-	p.Subscribers[topic] = append(p.Subscribers[topic], &Connection{Conn: c, MessageType: messageType})
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.subscribers[topic] == nil {
+		p.subscribers[topic] = make(map[*Connection]int)
+	}
+	p.subscribers[topic][conn] = messageType
 	return nil
 }
 
-func (p *PubSub) Unsubscribe(c *websocket.Conn, topic Topic) {
-	topic = topic.ToUpper()
-	for i, subscriber := range p.Subscribers[topic] {
-		if subscriber.Conn == c {
-			p.Subscribers[topic] = append(p.Subscribers[topic][:i], p.Subscribers[topic][i+1:]...)
-			break
-		}
+func (p *PubSub) Unsubscribe(conn *Connection, topic Topic) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.subscribers[topic.ToUpper()], conn)
+}
+
+func (p *PubSub) UnsubscribeFromAll(conn *Connection) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, subscribers := range p.subscribers {
+		delete(subscribers, conn)
 	}
 }
 
-func (p *PubSub) UnsubscribeFromAll(c *websocket.Conn) {
-	for topic := range p.Subscribers {
-		p.Unsubscribe(c, topic)
+// Subscriptions returns topics the connection is subscribed to, in the order of WhitelistedTopics
+func (p *PubSub) Subscriptions(conn *Connection) []Topic {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	topics := []Topic{}
+	for _, topic := range WhitelistedTopics {
+		if _, ok := p.subscribers[topic][conn]; ok {
+			topics = append(topics, topic)
+		}
 	}
+	return topics
+}
+
+// Subscribers returns how many connections are subscribed to the topic
+func (p *PubSub) Subscribers(topic Topic) int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.subscribers[topic])
 }
 
+// Publish queues the message for every subscriber without waiting for slow ones,
+// when a queue is full the message is dropped or the connection is closed depending on the policy
 func (p *PubSub) Publish(topic Topic, message []byte) {
-	if len(p.Subscribers[topic]) == 0 {
+	p.publish(topic, message, false)
+}
+
+// PublishBinary sends the message as a binary websocket message regardless of what the subscribers use
+func (p *PubSub) PublishBinary(topic Topic, message []byte) {
+	p.publish(topic, message, true)
+}
+
+func (p *PubSub) publish(topic Topic, message []byte, binary bool) {
+	p.mu.RLock()
+	subscribers := make(map[*Connection]int, len(p.subscribers[topic]))
+	for conn, messageType := range p.subscribers[topic] {
+		subscribers[conn] = messageType
+	}
+	p.mu.RUnlock()
+	if len(subscribers) == 0 {
 		return
 	}
 
-	log.Debug().Msgf("Publishing to topic %s: %s", topic, string(message))
-	for _, subscriber := range p.Subscribers[topic] {
-		if err := subscriber.Conn.WriteMessage(subscriber.MessageType, message); err != nil {
-			p.Unsubscribe(subscriber.Conn, topic) // unsubscribe if error
+	if binary {
+		log.Debug().Msgf("Publishing %d bytes to topic %s", len(message), topic)
+	} else {
+		log.Debug().Msgf("Publishing to topic %s: %s", topic, string(message))
+	}
+	for conn, messageType := range subscribers {
+		if binary {
+			messageType = websocket.BinaryMessage
+		}
+		if conn.offer(messageType, message) {
+			continue
+		}
+
+		if p.policy == PolicyDisconnect {
+			log.Warn().Str("topic", string(topic)).Msg("slow websocket client disconnected")
+			p.UnsubscribeFromAll(conn)
+			conn.close()
+		} else if conn.dropped.Add(1) == 1 {
+			log.Warn().Str("topic", string(topic)).Msg("slow websocket client, dropping messages")
 		}
 	}
 }
 
+// PublishJson publishes the message in an event envelope naming the topic
 func (p *PubSub) PublishJson(topic Topic, message interface{}) error {
 	by, err := json.Marshal(message)
 	if err != nil {
 		return fmt.Errorf("json marshal: %w", err)
 	}
+	if by, err = (Envelope{Type: MessageTypeEvent, Topic: topic}).wrap(by); err != nil {
+		return err
+	}
 
 	p.Publish(topic, by)
 	return nil
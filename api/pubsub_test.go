@@ -0,0 +1,108 @@
+package api
+
+import (
+	"fmt"
+	fasthttpws "github.com/fasthttp/websocket"
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPublishFromManyGoroutines(t *testing.T) {
+	pubSub := NewPubSub(64, PolicyDrop)
+	subscribed, closed := make(chan struct{}), make(chan *Connection, 1)
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Get("/ws", websocket.New(func(ws *websocket.Conn) {
+		c := pubSub.Connect(ws)
+		_ = pubSub.Subscribe(c, websocket.TextMessage, PhotosTopic)
+		close(subscribed)
+		_, _, _ = ws.ReadMessage()
+		pubSub.Disconnect(c)
+		closed <- c
+	}))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = app.Listener(ln) }()
+	defer app.Shutdown()
+
+	client, _, err := fasthttpws.DefaultDialer.Dial(fmt.Sprintf("ws://%s/ws", ln.Addr()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-subscribed
+
+	const publishers = 40
+	wg := sync.WaitGroup{}
+	for i := 0; i < publishers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_ = pubSub.PublishJson(PhotosTopic, i)
+		}(i)
+	}
+	wg.Wait()
+
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < publishers; i++ {
+		if _, _, err = client.ReadMessage(); err != nil {
+			t.Fatalf("expected %d messages, got %d: %s", publishers, i, err)
+		}
+	}
+
+	_ = client.Close()
+	c := <-closed
+	pubSub.mu.RLock()
+	defer pubSub.mu.RUnlock()
+	if _, ok := pubSub.subscribers[PhotosTopic][c]; ok {
+		t.Error("expected closed connection to be unsubscribed")
+	}
+}
+
+func TestSlowSubscriberDropsMessages(t *testing.T) {
+	pubSub := NewPubSub(2, PolicyDrop)
+	// no writer is started, so the queue fills up like with a client that doesn't read
+	c := &Connection{queue: make(chan outbound, 2), done: make(chan struct{}), stopped: make(chan struct{})}
+	_ = pubSub.Subscribe(c, websocket.TextMessage, PhotosTopic)
+
+	for i := 0; i < 5; i++ {
+		pubSub.Publish(PhotosTopic, []byte{byte(i)})
+	}
+	if len(c.queue) != 2 || c.Dropped() != 3 {
+		t.Errorf("expected 2 queued and 3 dropped messages, got %d and %d", len(c.queue), c.Dropped())
+	}
+}
+
+func TestSubscriptions(t *testing.T) {
+	pubSub := NewPubSub(1, PolicyDrop)
+	c := &Connection{}
+	_ = pubSub.Subscribe(c, websocket.TextMessage, "photos")
+	_ = pubSub.Subscribe(c, websocket.TextMessage, StatisticsTopic)
+	pubSub.Unsubscribe(c, "Photos")
+
+	if topics := pubSub.Subscriptions(c); len(topics) != 1 || topics[0] != StatisticsTopic {
+		t.Errorf("expected only statistics subscription, got %v", topics)
+	}
+	pubSub.UnsubscribeFromAll(c)
+	if topics := pubSub.Subscriptions(c); len(topics) != 0 {
+		t.Errorf("expected no subscriptions, got %v", topics)
+	}
+}
+
+func TestPublishBinary(t *testing.T) {
+	pubSub := NewPubSub(1, PolicyDrop)
+	c := &Connection{queue: make(chan outbound, 1), done: make(chan struct{}), stopped: make(chan struct{})}
+	_ = pubSub.Subscribe(c, websocket.TextMessage, PreviewTopic)
+	if pubSub.Subscribers(PreviewTopic) != 1 {
+		t.Fatal("expected one preview subscriber")
+	}
+
+	pubSub.PublishBinary(PreviewTopic, []byte{0xff, 0xd8})
+	if msg := <-c.queue; msg.messageType != websocket.BinaryMessage {
+		t.Errorf("expected binary message, got type %d", msg.messageType)
+	}
+}
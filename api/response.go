@@ -2,9 +2,15 @@ package api
 
 import (
 	"encoding/json"
-	"github.com/gofiber/contrib/websocket"
+	"github.com/macrosiak/rspi-timelaps-manager-go/auth"
+	"github.com/macrosiak/rspi-timelaps-manager-go/catalog"
+	"github.com/macrosiak/rspi-timelaps-manager-go/derivatives"
+	"github.com/macrosiak/rspi-timelaps-manager-go/render"
+	"github.com/macrosiak/rspi-timelaps-manager-go/schedule"
+	"github.com/macrosiak/rspi-timelaps-manager-go/session"
 	. "github.com/macrosiak/rspi-timelaps-manager-go/system_stats"
 	"github.com/rs/zerolog/log"
+	"time"
 )
 
 type WebsocketStatsResponse struct {
@@ -12,40 +18,85 @@ type WebsocketStatsResponse struct {
 }
 
 type WebsocketErrorResponse struct {
-	Error ActionStatus `json:"error"`
+	Error  ActionStatus `json:"error"`
+	Action Action       `json:"action,omitempty"`
 }
 
-func sendStruct(c *websocket.Conn, mt int, theStruct interface{}) {
+// sendStruct replies to the request with the struct in a response envelope
+func sendStruct(r ActionRequest, theStruct interface{}) {
 	respJson, err := json.Marshal(theStruct)
 	if err != nil {
 		log.Err(err).Msg("json marshal")
+		return
+	}
+	if respJson, err = (Envelope{Type: MessageTypeResponse, Id: r.Id}).wrap(respJson); err != nil {
+		log.Err(err).Msg("wrap response")
+		return
 	}
 
-	if err = c.WriteMessage(mt, respJson); err != nil {
-		log.Err(err).Msg("write message")
+	if err = r.conn.Send(r.mt, respJson); err != nil {
+		log.Err(err).Msg("send message")
 	}
 }
 
-func SendError(c *websocket.Conn, mt int, websocketError ActionStatus) {
+func SendError(r ActionRequest, websocketError ActionStatus) {
 	response := WebsocketErrorResponse{
-		Error: websocketError,
+		Error:  websocketError,
+		Action: r.Action,
 	}
 
-	sendStruct(c, mt, response)
+	sendStruct(r, response)
 }
 
 type Action string
 
 const (
 	ActionRemoveAllImages = "REMOVE_ALL_IMAGES"
-	ActionAuth            = "AUTH"
-	ActionSubscribe       = "SUBSCRIBE"
-	ActionUnsubscribe     = "UNSUBSCRIBE"
+	ActionRenderTimelapse = "RENDER_TIMELAPSE"
+	ActionListRenders     = "LIST_RENDERS"
+	ActionGetSchedule     = "GET_SCHEDULE"
+	ActionSetSchedule     = "SET_SCHEDULE"
+	ActionGetSettings     = "GET_SETTINGS"
+	ActionUpdateSettings  = "UPDATE_SETTINGS"
+
+	ActionGetTimelapseStatus = "GET_TIMELAPSE_STATUS"
+	ActionStartTimelapse     = "START_TIMELAPSE"
+	ActionPauseTimelapse     = "PAUSE_TIMELAPSE"
+	ActionResumeTimelapse    = "RESUME_TIMELAPSE"
+	ActionStopTimelapse      = "STOP_TIMELAPSE"
+
+	ActionListSessions       = "LIST_SESSIONS"
+	ActionRemoveSession      = "REMOVE_SESSION"
+	ActionImportLegacyPhotos = "IMPORT_LEGACY_PHOTOS"
+	ActionTakePhoto          = "TAKE_PHOTO"
+
+	ActionGetRetention = "GET_RETENTION"
+	ActionSetRetention = "SET_RETENTION"
+	ActionRunRetention = "RUN_RETENTION"
+
+	ActionListUsers  = "LIST_USERS"
+	ActionCreateUser = "CREATE_USER"
+	ActionUpdateUser = "UPDATE_USER"
+	ActionDeleteUser = "DELETE_USER"
+
+	ActionHello       = "HELLO"
+	ActionAuth        = "AUTH"
+	ActionLogout      = "LOGOUT"
+	ActionShareFile   = "SHARE_FILE"
+	ActionSubscribe   = "SUBSCRIBE"
+	ActionUnsubscribe = "UNSUBSCRIBE"
+
+	ActionListSubscriptions = "LIST_SUBSCRIPTIONS"
+	ActionListTopics        = "LIST_TOPICS"
 )
 
+// ActionPayload is an action sent by a client, the optional id is echoed in the reply,
+// params replace value, which is still accepted from older clients
 type ActionPayload struct {
-	Action Action `json:"action"`
-	Value  string `json:"value"`
+	Id     json.RawMessage `json:"id,omitempty"`
+	Action Action          `json:"action"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Value  string          `json:"value"`
 }
 
 type ActionStatus string
@@ -55,7 +106,15 @@ const (
 	ActionStatusUnknownError       ActionStatus = "UNKNOWN_ERROR"
 	ActionStatusWrongCredentials   ActionStatus = "WRONG_CREDENTIALS"
 	ActionStatusInvalidTopic       ActionStatus = "INVALID_TOPIC"
+	ActionStatusInvalidValue       ActionStatus = "INVALID_VALUE"
+	ActionStatusBusy               ActionStatus = "BUSY"
+	ActionStatusNotFound           ActionStatus = "NOT_FOUND"
+	ActionStatusNotSupported       ActionStatus = "NOT_SUPPORTED"
+	ActionStatusInvalidState       ActionStatus = "INVALID_STATE"
 	ActionStatusNotAuthorisedError ActionStatus = "NOT_AUTHORISED"
+	ActionStatusTooManyAttempts    ActionStatus = "TOO_MANY_ATTEMPTS"
+	ActionStatusForbidden          ActionStatus = "FORBIDDEN"
+	ActionStatusCapturePaused      ActionStatus = "CAPTURE_PAUSED"
 )
 
 type ActionResponse struct {
@@ -64,16 +123,149 @@ type ActionResponse struct {
 	Message *string      `json:"message"`
 }
 
-func SendStatus(c *websocket.Conn, mt int, action Action, status ActionStatus, message *string) {
+func SendStatus(r ActionRequest, status ActionStatus, message *string) {
 	response := ActionResponse{
-		Action:  action,
+		Action:  r.Action,
 		Status:  status,
 		Message: message,
 	}
-	sendStruct(c, mt, response)
+	sendStruct(r, response)
+}
+
+// SubscriptionsResponse answers LIST_SUBSCRIPTIONS and UNSUBSCRIBE with topics the connection still receives
+type SubscriptionsResponse struct {
+	ActionResponse
+	Topics []Topic `json:"topics"`
+}
+
+type TopicResponse struct {
+	Topic       Topic     `json:"topic"`
+	Description string    `json:"description"`
+	Role        auth.Role `json:"role"`
+}
+
+type TopicsResponse struct {
+	ActionResponse
+	Topics []TopicResponse `json:"topics"`
+}
+
+func NewTopicsResponse() TopicsResponse {
+	response := TopicsResponse{ActionResponse: ActionResponse{Action: ActionListTopics, Status: ActionStatusSuccess}}
+	for _, topic := range WhitelistedTopics {
+		response.Topics = append(response.Topics, TopicResponse{Topic: topic, Description: TopicDescriptions[topic], Role: topicRole(topic)})
+	}
+	return response
 }
 
+// PhotoResponse links thumbnail and preview only for formats derivatives are generated for
 type PhotoResponse struct {
-	Photo     string `json:"photo"`
-	CreatedAt int64  `json:"createdAt"`
+	Photo        string `json:"photo"`
+	CreatedAt    int64  `json:"createdAt"`
+	Url          string `json:"url"`
+	ThumbnailUrl string `json:"thumbnailUrl,omitempty"`
+	PreviewUrl   string `json:"previewUrl,omitempty"`
+}
+
+// NewPhotoResponse links the photo with a signed url, so clients can load it without sending a token
+func NewPhotoResponse(photo *catalog.Photo, signer *auth.Signer) PhotoResponse {
+	response := PhotoResponse{
+		Photo:     photo.FileName,
+		CreatedAt: photo.TakenAt,
+		Url:       signer.URL(PhotoPath(photo)),
+	}
+	if derivatives.Supported(*photo) {
+		response.ThumbnailUrl = signer.URL(DerivativePath(photo, derivatives.KindThumbnail))
+		response.PreviewUrl = signer.URL(DerivativePath(photo, derivatives.KindWeb))
+	}
+	return response
+}
+
+func PhotoPath(photo *catalog.Photo) string {
+	return "/photos/" + photo.RelativePath()
+}
+
+// DerivativePath doesn't contain the session, derivatives are looked up in the catalog by the photo name
+func DerivativePath(photo *catalog.Photo, kind derivatives.Kind) string {
+	return derivativesPath + "/" + string(kind) + "/" + photo.FileName + derivativeExt
+}
+
+// PhotoDetailsResponse extends PhotoResponse with everything the catalog knows about the photo
+type PhotoDetailsResponse struct {
+	PhotoResponse
+	*catalog.Photo
+}
+
+func NewPhotoDetailsResponse(photo *catalog.Photo, signer *auth.Signer) PhotoDetailsResponse {
+	return PhotoDetailsResponse{
+		PhotoResponse: NewPhotoResponse(photo, signer),
+		Photo:         photo,
+	}
+}
+
+func RenderPath(output string) string {
+	return "/renders/" + output
+}
+
+type ScheduleResponse struct {
+	Schedule    schedule.Schedule `json:"schedule"`
+	NextPhotoAt *int64            `json:"nextPhotoAt"`
+}
+
+func NewScheduleResponse(s schedule.Schedule) ScheduleResponse {
+	response := ScheduleResponse{Schedule: s}
+	if next, ok := s.Next(time.Now()); ok {
+		nextUnix := next.Unix()
+		response.NextPhotoAt = &nextUnix
+	}
+	return response
+}
+
+// RenderJobResponse describes a render job, its id is sent as jobId, so it never collides with the envelope id
+type RenderJobResponse struct {
+	JobId       string          `json:"jobId"`
+	Request     render.Request  `json:"request"`
+	State       render.JobState `json:"state"`
+	FramesTotal int             `json:"framesTotal"`
+	FramesDone  int             `json:"framesDone"`
+	Output      string          `json:"output"`
+	Error       *string         `json:"error"`
+	CreatedAt   int64           `json:"createdAt"`
+	FinishedAt  *int64          `json:"finishedAt"`
+	Progress    float64         `json:"progress"`
+	Url         *string         `json:"url"`
+}
+
+func NewRenderJobResponse(job render.Job, signer *auth.Signer) RenderJobResponse {
+	response := RenderJobResponse{
+		JobId:       job.Id,
+		Request:     job.Request,
+		State:       job.State,
+		FramesTotal: job.FramesTotal,
+		FramesDone:  job.FramesDone,
+		Output:      job.Output,
+		Error:       job.Error,
+		CreatedAt:   job.CreatedAt,
+		FinishedAt:  job.FinishedAt,
+		Progress:    job.Progress(),
+	}
+	if job.State == render.JobStateDone {
+		url := signer.URL(RenderPath(job.Output))
+		response.Url = &url
+	}
+	return response
+}
+
+// SessionResponse is a session manifest together with what is left of its photos in the catalog
+type SessionResponse struct {
+	session.Session
+	Photos catalog.Summary `json:"photos"`
+	Active bool            `json:"active"`
+}
+
+type SessionsResponse struct {
+	Sessions []SessionResponse `json:"sessions"`
+}
+
+type RenderJobsResponse struct {
+	Renders []RenderJobResponse `json:"renders"`
 }
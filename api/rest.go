@@ -0,0 +1,378 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gofiber/fiber/v2"
+	"github.com/macrosiak/rspi-timelaps-manager-go/auth"
+	"github.com/macrosiak/rspi-timelaps-manager-go/camera"
+	"github.com/macrosiak/rspi-timelaps-manager-go/catalog"
+	"github.com/macrosiak/rspi-timelaps-manager-go/retention"
+	"github.com/macrosiak/rspi-timelaps-manager-go/session"
+	"github.com/macrosiak/rspi-timelaps-manager-go/settings"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// CaptureRequest describes a manual shot, nil Settings means the current settings are used
+// and excluded photos are stored outside of the session, so they are not part of the timelapse
+type CaptureRequest struct {
+	Settings            *camera.CameraSettings
+	ExcludeFromSequence bool
+}
+
+// Capturer is implemented by the camera worker
+type Capturer interface {
+	Capture(request CaptureRequest) (*catalog.Photo, error)
+}
+
+// TakePhotoRequest is the body of TAKE_PHOTO action and POST /photos, settings override only the fields
+// which are present, e.g. {"settings": {"width": "640", "height": "480"}, "excludeFromSequence": true}
+type TakePhotoRequest struct {
+	Settings            json.RawMessage `json:"settings"`
+	ExcludeFromSequence bool            `json:"excludeFromSequence"`
+}
+
+// parseTakePhotoRequest builds capture request from the body, empty body takes a regular photo
+func (a Api) parseTakePhotoRequest(body []byte) (CaptureRequest, error) {
+	request := TakePhotoRequest{}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &request); err != nil {
+			return CaptureRequest{}, err
+		}
+	}
+
+	captureRequest := CaptureRequest{ExcludeFromSequence: request.ExcludeFromSequence}
+	if len(request.Settings) == 0 {
+		return captureRequest, nil
+	}
+
+	cameraSettings := a.settings.Get().CameraSettings()
+	if err := json.Unmarshal(request.Settings, cameraSettings); err != nil {
+		return CaptureRequest{}, err
+	}
+	if err := cameraSettings.Validate(); err != nil {
+		return CaptureRequest{}, err
+	}
+	captureRequest.Settings = cameraSettings
+	return captureRequest, nil
+}
+
+type RestErrorResponse struct {
+	Error   ActionStatus `json:"error"`
+	Message *string      `json:"message"`
+}
+
+type PhotosPageResponse struct {
+	Photos []PhotoDetailsResponse `json:"photos"`
+	Total  int                    `json:"total"`
+	Offset int                    `json:"offset"`
+	Limit  int                    `json:"limit"`
+}
+
+type RemovedPhotosResponse struct {
+	Removed int `json:"removed"`
+}
+
+type StartTimelapseRequest struct {
+	Name string `json:"name"`
+}
+
+func httpStatus(status ActionStatus) int {
+	switch status {
+	case ActionStatusNotAuthorisedError, ActionStatusWrongCredentials:
+		return fiber.StatusUnauthorized
+	case ActionStatusInvalidValue, ActionStatusInvalidTopic:
+		return fiber.StatusBadRequest
+	case ActionStatusNotFound:
+		return fiber.StatusNotFound
+	case ActionStatusForbidden:
+		return fiber.StatusForbidden
+	case ActionStatusTooManyAttempts:
+		return fiber.StatusTooManyRequests
+	case ActionStatusBusy, ActionStatusInvalidState, ActionStatusCapturePaused:
+		return fiber.StatusConflict
+	case ActionStatusNotSupported:
+		return fiber.StatusNotImplemented
+	}
+	return fiber.StatusInternalServerError
+}
+
+func SendRestError(c *fiber.Ctx, status ActionStatus, message *string) error {
+	return c.Status(httpStatus(status)).JSON(RestErrorResponse{Error: status, Message: message})
+}
+
+func sendRestErr(c *fiber.Ctx, status ActionStatus, err error) error {
+	msg := err.Error()
+	return SendRestError(c, status, &msg)
+}
+
+func (a Api) registerRestRoutes(app *fiber.App) {
+	// login and schema are registered before the group, so they don't require a token
+	app.Post("/api/v1/auth/login", a.restLogin)
+	app.Get("/api/v1/schema", a.restSchema)
+	v1 := app.Group("/api/v1", a.restAuth)
+	v1.Post("/auth/logout", a.restLogout)
+
+	viewer, operator, admin := a.restRole(auth.RoleViewer), a.restRole(auth.RoleOperator), a.restRole(auth.RoleAdmin)
+
+	v1.Get("/photos", viewer, a.restListPhotos)
+	v1.Post("/photos", operator, a.restCapturePhoto)
+	v1.Delete("/photos", operator, a.restRemovePhotos)
+	v1.Get("/photos/:name", viewer, a.restGetPhoto)
+
+	v1.Get("/camera/settings", viewer, a.restGetCameraSettings)
+	v1.Put("/camera/settings", operator, a.restUpdateCameraSettings)
+	v1.Patch("/camera/settings", operator, a.restUpdateCameraSettings)
+
+	v1.Get("/sessions", viewer, a.restListSessions)
+	v1.Post("/sessions/import-legacy", operator, a.restImportLegacyPhotos)
+	v1.Get("/sessions/:id", viewer, a.restGetSession)
+	v1.Delete("/sessions/:id", operator, a.restRemoveSession)
+
+	v1.Get("/retention", viewer, a.restGetRetention)
+	v1.Put("/retention", operator, a.restSetRetention)
+	v1.Post("/retention/run", operator, a.restRunRetention)
+
+	v1.Get("/stats", viewer, a.restGetStats)
+
+	v1.Post("/share", operator, a.restShareFile)
+
+	v1.Get("/timelapse", viewer, a.restGetTimelapse)
+	v1.Post("/timelapse/start", operator, a.restStartTimelapse)
+	v1.Post("/timelapse/pause", operator, a.restPauseTimelapse)
+	v1.Post("/timelapse/resume", operator, a.restResumeTimelapse)
+	v1.Post("/timelapse/stop", operator, a.restStopTimelapse)
+
+	v1.Get("/users", admin, a.restListUsers)
+	v1.Post("/users", admin, a.restCreateUser)
+	v1.Patch("/users/:username", admin, a.restUpdateUser)
+	v1.Delete("/users/:username", admin, a.restDeleteUser)
+}
+
+// queryTime parses unix timestamp from query, missing value returns zero time
+func queryTime(c *fiber.Ctx, key string) (time.Time, error) {
+	if c.Query(key) == "" {
+		return time.Time{}, nil
+	}
+
+	value := c.QueryInt(key, -1)
+	if value < 0 {
+		return time.Time{}, errors.New(key + " must be unix timestamp")
+	}
+	return time.Unix(int64(value), 0), nil
+}
+
+func (a Api) restListPhotos(c *fiber.Ctx) error {
+	from, err := queryTime(c, "from")
+	if err != nil {
+		return sendRestErr(c, ActionStatusInvalidValue, err)
+	}
+	to, err := queryTime(c, "to")
+	if err != nil {
+		return sendRestErr(c, ActionStatusInvalidValue, err)
+	}
+
+	limit := c.QueryInt("limit", defaultPageSize)
+	offset := c.QueryInt("offset", 0)
+	if limit <= 0 || limit > maxPageSize || offset < 0 {
+		return sendRestErr(c, ActionStatusInvalidValue, errors.New("invalid limit or offset"))
+	}
+
+	query := catalog.Query{From: from, To: to, Session: c.Query("session"), Offset: offset, Limit: limit}
+	photos, total, err := a.photoCatalog.List(query)
+	if err != nil {
+		log.Err(err).Msg("list photos")
+		return SendRestError(c, ActionStatusUnknownError, nil)
+	}
+
+	response := PhotosPageResponse{Photos: []PhotoDetailsResponse{}, Total: total, Offset: offset, Limit: limit}
+	for i := range photos {
+		response.Photos = append(response.Photos, NewPhotoDetailsResponse(&photos[i], a.signer))
+	}
+	return c.JSON(response)
+}
+
+func (a Api) restGetPhoto(c *fiber.Ctx) error {
+	photo, err := a.photoCatalog.Get(c.Params("name"))
+	if errors.Is(err, catalog.ErrNotFound) {
+		return SendRestError(c, ActionStatusNotFound, nil)
+	} else if err != nil {
+		log.Err(err).Msg("get photo")
+		return SendRestError(c, ActionStatusUnknownError, nil)
+	}
+	return c.JSON(NewPhotoDetailsResponse(photo, a.signer))
+}
+
+func (a Api) restCapturePhoto(c *fiber.Ctx) error {
+	request, err := a.parseTakePhotoRequest(c.Body())
+	if err != nil {
+		return sendRestErr(c, ActionStatusInvalidValue, err)
+	}
+
+	photo, err := a.capturer.Capture(request)
+	if err != nil {
+		log.Err(err).Msg("capture photo")
+		return sendRestErr(c, captureErrorStatus(err), err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(NewPhotoDetailsResponse(photo, a.signer))
+}
+
+// restRemovePhotos removes photos taken between from and to, optionally only of one session,
+// at least one of the filters is required
+func (a Api) restRemovePhotos(c *fiber.Ctx) error {
+	from, err := queryTime(c, "from")
+	if err != nil {
+		return sendRestErr(c, ActionStatusInvalidValue, err)
+	}
+	to, err := queryTime(c, "to")
+	if err != nil {
+		return sendRestErr(c, ActionStatusInvalidValue, err)
+	}
+	sessionId := c.Query("session")
+	if from.IsZero() && to.IsZero() && sessionId == "" {
+		return sendRestErr(c, ActionStatusInvalidValue, errors.New("from, to or session is required"))
+	}
+
+	removed, err := a.commandsService.RemovePhotos(sessionId, from, to)
+	if err != nil {
+		log.Err(err).Msg("remove photos")
+		return SendRestError(c, ActionStatusUnknownError, nil)
+	}
+	return c.JSON(RemovedPhotosResponse{Removed: removed})
+}
+
+func (a Api) restGetCameraSettings(c *fiber.Ctx) error {
+	return c.JSON(a.settings.Get())
+}
+
+// restUpdateCameraSettings changes only fields present in the body
+func (a Api) restUpdateCameraSettings(c *fiber.Ctx) error {
+	patch := settings.Patch{}
+	if err := c.BodyParser(&patch); err != nil {
+		return sendRestErr(c, ActionStatusInvalidValue, err)
+	}
+
+	updated, err := a.settings.Update(patch)
+	if err != nil {
+		return sendRestErr(c, ActionStatusInvalidValue, err)
+	}
+	return c.JSON(updated)
+}
+
+func (a Api) restListSessions(c *fiber.Ctx) error {
+	response, err := a.listSessions()
+	if err != nil {
+		log.Err(err).Msg("list sessions")
+		return SendRestError(c, ActionStatusUnknownError, nil)
+	}
+	return c.JSON(response)
+}
+
+func (a Api) restGetSession(c *fiber.Ctx) error {
+	response, err := a.listSessions()
+	if err != nil {
+		log.Err(err).Msg("list sessions")
+		return SendRestError(c, ActionStatusUnknownError, nil)
+	}
+
+	for _, s := range response.Sessions {
+		if s.Id == c.Params("id") {
+			return c.JSON(s)
+		}
+	}
+	return SendRestError(c, ActionStatusNotFound, nil)
+}
+
+func (a Api) restRemoveSession(c *fiber.Ctx) error {
+	removed, err := a.commandsService.RemoveSession(c.Params("id"))
+	if err != nil {
+		return sendRestErr(c, sessionErrorStatus(err), err)
+	}
+	return c.JSON(RemovedPhotosResponse{Removed: removed})
+}
+
+func (a Api) restImportLegacyPhotos(c *fiber.Ctx) error {
+	legacy, err := a.commandsService.ImportLegacyPhotos()
+	if err != nil {
+		log.Err(err).Msg("import legacy photos")
+		return sendRestErr(c, ActionStatusUnknownError, err)
+	}
+	return c.JSON(legacy)
+}
+
+func (a Api) restGetRetention(c *fiber.Ctx) error {
+	return c.JSON(a.retention.Policy())
+}
+
+func (a Api) restSetRetention(c *fiber.Ctx) error {
+	policy := retention.Policy{}
+	if err := c.BodyParser(&policy); err != nil {
+		return sendRestErr(c, ActionStatusInvalidValue, err)
+	}
+
+	if err := a.retention.SetPolicy(policy); err != nil {
+		return sendRestErr(c, ActionStatusInvalidValue, err)
+	}
+	return c.JSON(policy)
+}
+
+// restRunRetention enforces retention policy right away, ?dryRun=true only reports what would be removed
+func (a Api) restRunRetention(c *fiber.Ctx) error {
+	report, err := a.retention.Enforce(c.QueryBool("dryRun"))
+	if err != nil {
+		log.Err(err).Msg("enforce retention")
+		return sendRestErr(c, ActionStatusUnknownError, err)
+	}
+	return c.JSON(report)
+}
+
+func (a Api) restGetStats(c *fiber.Ctx) error {
+	stats, err := a.systemStatsSrv.GetStats()
+	if err != nil {
+		log.Err(err).Msg("get stats")
+		return SendRestError(c, ActionStatusUnknownError, nil)
+	}
+	return c.JSON(stats)
+}
+
+func (a Api) restGetTimelapse(c *fiber.Ctx) error {
+	return c.JSON(a.sessions.Status())
+}
+
+func (a Api) restSessionTransition(c *fiber.Ctx, status session.Status, err error) error {
+	if err != nil {
+		return sendRestErr(c, sessionErrorStatus(err), err)
+	}
+	return c.JSON(status)
+}
+
+func (a Api) restStartTimelapse(c *fiber.Ctx) error {
+	request := StartTimelapseRequest{}
+	if err := c.BodyParser(&request); err != nil {
+		return sendRestErr(c, ActionStatusInvalidValue, err)
+	}
+
+	status, err := a.sessions.Start(request.Name)
+	return a.restSessionTransition(c, status, err)
+}
+
+func (a Api) restPauseTimelapse(c *fiber.Ctx) error {
+	status, err := a.sessions.Pause()
+	return a.restSessionTransition(c, status, err)
+}
+
+func (a Api) restResumeTimelapse(c *fiber.Ctx) error {
+	status, err := a.sessions.Resume()
+	return a.restSessionTransition(c, status, err)
+}
+
+func (a Api) restStopTimelapse(c *fiber.Ctx) error {
+	status, err := a.sessions.Stop()
+	return a.restSessionTransition(c, status, err)
+}
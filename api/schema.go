@@ -0,0 +1,286 @@
+package api
+
+import (
+	"encoding"
+	"encoding/json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/macrosiak/rspi-timelaps-manager-go/auth"
+	"github.com/macrosiak/rspi-timelaps-manager-go/lib"
+	"github.com/macrosiak/rspi-timelaps-manager-go/render"
+	"github.com/macrosiak/rspi-timelaps-manager-go/retention"
+	"github.com/macrosiak/rspi-timelaps-manager-go/safeguard"
+	"github.com/macrosiak/rspi-timelaps-manager-go/schedule"
+	"github.com/macrosiak/rspi-timelaps-manager-go/session"
+	"github.com/macrosiak/rspi-timelaps-manager-go/settings"
+	. "github.com/macrosiak/rspi-timelaps-manager-go/system_stats"
+	"path"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// actionSpec describes params and the reply of an action, nil means the action has no params
+type actionSpec struct {
+	Action   Action
+	Params   interface{}
+	Response interface{}
+}
+
+// actionSpecs lists every websocket action, it is the source of HELLO and of the schema
+var actionSpecs = []actionSpec{
+	{ActionHello, HelloParams{}, HelloResponse{}},
+	{ActionAuth, AuthRequest{}, AuthResponse{}},
+	{ActionLogout, nil, ActionResponse{}},
+	{ActionSubscribe, TopicParams{}, SubscriptionsResponse{}},
+	{ActionUnsubscribe, TopicParams{}, SubscriptionsResponse{}},
+	{ActionListSubscriptions, nil, SubscriptionsResponse{}},
+	{ActionListTopics, nil, TopicsResponse{}},
+	{ActionRemoveAllImages, SessionParams{}, ActionResponse{}},
+	{ActionRenderTimelapse, render.Request{}, ActionResponse{}},
+	{ActionListRenders, nil, RenderJobsResponse{}},
+	{ActionGetSchedule, nil, ScheduleResponse{}},
+	{ActionSetSchedule, schedule.Schedule{}, ActionResponse{}},
+	{ActionGetSettings, nil, settings.Settings{}},
+	{ActionUpdateSettings, settings.Patch{}, ActionResponse{}},
+	{ActionGetTimelapseStatus, nil, session.Status{}},
+	{ActionStartTimelapse, StartTimelapseParams{}, ActionResponse{}},
+	{ActionPauseTimelapse, nil, ActionResponse{}},
+	{ActionResumeTimelapse, nil, ActionResponse{}},
+	{ActionStopTimelapse, nil, ActionResponse{}},
+	{ActionListSessions, nil, SessionsResponse{}},
+	{ActionRemoveSession, SessionParams{}, ActionResponse{}},
+	{ActionImportLegacyPhotos, nil, ActionResponse{}},
+	{ActionTakePhoto, TakePhotoRequest{}, PhotoDetailsResponse{}},
+	{ActionGetRetention, nil, retention.Policy{}},
+	{ActionSetRetention, retention.Policy{}, ActionResponse{}},
+	{ActionRunRetention, RunRetentionParams{}, retention.Report{}},
+	{ActionShareFile, ShareRequest{}, ShareResponse{}},
+	{ActionListUsers, nil, UsersResponse{}},
+	{ActionCreateUser, CreateUserRequest{}, UserResponse{}},
+	{ActionUpdateUser, UpdateUserRequest{}, UserResponse{}},
+	{ActionDeleteUser, UsernameParams{}, ActionResponse{}},
+}
+
+// supportedActions are the actions of actionSpecs, others are refused as not supported
+var supportedActions = func() map[Action]bool {
+	actions := make(map[Action]bool)
+	for _, spec := range actionSpecs {
+		actions[spec.Action] = true
+	}
+	return actions
+}()
+
+// topicEvents are messages published to each topic, binaryTopics publish raw data instead of JSON
+var topicEvents = map[Topic]interface{}{
+	StatisticsTopic: StatsResponse{},
+	PhotosTopic:     PhotoResponse{},
+	RendersTopic:    RenderJobResponse{},
+	SettingsTopic:   settings.Settings{},
+	StatusTopic:     session.Status{},
+	DiskTopic:       safeguard.State{},
+	AuditTopic:      AuditEvent{},
+}
+
+var binaryTopics = map[Topic]string{
+	PreviewTopic: "image/jpeg",
+}
+
+// Schema is a JSON Schema of the websocket protocol, every message is an object described in $defs
+// together with the envelope, params and replies of actions are in actions, messages of topics in topics
+type Schema struct {
+	Schema          string                  `json:"$schema"`
+	Title           string                  `json:"title"`
+	ProtocolVersion int                     `json:"protocolVersion"`
+	Envelope        *JsonSchema             `json:"envelope"`
+	Request         *JsonSchema             `json:"request"`
+	Error           *JsonSchema             `json:"error"`
+	Actions         map[Action]ActionSchema `json:"actions"`
+	Topics          map[Topic]TopicSchema   `json:"topics"`
+	Defs            map[string]*JsonSchema  `json:"$defs"`
+}
+
+// ActionSchema has no role for actions allowed without authentication
+type ActionSchema struct {
+	Role     auth.Role   `json:"role,omitempty"`
+	Params   *JsonSchema `json:"params"`
+	Response *JsonSchema `json:"response"`
+}
+
+// TopicSchema has content type instead of event for topics which publish binary messages
+type TopicSchema struct {
+	Description string      `json:"description"`
+	Role        auth.Role   `json:"role"`
+	Event       *JsonSchema `json:"event,omitempty"`
+	ContentType string      `json:"contentType,omitempty"`
+}
+
+// JsonSchema is the subset of JSON Schema needed to describe the Go types of the protocol
+type JsonSchema struct {
+	Ref                  string                 `json:"$ref,omitempty"`
+	Type                 interface{}            `json:"type,omitempty"`
+	Format               string                 `json:"format,omitempty"`
+	Enum                 []interface{}          `json:"enum,omitempty"`
+	Properties           map[string]*JsonSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	Items                *JsonSchema            `json:"items,omitempty"`
+	AdditionalProperties *JsonSchema            `json:"additionalProperties,omitempty"`
+	AnyOf                []*JsonSchema          `json:"anyOf,omitempty"`
+}
+
+var (
+	rawMessageType    = reflect.TypeOf(json.RawMessage{})
+	timeType          = reflect.TypeOf(time.Time{})
+	durationType      = reflect.TypeOf(lib.Duration(0))
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// schemaEnums lists allowed values of string types which have a known set of constants
+func schemaEnums() map[reflect.Type][]interface{} {
+	actions, topics := []interface{}{}, []interface{}{}
+	for _, spec := range actionSpecs {
+		actions = append(actions, spec.Action)
+	}
+	for _, topic := range WhitelistedTopics {
+		topics = append(topics, topic)
+	}
+	return map[reflect.Type][]interface{}{
+		reflect.TypeOf(Action("")):      actions,
+		reflect.TypeOf(Topic("")):       topics,
+		reflect.TypeOf(MessageType("")): {MessageTypeResponse, MessageTypeEvent},
+		reflect.TypeOf(auth.Role("")):   {auth.RoleViewer, auth.RoleOperator, auth.RoleAdmin},
+		reflect.TypeOf(Feature("")):     {FeatureStreaming, FeaturePreview, FeatureRendering, FeatureMp4, FeatureUpload, FeatureSignedUrls},
+	}
+}
+
+type schemaBuilder struct {
+	defs  map[string]*JsonSchema
+	names map[reflect.Type]string
+	enums map[reflect.Type][]interface{}
+}
+
+// NewSchema generates the schema from the Go types sent and received over the websocket
+func NewSchema() Schema {
+	b := &schemaBuilder{defs: map[string]*JsonSchema{}, names: map[reflect.Type]string{}, enums: schemaEnums()}
+	schema := Schema{
+		Schema:          "https://json-schema.org/draft/2020-12/schema",
+		Title:           "Timelapse manager websocket protocol",
+		ProtocolVersion: ProtocolVersion,
+		Envelope:        b.of(reflect.TypeOf(Envelope{})),
+		Request:         b.of(reflect.TypeOf(ActionPayload{})),
+		Error:           b.of(reflect.TypeOf(WebsocketErrorResponse{})),
+		Actions:         map[Action]ActionSchema{},
+		Topics:          map[Topic]TopicSchema{},
+		Defs:            b.defs,
+	}
+	for _, spec := range actionSpecs {
+		action := ActionSchema{Response: b.of(reflect.TypeOf(spec.Response))}
+		if !publicActions[spec.Action] {
+			action.Role = actionRole(spec.Action)
+		}
+		if spec.Params != nil {
+			action.Params = b.of(reflect.TypeOf(spec.Params))
+		}
+		schema.Actions[spec.Action] = action
+	}
+	for _, topic := range WhitelistedTopics {
+		topicSchema := TopicSchema{Description: TopicDescriptions[topic], Role: topicRole(topic), ContentType: binaryTopics[topic]}
+		if event, ok := topicEvents[topic]; ok {
+			topicSchema.Event = b.of(reflect.TypeOf(event))
+		}
+		schema.Topics[topic] = topicSchema
+	}
+	return schema
+}
+
+func (b *schemaBuilder) of(t reflect.Type) *JsonSchema {
+	switch {
+	case t == rawMessageType:
+		return &JsonSchema{}
+	case t == timeType:
+		return &JsonSchema{Type: "string", Format: "date-time"}
+	case t == durationType:
+		return &JsonSchema{Type: "string", Format: "duration"}
+	case t.Kind() != reflect.Struct && t.Implements(textMarshalerType):
+		return &JsonSchema{Type: "string"}
+	}
+	if enum, ok := b.enums[t]; ok {
+		return &JsonSchema{Type: "string", Enum: enum}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return &JsonSchema{AnyOf: []*JsonSchema{b.of(t.Elem()), {Type: "null"}}}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &JsonSchema{Type: "string", Format: "byte"}
+		}
+		return &JsonSchema{Type: []string{"array", "null"}, Items: b.of(t.Elem())}
+	case reflect.Map:
+		return &JsonSchema{Type: "object", AdditionalProperties: b.of(t.Elem())}
+	case reflect.Struct:
+		return b.ref(t)
+	case reflect.String:
+		return &JsonSchema{Type: "string"}
+	case reflect.Bool:
+		return &JsonSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &JsonSchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &JsonSchema{Type: "number"}
+	}
+	return &JsonSchema{}
+}
+
+// ref describes a struct in $defs once and refers to it, names are qualified by the package when they collide
+func (b *schemaBuilder) ref(t reflect.Type) *JsonSchema {
+	name, ok := b.names[t]
+	if !ok {
+		name = t.Name()
+		if _, taken := b.defs[name]; taken || name == "" {
+			name = path.Base(t.PkgPath()) + "." + t.Name()
+		}
+		b.names[t] = name
+		schema := &JsonSchema{Type: "object", Properties: map[string]*JsonSchema{}}
+		b.defs[name] = schema
+		b.fields(t, schema)
+	}
+	return &JsonSchema{Ref: "#/$defs/" + name}
+}
+
+// fields adds exported fields the way encoding/json marshals them, embedded structs are flattened
+func (b *schemaBuilder) fields(t reflect.Type, schema *JsonSchema) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				b.fields(embedded, schema)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		schema.Properties[name] = b.of(field.Type)
+		if !strings.Contains(options, "omitempty") {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+}
+
+func (a Api) restSchema(c *fiber.Ctx) error {
+	return c.JSON(NewSchema())
+}
@@ -0,0 +1,110 @@
+package api
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"strings"
+	"testing"
+)
+
+// handledActions returns actions of the case clauses of the switch on the action in WebsocketHandler
+func handledActions(t *testing.T) []Action {
+	packages, err := parser.ParseDir(token.NewFileSet(), ".", func(info fs.FileInfo) bool {
+		return !strings.HasSuffix(info.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := make(map[string]Action)
+	var handler *ast.FuncDecl
+	for _, file := range packages["api"].Files {
+		for _, decl := range file.Decls {
+			switch decl := decl.(type) {
+			case *ast.FuncDecl:
+				if decl.Name.Name == "WebsocketHandler" {
+					handler = decl
+				}
+			case *ast.GenDecl:
+				for _, spec := range decl.Specs {
+					constant, ok := spec.(*ast.ValueSpec)
+					if !ok || decl.Tok != token.CONST {
+						continue
+					}
+					for i, name := range constant.Names {
+						if i < len(constant.Values) {
+							if literal, ok := constant.Values[i].(*ast.BasicLit); ok && literal.Kind == token.STRING {
+								values[name.Name] = Action(strings.Trim(literal.Value, `"`))
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	if handler == nil {
+		t.Fatal("WebsocketHandler not found")
+	}
+
+	var handled []Action
+	ast.Inspect(handler, func(node ast.Node) bool {
+		switchStmt, ok := node.(*ast.SwitchStmt)
+		if !ok {
+			return true
+		}
+		if tag, ok := switchStmt.Tag.(*ast.SelectorExpr); !ok || tag.Sel.Name != "Action" {
+			return true
+		}
+		for _, stmt := range switchStmt.Body.List {
+			for _, expr := range stmt.(*ast.CaseClause).List {
+				ident, ok := expr.(*ast.Ident)
+				if !ok {
+					continue
+				}
+				action, ok := values[ident.Name]
+				if !ok {
+					t.Errorf("value of %s not found", ident.Name)
+				}
+				handled = append(handled, action)
+			}
+		}
+		return false
+	})
+	return handled
+}
+
+func TestSchemaCoversActions(t *testing.T) {
+	schema := NewSchema()
+	for action := range actionRoles {
+		if _, ok := schema.Actions[action]; !ok {
+			t.Errorf("action %s missing in schema", action)
+		}
+	}
+	// HELLO and the schema are built from actionSpecs, so they have to list everything the handler does
+	handled := make(map[Action]bool)
+	for _, action := range handledActions(t) {
+		handled[action] = true
+		if !supportedActions[action] {
+			t.Errorf("action %s is handled but missing in actionSpecs", action)
+		}
+	}
+	if len(handled) == 0 {
+		t.Fatal("no actions found in WebsocketHandler")
+	}
+	for action := range supportedActions {
+		if !handled[action] {
+			t.Errorf("action %s is in actionSpecs but not handled", action)
+		}
+	}
+	if _, err := json.Marshal(schema); err != nil {
+		t.Fatal(err)
+	}
+
+	photo := schema.Defs["PhotoDetailsResponse"]
+	if photo == nil || photo.Properties["url"] == nil || photo.Properties["fileName"] == nil {
+		t.Errorf("expected embedded fields to be flattened, got %+v", photo)
+	}
+}
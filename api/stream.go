@@ -0,0 +1,72 @@
+package api
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"github.com/macrosiak/rspi-timelaps-manager-go/auth"
+	"github.com/macrosiak/rspi-timelaps-manager-go/stream"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+const (
+	// streamPath is protected like photos, browsers pass the token in the query of an img tag
+	streamPath    = "/stream.mjpeg"
+	mjpegBoundary = "frame"
+	// viewers which get no frame for this long are disconnected, so a stuck camera doesn't keep them forever
+	streamIdleTimeout = 10 * time.Second
+)
+
+// streamMjpeg sends the live stream as multipart jpegs, which browsers play in an img tag
+func (a Api) streamMjpeg(c *fiber.Ctx) error {
+	viewer, err := a.liveStream.Subscribe()
+	if errors.Is(err, stream.ErrDisabled) {
+		return sendRestErr(c, ActionStatusInvalidState, err)
+	} else if err != nil {
+		return sendRestErr(c, ActionStatusUnknownError, err)
+	}
+
+	// viewers authenticated with a token are disconnected once it's revoked or expires,
+	// signed urls aren't issued for the stream
+	revoked := make(chan struct{})
+	var held *holder
+	if token, ok := c.Locals(tokenLocal).(auth.Token); ok {
+		held = a.holders.add(token.Value, func() {
+			log.Info().Str("user", token.Username).Msg("token revoked, stream viewer disconnected")
+			close(revoked)
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, "multipart/x-mixed-replace; boundary="+mjpegBoundary)
+	c.Set(fiber.HeaderCacheControl, "no-cache, no-store")
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer a.liveStream.Unsubscribe(viewer)
+		defer a.holders.remove(held)
+		timer := time.NewTimer(streamIdleTimeout)
+		defer timer.Stop()
+		for {
+			select {
+			case frame, open := <-viewer.Frames():
+				if !open {
+					return
+				}
+				_, _ = fmt.Fprintf(w, "--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", mjpegBoundary, len(frame))
+				_, _ = w.Write(frame)
+				_, _ = w.WriteString("\r\n")
+				// flushing fails once the viewer went away
+				if err := w.Flush(); err != nil {
+					return
+				}
+				timer.Reset(streamIdleTimeout)
+			case <-timer.C:
+				log.Warn().Msg("no frames from the live stream, viewer disconnected")
+				return
+			case <-revoked:
+				return
+			}
+		}
+	})
+	return nil
+}
@@ -0,0 +1,169 @@
+package api
+
+import (
+	"errors"
+	"github.com/gofiber/fiber/v2"
+	"github.com/macrosiak/rspi-timelaps-manager-go/auth"
+)
+
+// actionRoles lists the role each websocket action requires, actions missing here are only allowed to admins
+var actionRoles = map[Action]auth.Role{
+	ActionLogout:             auth.RoleViewer,
+	ActionSubscribe:          auth.RoleViewer,
+	ActionUnsubscribe:        auth.RoleViewer,
+	ActionListSubscriptions:  auth.RoleViewer,
+	ActionListTopics:         auth.RoleViewer,
+	ActionListRenders:        auth.RoleViewer,
+	ActionGetSchedule:        auth.RoleViewer,
+	ActionGetSettings:        auth.RoleViewer,
+	ActionGetTimelapseStatus: auth.RoleViewer,
+	ActionListSessions:       auth.RoleViewer,
+	ActionGetRetention:       auth.RoleViewer,
+
+	ActionRemoveAllImages:    auth.RoleOperator,
+	ActionRenderTimelapse:    auth.RoleOperator,
+	ActionSetSchedule:        auth.RoleOperator,
+	ActionUpdateSettings:     auth.RoleOperator,
+	ActionStartTimelapse:     auth.RoleOperator,
+	ActionPauseTimelapse:     auth.RoleOperator,
+	ActionResumeTimelapse:    auth.RoleOperator,
+	ActionStopTimelapse:      auth.RoleOperator,
+	ActionRemoveSession:      auth.RoleOperator,
+	ActionImportLegacyPhotos: auth.RoleOperator,
+	ActionTakePhoto:          auth.RoleOperator,
+	ActionSetRetention:       auth.RoleOperator,
+	ActionRunRetention:       auth.RoleOperator,
+	ActionShareFile:          auth.RoleOperator,
+
+	ActionListUsers:  auth.RoleAdmin,
+	ActionCreateUser: auth.RoleAdmin,
+	ActionUpdateUser: auth.RoleAdmin,
+	ActionDeleteUser: auth.RoleAdmin,
+}
+
+// publicActions are allowed before authentication
+var publicActions = map[Action]bool{
+	ActionHello: true,
+	ActionAuth:  true,
+}
+
+// topicRoles lists topics which need more than the viewer role
+var topicRoles = map[Topic]auth.Role{
+	AuditTopic: auth.RoleAdmin,
+}
+
+func actionRole(action Action) auth.Role {
+	if role, ok := actionRoles[action]; ok {
+		return role
+	}
+	return auth.RoleAdmin
+}
+
+func topicRole(topic Topic) auth.Role {
+	if role, ok := topicRoles[topic.ToUpper()]; ok {
+		return role
+	}
+	return auth.RoleViewer
+}
+
+// allowed tells whether owner of the token currently has the required role
+func (a Api) allowed(token auth.Token, required auth.Role) bool {
+	role, err := a.authenticator.Role(token)
+	return err == nil && role.Allows(required)
+}
+
+// UserResponse is a user without the password hash
+type UserResponse struct {
+	Username  string    `json:"username"`
+	Role      auth.Role `json:"role"`
+	CreatedAt int64     `json:"createdAt"`
+}
+
+func NewUserResponse(user auth.User) UserResponse {
+	return UserResponse{Username: user.Username, Role: user.Role, CreatedAt: user.CreatedAt}
+}
+
+type UsersResponse struct {
+	Users []UserResponse `json:"users"`
+}
+
+// CreateUserRequest is the value of CREATE_USER action and the body of POST /users
+type CreateUserRequest struct {
+	Username string    `json:"username"`
+	Password string    `json:"password"`
+	Role     auth.Role `json:"role"`
+}
+
+// UpdateUserRequest is the value of UPDATE_USER action, e.g. {"username": "anna", "role": "OPERATOR"}
+type UpdateUserRequest struct {
+	Username string `json:"username"`
+	auth.UserPatch
+}
+
+func (a Api) listUsers() UsersResponse {
+	response := UsersResponse{Users: []UserResponse{}}
+	for _, user := range a.authenticator.Users() {
+		response.Users = append(response.Users, NewUserResponse(user))
+	}
+	return response
+}
+
+func userErrorStatus(err error) ActionStatus {
+	switch {
+	case errors.Is(err, auth.ErrUserNotFound):
+		return ActionStatusNotFound
+	case errors.Is(err, auth.ErrUserExists), errors.Is(err, auth.ErrLastAdmin):
+		return ActionStatusInvalidState
+	case errors.Is(err, auth.ErrInvalidUsername), errors.Is(err, auth.ErrInvalidRole), errors.Is(err, auth.ErrPasswordTooShort):
+		return ActionStatusInvalidValue
+	}
+	return ActionStatusUnknownError
+}
+
+// restRole requires the token checked by restAuth to have at least the role
+func (a Api) restRole(required auth.Role) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !a.allowed(c.Locals(tokenLocal).(auth.Token), required) {
+			return SendRestError(c, ActionStatusForbidden, nil)
+		}
+		return c.Next()
+	}
+}
+
+func (a Api) restListUsers(c *fiber.Ctx) error {
+	return c.JSON(a.listUsers())
+}
+
+func (a Api) restCreateUser(c *fiber.Ctx) error {
+	request := CreateUserRequest{}
+	if err := c.BodyParser(&request); err != nil {
+		return sendRestErr(c, ActionStatusInvalidValue, err)
+	}
+
+	user, err := a.authenticator.CreateUser(request.Username, request.Password, request.Role)
+	if err != nil {
+		return sendRestErr(c, userErrorStatus(err), err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(NewUserResponse(user))
+}
+
+// restUpdateUser changes only password or role present in the body
+func (a Api) restUpdateUser(c *fiber.Ctx) error {
+	patch := auth.UserPatch{}
+	if err := c.BodyParser(&patch); err != nil {
+		return sendRestErr(c, ActionStatusInvalidValue, err)
+	}
+
+	user, err := a.authenticator.UpdateUser(c.Params("username"), patch)
+	if err != nil {
+		return sendRestErr(c, userErrorStatus(err), err)
+	}
+	return c.JSON(NewUserResponse(user))
+}
+
+func (a Api) restDeleteUser(c *fiber.Ctx) error {
+	if err := a.authenticator.DeleteUser(c.Params("username")); err != nil {
+		return sendRestErr(c, userErrorStatus(err), err)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"github.com/macrosiak/rspi-timelaps-manager-go/config"
+)
+
+// Authenticator logs users in and checks tokens they send with websocket actions and HTTP requests
+type Authenticator struct {
+	users   *Users
+	tokens  *Tokens
+	limiter *Limiter
+}
+
+func NewAuthenticator(users *Users, tokens *Tokens, limiter *Limiter) *Authenticator {
+	return &Authenticator{users: users, tokens: tokens, limiter: limiter}
+}
+
+// FromConfig loads users and creates the default account with the configured password on the first start
+func FromConfig(cfg *config.Config) (*Authenticator, error) {
+	users, err := NewUsers(cfg.UsersFile, cfg.Password)
+	if err != nil {
+		return nil, err
+	}
+	limiter := NewLimiter(LimiterConfig{
+		MaxAttempts: cfg.AuthMaxAttempts,
+		BaseDelay:   cfg.AuthBackoffDelay,
+		BanDuration: cfg.AuthBanDuration,
+	})
+	return NewAuthenticator(users, NewTokens(cfg.AuthTokenTtl), limiter), nil
+}
+
+// Login verifies the password and issues a new token, failed attempts from the remote address ip
+// and for the account are limited, LimitError is returned while they have to wait
+func (a *Authenticator) Login(username, password, ip string) (Token, error) {
+	if err := a.limiter.Allow(ip, username); err != nil {
+		return Token{}, err
+	}
+
+	user, err := a.users.Verify(username, password)
+	if err != nil {
+		a.limiter.Failure(ip, username)
+		return Token{}, err
+	}
+	a.limiter.Success(ip, username)
+	return a.tokens.Issue(user.Username)
+}
+
+// Resume authenticates a connection with a token issued earlier, failures count against the remote address
+func (a *Authenticator) Resume(token, ip string) (Token, error) {
+	if err := a.limiter.Allow(ip, ""); err != nil {
+		return Token{}, err
+	}
+
+	validated, err := a.tokens.Validate(token)
+	if err != nil {
+		a.limiter.Failure(ip, "")
+		return Token{}, err
+	}
+	return validated, nil
+}
+
+func (a *Authenticator) Authenticate(token string) (Token, error) {
+	return a.tokens.Validate(token)
+}
+
+func (a *Authenticator) Logout(token string) {
+	a.tokens.Revoke(token)
+}
+
+// OnLockout registers function called when too many failed attempts ban an address or an account
+func (a *Authenticator) OnLockout(listener func(lockout Lockout)) {
+	a.limiter.OnLockout(listener)
+}
+
+// OnRevoke registers function called after logout, a password change or removal of a user revoked tokens,
+// holders of the tokens are found by authenticating them again
+func (a *Authenticator) OnRevoke(listener func()) {
+	a.tokens.OnRevoke(listener)
+}
+
+// Role returns the current role of the token owner, so role changes apply to tokens issued before
+func (a *Authenticator) Role(token Token) (Role, error) {
+	user, err := a.users.Get(token.Username)
+	if err != nil {
+		return "", err
+	}
+	return user.Role, nil
+}
+
+func (a *Authenticator) Users() []User {
+	return a.users.List()
+}
+
+func (a *Authenticator) CreateUser(username, password string, role Role) (User, error) {
+	return a.users.Create(username, password, role)
+}
+
+// UpdateUser changes password or role, a new password logs the user out everywhere
+func (a *Authenticator) UpdateUser(username string, patch UserPatch) (User, error) {
+	user, err := a.users.Update(username, patch)
+	if err != nil {
+		return User{}, err
+	}
+	if patch.Password != nil {
+		a.tokens.RevokeUser(username)
+	}
+	return user, nil
+}
+
+// DeleteUser removes the account and revokes its tokens
+func (a *Authenticator) DeleteUser(username string) error {
+	if err := a.users.Delete(username); err != nil {
+		return err
+	}
+	a.tokens.RevokeUser(username)
+	return nil
+}
@@ -0,0 +1,176 @@
+package auth
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUsersBootstrapAndVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	users, err := NewUsers(path, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	by, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(by), "secret") {
+		t.Error("expected only the password hash to be stored")
+	}
+
+	if _, err = users.Verify(DefaultUsername, "secret"); err != nil {
+		t.Errorf("expected password to match, got %v", err)
+	}
+	for _, credentials := range [][2]string{{DefaultUsername, "wrong"}, {"nobody", "secret"}} {
+		if _, err = users.Verify(credentials[0], credentials[1]); !errors.Is(err, ErrWrongCredentials) {
+			t.Errorf("%v: expected wrong credentials, got %v", credentials, err)
+		}
+	}
+
+	// the file takes precedence over the configured password once it exists
+	if users, err = NewUsers(path, "other"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = users.Verify(DefaultUsername, "secret"); err != nil {
+		t.Errorf("expected stored password to be kept, got %v", err)
+	}
+}
+
+func TestTokens(t *testing.T) {
+	tokens := NewTokens(time.Hour)
+	token, err := tokens.Issue("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	validated, err := tokens.Validate(token.Value)
+	if err != nil || validated.Username != "admin" {
+		t.Fatalf("expected valid token, got %+v, %v", validated, err)
+	}
+
+	tokens.Revoke(token.Value)
+	if _, err = tokens.Validate(token.Value); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected revoked token to be invalid, got %v", err)
+	}
+
+	expiring := NewTokens(-time.Second)
+	token, _ = expiring.Issue("admin")
+	if _, err = expiring.Validate(token.Value); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected expired token to be invalid, got %v", err)
+	}
+}
+
+func TestSigner(t *testing.T) {
+	signer := NewSigner([]byte("key"), time.Hour)
+	signed, err := url.Parse(signer.URL("/photos/garden/2023-10-01__10-00-00.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = signer.Verify(signed.Path, signed.Query()); err != nil {
+		t.Errorf("expected signed url to be valid, got %v", err)
+	}
+	if err = signer.Verify("/photos/garden/2023-10-01__10-01-00.jpg", signed.Query()); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("expected signature of other file to be invalid, got %v", err)
+	}
+
+	expired, _ := url.Parse(signer.Sign("/renders/garden.mp4", time.Now().Add(-time.Minute)))
+	if err = signer.Verify(expired.Path, expired.Query()); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("expected expired url to be invalid, got %v", err)
+	}
+}
+
+func TestLimiterBackoffAndBan(t *testing.T) {
+	limiter := NewLimiter(LimiterConfig{MaxAttempts: 3, BaseDelay: time.Minute, BanDuration: time.Hour})
+	var lockouts []Lockout
+	limiter.OnLockout(func(lockout Lockout) {
+		lockouts = append(lockouts, lockout)
+	})
+
+	limiter.Failure("10.0.0.1", "admin")
+	var limit *LimitError
+	if err := limiter.Allow("10.0.0.2", "admin"); !errors.As(err, &limit) || limit.Banned {
+		t.Fatalf("expected account to wait from any address, got %v", err)
+	}
+	if err := limiter.Allow("10.0.0.1", "viewer"); err == nil {
+		t.Fatal("expected address to wait for any account")
+	}
+	if err := limiter.Allow("10.0.0.2", "viewer"); err != nil {
+		t.Fatalf("expected other address and account to be allowed, got %v", err)
+	}
+
+	limiter.Failure("10.0.0.1", "admin")
+	if err := limiter.Allow("10.0.0.1", ""); !errors.As(err, &limit) || time.Until(limit.Until) <= time.Minute {
+		t.Errorf("expected delay to double, got %v", err)
+	}
+
+	limiter.Failure("10.0.0.1", "admin")
+	if err := limiter.Allow("10.0.0.1", ""); !errors.As(err, &limit) || !limit.Banned {
+		t.Errorf("expected ban, got %v", err)
+	}
+	if len(lockouts) != 2 {
+		t.Errorf("expected lockout of the address and the account, got %+v", lockouts)
+	}
+
+	limiter.Success("10.0.0.1", "admin")
+	if err := limiter.Allow("10.0.0.1", "admin"); err != nil {
+		t.Errorf("expected success to reset failures, got %v", err)
+	}
+}
+
+func TestUserManagement(t *testing.T) {
+	users, err := NewUsers(filepath.Join(t.TempDir(), "users.json"), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator := NewAuthenticator(users, NewTokens(time.Hour), NewLimiter(LimiterConfig{MaxAttempts: 5, BaseDelay: time.Second, BanDuration: time.Minute}))
+
+	if _, err = authenticator.CreateUser("anna", "short", RoleViewer); !errors.Is(err, ErrPasswordTooShort) {
+		t.Errorf("expected short password to be refused, got %v", err)
+	}
+	if _, err = authenticator.CreateUser("anna", "long enough", RoleViewer); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := authenticator.Login("anna", "long enough", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if role, _ := authenticator.Role(token); !role.Allows(RoleViewer) || role.Allows(RoleOperator) {
+		t.Errorf("expected viewer role, got %s", role)
+	}
+
+	operator := RoleOperator
+	if _, err = authenticator.UpdateUser("anna", UserPatch{Role: &operator}); err != nil {
+		t.Fatal(err)
+	}
+	if role, _ := authenticator.Role(token); !role.Allows(RoleOperator) || role.Allows(RoleAdmin) {
+		t.Errorf("expected role change to apply to issued token, got %s", role)
+	}
+
+	password := "changed password"
+	if _, err = authenticator.UpdateUser("anna", UserPatch{Password: &password}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = authenticator.Authenticate(token.Value); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected password change to revoke tokens, got %v", err)
+	}
+
+	viewer := RoleViewer
+	if _, err = authenticator.UpdateUser(DefaultUsername, UserPatch{Role: &viewer}); !errors.Is(err, ErrLastAdmin) {
+		t.Errorf("expected the last admin to keep the role, got %v", err)
+	}
+	if err = authenticator.DeleteUser(DefaultUsername); !errors.Is(err, ErrLastAdmin) {
+		t.Errorf("expected the last admin to stay, got %v", err)
+	}
+	if err = authenticator.DeleteUser("anna"); err != nil {
+		t.Fatal(err)
+	}
+}
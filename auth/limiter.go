@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var ErrTooManyAttempts = errors.New("too many failed login attempts")
+
+// LimitError tells when the next attempt is accepted, Banned is set when the limit of failed attempts was reached
+type LimitError struct {
+	Until  time.Time
+	Banned bool
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", ErrTooManyAttempts, e.Until.Format(time.RFC3339))
+}
+
+func (e *LimitError) Unwrap() error {
+	return ErrTooManyAttempts
+}
+
+type LockoutKind string
+
+const (
+	LockoutIp      LockoutKind = "IP"
+	LockoutAccount LockoutKind = "ACCOUNT"
+)
+
+// Lockout is reported when a remote address or an account is banned
+type Lockout struct {
+	Kind     LockoutKind `json:"kind"`
+	Key      string      `json:"key"`
+	Failures int         `json:"failures"`
+	At       int64       `json:"at"`
+	Until    int64       `json:"until"`
+}
+
+type LimiterConfig struct {
+	// MaxAttempts failed in a row ban the address or account for BanDuration
+	MaxAttempts int
+	// BaseDelay is the wait after the first failure, it doubles with every next one
+	BaseDelay   time.Duration
+	BanDuration time.Duration
+}
+
+type attempts struct {
+	failures    int
+	lastFailure time.Time
+	nextAllowed time.Time
+	banned      bool
+}
+
+// Limiter tracks failed logins per remote address and per account, so guessing passwords
+// gets slower with every attempt no matter how many connections are opened
+type Limiter struct {
+	cfg LimiterConfig
+
+	mu        sync.Mutex
+	attempts  map[string]*attempts
+	listeners []func(lockout Lockout)
+}
+
+func NewLimiter(cfg LimiterConfig) *Limiter {
+	return &Limiter{cfg: cfg, attempts: make(map[string]*attempts)}
+}
+
+func limiterKeys(ip, username string) map[LockoutKind]string {
+	keys := map[LockoutKind]string{}
+	if ip != "" {
+		keys[LockoutIp] = ip
+	}
+	if username != "" {
+		keys[LockoutAccount] = username
+	}
+	return keys
+}
+
+func attemptsKey(kind LockoutKind, key string) string {
+	return string(kind) + "/" + key
+}
+
+// Allow returns LimitError while the address or the account has to wait before the next attempt
+func (l *Limiter) Allow(ip, username string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	var limit *LimitError
+	for kind, key := range limiterKeys(ip, username) {
+		a := l.attempts[attemptsKey(kind, key)]
+		if a == nil || !now.Before(a.nextAllowed) {
+			continue
+		}
+		if limit == nil || a.nextAllowed.After(limit.Until) {
+			limit = &LimitError{Until: a.nextAllowed, Banned: a.banned}
+		}
+	}
+	if limit != nil {
+		return limit
+	}
+	return nil
+}
+
+// Failure records failed attempt, listeners are notified when it leads to a ban
+func (l *Limiter) Failure(ip, username string) {
+	l.mu.Lock()
+	now := time.Now()
+	l.removeStale(now)
+
+	var lockouts []Lockout
+	for kind, key := range limiterKeys(ip, username) {
+		a := l.attempts[attemptsKey(kind, key)]
+		if a == nil {
+			a = &attempts{}
+			l.attempts[attemptsKey(kind, key)] = a
+		}
+		a.failures++
+		a.lastFailure = now
+		a.banned = false
+
+		if a.failures >= l.cfg.MaxAttempts {
+			a.nextAllowed = now.Add(l.cfg.BanDuration)
+			a.banned = true
+			lockouts = append(lockouts, Lockout{Kind: kind, Key: key, Failures: a.failures, At: now.Unix(), Until: a.nextAllowed.Unix()})
+			a.failures = 0
+			continue
+		}
+		delay := l.cfg.BaseDelay << (a.failures - 1)
+		if delay > l.cfg.BanDuration || delay <= 0 {
+			delay = l.cfg.BanDuration
+		}
+		a.nextAllowed = now.Add(delay)
+	}
+	listeners := l.listeners
+	l.mu.Unlock()
+
+	for _, lockout := range lockouts {
+		for _, listener := range listeners {
+			listener(lockout)
+		}
+	}
+}
+
+// Success forgets failures of the address and the account
+func (l *Limiter) Success(ip, username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for kind, key := range limiterKeys(ip, username) {
+		delete(l.attempts, attemptsKey(kind, key))
+	}
+}
+
+// OnLockout registers function called every time an address or an account is banned
+func (l *Limiter) OnLockout(listener func(lockout Lockout)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.listeners = append(l.listeners, listener)
+}
+
+// removeStale forgets failures older than the ban duration, callers hold the lock
+func (l *Limiter) removeStale(now time.Time) {
+	for key, a := range l.attempts {
+		if now.After(a.nextAllowed) && now.Sub(a.lastFailure) > l.cfg.BanDuration {
+			delete(l.attempts, key)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package auth
+
+import "errors"
+
+var ErrInvalidRole = errors.New("role must be VIEWER, OPERATOR or ADMIN")
+
+// Role grants access to actions, every role can do everything the roles before it can
+type Role string
+
+const (
+	// RoleViewer sees stats, photos and the live stream
+	RoleViewer Role = "VIEWER"
+	// RoleOperator changes settings, takes and removes photos and controls sessions
+	RoleOperator Role = "OPERATOR"
+	// RoleAdmin manages users
+	RoleAdmin Role = "ADMIN"
+)
+
+func (r Role) level() int {
+	switch r {
+	case RoleViewer:
+		return 1
+	case RoleOperator:
+		return 2
+	case RoleAdmin:
+		return 3
+	}
+	return 0
+}
+
+func (r Role) Validate() error {
+	if r.level() == 0 {
+		return ErrInvalidRole
+	}
+	return nil
+}
+
+// Allows tells whether the role has at least the required one
+func (r Role) Allows(required Role) bool {
+	return r.level() > 0 && r.level() >= required.level()
+}
@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	keySize = 32
+
+	expiresParam   = "expires"
+	signatureParam = "signature"
+)
+
+var ErrInvalidSignature = errors.New("invalid or expired signature")
+
+// Signer creates links to files which work without a token until they expire,
+// the key is persisted so links survive restarts, removing the key file invalidates all of them
+type Signer struct {
+	key []byte
+	// ttl is how long links returned by URL work
+	ttl time.Duration
+}
+
+func NewSigner(key []byte, ttl time.Duration) *Signer {
+	return &Signer{key: key, ttl: ttl}
+}
+
+// LoadSigner reads the key from path, a random key is generated and saved on the first start
+func LoadSigner(path string, ttl time.Duration) (*Signer, error) {
+	key, err := os.ReadFile(path)
+	if err == nil && len(key) == keySize {
+		return NewSigner(key, ttl), nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("read signing key: %w", err)
+	}
+
+	key = make([]byte, keySize)
+	if _, err = rand.Read(key); err != nil {
+		return nil, fmt.Errorf("generate signing key: %w", err)
+	}
+	if err = os.WriteFile(path, key, 0600); err != nil {
+		return nil, fmt.Errorf("write signing key: %w", err)
+	}
+	return NewSigner(key, ttl), nil
+}
+
+func (s *Signer) signature(path string, expires int64) string {
+	h := hmac.New(sha256.New, s.key)
+	h.Write([]byte(path + "\n" + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Sign returns the path with expiry and signature in the query, nil signer returns the path as it is
+func (s *Signer) Sign(path string, expires time.Time) string {
+	if s == nil {
+		return path
+	}
+	query := url.Values{}
+	query.Set(expiresParam, strconv.FormatInt(expires.Unix(), 10))
+	query.Set(signatureParam, s.signature(path, expires.Unix()))
+	return path + "?" + query.Encode()
+}
+
+// URL signs the path with the default lifetime, it's used for links in api responses,
+// expiry is rounded up to a full hour so the same file keeps the same url and browsers can cache it
+func (s *Signer) URL(path string) string {
+	if s == nil {
+		return path
+	}
+	return s.Sign(path, time.Now().Add(s.ttl).Truncate(time.Hour).Add(time.Hour))
+}
+
+// Verify checks expiry and signature query parameters of the path
+func (s *Signer) Verify(path string, query url.Values) error {
+	expires, err := strconv.ParseInt(query.Get(expiresParam), 10, 64)
+	if err != nil || time.Now().Unix() >= expires {
+		return ErrInvalidSignature
+	}
+
+	expected := s.signature(path, expires)
+	if !hmac.Equal([]byte(expected), []byte(query.Get(signatureParam))) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// Token is a session issued after login, Value is only known to the client, the store keeps its hash
+type Token struct {
+	Value     string `json:"token"`
+	Username  string `json:"username"`
+	IssuedAt  int64  `json:"issuedAt"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+func (t Token) Expired(now time.Time) bool {
+	return now.Unix() >= t.ExpiresAt
+}
+
+// Tokens keeps issued tokens in memory, so a restart logs everyone out
+type Tokens struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	tokens    map[string]Token
+	listeners []func()
+}
+
+func NewTokens(ttl time.Duration) *Tokens {
+	return &Tokens{ttl: ttl, tokens: make(map[string]Token)}
+}
+
+func tokenKey(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+func (t *Tokens) Issue(username string) (Token, error) {
+	by := make([]byte, 32)
+	if _, err := rand.Read(by); err != nil {
+		return Token{}, fmt.Errorf("generate token: %w", err)
+	}
+
+	now := time.Now()
+	token := Token{
+		Value:     base64.RawURLEncoding.EncodeToString(by),
+		Username:  username,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(t.ttl).Unix(),
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.removeExpired(now)
+	stored := token
+	stored.Value = ""
+	t.tokens[tokenKey(token.Value)] = stored
+	return token, nil
+}
+
+// Validate returns the token issued with the value, ErrInvalidToken when it's unknown, expired or revoked
+func (t *Tokens) Validate(value string) (Token, error) {
+	if value == "" {
+		return Token{}, ErrInvalidToken
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := tokenKey(value)
+	token, ok := t.tokens[key]
+	if !ok {
+		return Token{}, ErrInvalidToken
+	}
+	if token.Expired(time.Now()) {
+		delete(t.tokens, key)
+		return Token{}, ErrInvalidToken
+	}
+	token.Value = value
+	return token, nil
+}
+
+func (t *Tokens) Revoke(value string) {
+	t.mu.Lock()
+	delete(t.tokens, tokenKey(value))
+	listeners := t.listeners
+	t.mu.Unlock()
+	notify(listeners)
+}
+
+// RevokeUser removes all tokens of the user
+func (t *Tokens) RevokeUser(username string) {
+	t.mu.Lock()
+	for key, token := range t.tokens {
+		if token.Username == username {
+			delete(t.tokens, key)
+		}
+	}
+	listeners := t.listeners
+	t.mu.Unlock()
+	notify(listeners)
+}
+
+// OnRevoke registers function called after tokens were revoked, expired tokens aren't announced
+func (t *Tokens) OnRevoke(listener func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.listeners = append(t.listeners, listener)
+}
+
+func notify(listeners []func()) {
+	for _, listener := range listeners {
+		listener()
+	}
+}
+
+// removeExpired keeps the map from growing with tokens of clients which never logged out, callers hold the lock
+func (t *Tokens) removeExpired(now time.Time) {
+	for key, token := range t.tokens {
+		if token.Expired(now) {
+			delete(t.tokens, key)
+		}
+	}
+}
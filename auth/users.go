@@ -0,0 +1,253 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultUsername is the account created on the first start with the password from config
+const DefaultUsername = "admin"
+
+// passwords set through user management must have at least this many characters
+const minPasswordLength = 8
+
+var (
+	ErrWrongCredentials = errors.New("wrong username or password")
+	ErrUserNotFound     = errors.New("user not found")
+	ErrUserExists       = errors.New("user already exists")
+	ErrInvalidUsername  = errors.New("username must be 1 to 32 letters, digits, dots, dashes or underscores")
+	ErrPasswordTooShort = fmt.Errorf("password must have at least %d characters", minPasswordLength)
+	ErrLastAdmin        = errors.New("at least one admin must remain")
+	usernamePattern     = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,32}$`)
+)
+
+type User struct {
+	Username     string `json:"username"`
+	PasswordHash string `json:"passwordHash"`
+	Role         Role   `json:"role"`
+	CreatedAt    int64  `json:"createdAt"`
+}
+
+// UserPatch changes only fields which are set
+type UserPatch struct {
+	Password *string `json:"password"`
+	Role     *Role   `json:"role"`
+}
+
+// dummyHash is compared against when the user doesn't exist, so response time doesn't reveal which usernames exist
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("hash password: %w", err)
+	}
+	return string(hash), nil
+}
+
+// Users keeps accounts with bcrypt hashed passwords in a json file, plain passwords are never stored
+type Users struct {
+	path  string
+	mu    sync.RWMutex
+	users map[string]User
+}
+
+// NewUsers loads accounts from path, when the file doesn't exist it's created with the default account
+// using bootstrapPassword, which may be a plain password or a bcrypt hash of it
+func NewUsers(path string, bootstrapPassword string) (*Users, error) {
+	store := &Users{path: path, users: make(map[string]User)}
+
+	by, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		hash := bootstrapPassword
+		if _, costErr := bcrypt.Cost([]byte(hash)); costErr != nil {
+			if hash, err = HashPassword(bootstrapPassword); err != nil {
+				return nil, err
+			}
+		}
+		store.users[DefaultUsername] = User{Username: DefaultUsername, PasswordHash: hash, Role: RoleAdmin, CreatedAt: time.Now().Unix()}
+		if err = store.save(); err != nil {
+			return nil, err
+		}
+		return store, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("read users: %w", err)
+	}
+
+	var users []User
+	if err = json.Unmarshal(by, &users); err != nil {
+		return nil, fmt.Errorf("unmarshal users: %w", err)
+	}
+	for _, user := range users {
+		// accounts created before roles existed were admins
+		if user.Role == "" {
+			user.Role = RoleAdmin
+		}
+		store.users[user.Username] = user
+	}
+	return store, nil
+}
+
+// list returns users sorted by username, callers hold the lock
+func (s *Users) list() []User {
+	users := make([]User, 0, len(s.users))
+	for _, user := range s.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users
+}
+
+// save writes all users to the file, callers hold the lock
+func (s *Users) save() error {
+	by, err := json.MarshalIndent(s.list(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("json marshal: %w", err)
+	}
+	if err = os.WriteFile(s.path, by, 0600); err != nil {
+		return fmt.Errorf("write users: %w", err)
+	}
+	return nil
+}
+
+// Verify returns the user when the password matches, ErrWrongCredentials otherwise
+func (s *Users) Verify(username, password string) (*User, error) {
+	s.mu.RLock()
+	user, ok := s.users[username]
+	s.mu.RUnlock()
+
+	hash := []byte(user.PasswordHash)
+	if !ok {
+		hash = dummyHash
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil || !ok {
+		return nil, ErrWrongCredentials
+	}
+	return &user, nil
+}
+
+func (s *Users) List() []User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.list()
+}
+
+func (s *Users) Get(username string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	user, ok := s.users[username]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return user, nil
+}
+
+func (s *Users) Create(username, password string, role Role) (User, error) {
+	if !usernamePattern.MatchString(username) {
+		return User{}, ErrInvalidUsername
+	}
+	if err := role.Validate(); err != nil {
+		return User{}, err
+	}
+	if len(password) < minPasswordLength {
+		return User{}, ErrPasswordTooShort
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return User{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[username]; ok {
+		return User{}, ErrUserExists
+	}
+	user := User{Username: username, PasswordHash: hash, Role: role, CreatedAt: time.Now().Unix()}
+	s.users[username] = user
+	if err = s.save(); err != nil {
+		delete(s.users, username)
+		return User{}, err
+	}
+	return user, nil
+}
+
+func (s *Users) Update(username string, patch UserPatch) (User, error) {
+	hash := ""
+	if patch.Password != nil {
+		if len(*patch.Password) < minPasswordLength {
+			return User{}, ErrPasswordTooShort
+		}
+		var err error
+		if hash, err = HashPassword(*patch.Password); err != nil {
+			return User{}, err
+		}
+	}
+	if patch.Role != nil {
+		if err := patch.Role.Validate(); err != nil {
+			return User{}, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, ok := s.users[username]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	user := previous
+	if hash != "" {
+		user.PasswordHash = hash
+	}
+	if patch.Role != nil {
+		if *patch.Role != RoleAdmin && s.lastAdmin(username) {
+			return User{}, ErrLastAdmin
+		}
+		user.Role = *patch.Role
+	}
+
+	s.users[username] = user
+	if err := s.save(); err != nil {
+		s.users[username] = previous
+		return User{}, err
+	}
+	return user, nil
+}
+
+func (s *Users) Delete(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[username]
+	if !ok {
+		return ErrUserNotFound
+	}
+	if s.lastAdmin(username) {
+		return ErrLastAdmin
+	}
+
+	delete(s.users, username)
+	if err := s.save(); err != nil {
+		s.users[username] = user
+		return err
+	}
+	return nil
+}
+
+// lastAdmin tells whether the user is the only admin left, callers hold the lock
+func (s *Users) lastAdmin(username string) bool {
+	if s.users[username].Role != RoleAdmin {
+		return false
+	}
+	for _, user := range s.users {
+		if user.Username != username && user.Role == RoleAdmin {
+			return false
+		}
+	}
+	return true
+}
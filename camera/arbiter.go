@@ -0,0 +1,359 @@
+package camera
+
+import (
+	"errors"
+	"fmt"
+	"github.com/macrosiak/rspi-timelaps-manager-go/lib"
+	"github.com/rs/zerolog/log"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+const (
+	arbiterQueueSize = 16
+	// scheduled frame which starts later than this after its planned time is reported as late
+	lateTolerance = 2 * time.Second
+)
+
+var (
+	ErrQueueFull = errors.New("camera queue is full")
+	// ErrFrameSkipped is returned for a scheduled frame while the previous one is still waiting or being taken
+	ErrFrameSkipped = errors.New("previous scheduled frame is not taken yet, frame skipped")
+	// ErrStreamRunning is returned for a preview while the live stream is running
+	ErrStreamRunning = errors.New("live stream is running")
+)
+
+// Metrics describe how well the camera keeps up with the schedule
+type Metrics struct {
+	FramesCaptured      int          `json:"framesCaptured"`
+	FramesSkipped       int          `json:"framesSkipped"`
+	FramesLate          int          `json:"framesLate"`
+	FailedCaptures      int          `json:"failedCaptures"`
+	LastCaptureDuration lib.Duration `json:"lastCaptureDuration"`
+	QueueLength         int          `json:"queueLength"`
+	Streaming           bool         `json:"streaming"`
+}
+
+// CaptureJob describes a photo to take, Path is called right before the capture with the settings in use,
+// so names based on the capture time stay unique
+type CaptureJob struct {
+	Path func(settings CameraSettings) string
+	// Settings override the current settings for this photo only
+	Settings *CameraSettings
+	// Scheduled frames are skipped instead of queued when the previous one isn't taken yet
+	Scheduled bool
+	Planned   time.Time
+}
+
+type CaptureResult struct {
+	FilePath string
+	Settings CameraSettings
+	Metadata *Metadata
+}
+
+// Arbiter owns the camera, captures, stream start and stop and settings changes are queued
+// and processed one by one, so only one libcamera process uses the camera at a time
+type Arbiter struct {
+	camera       Camera
+	streamOutput io.Writer
+	streamExit   []func()
+	jobs         chan func()
+
+	// fields below are used only by the Run goroutine
+	settings  *CameraSettings
+	streamCmd *exec.Cmd
+	// streamExited is closed once the stream process exits, for whatever reason
+	streamExited chan struct{}
+
+	mu               sync.Mutex
+	metrics          Metrics
+	scheduledPending bool
+	// pendingSettings wait for the running job, only the latest ones are applied
+	pendingSettings *CameraSettings
+}
+
+func NewArbiter(camera Camera) *Arbiter {
+	return &Arbiter{
+		camera:       camera,
+		streamOutput: io.Discard,
+		jobs:         make(chan func(), arbiterQueueSize),
+		settings:     camera.Settings(),
+	}
+}
+
+// SetStreamOutput sets where the stream process writes its frames, it must be called before Run
+func (a *Arbiter) SetStreamOutput(output io.Writer) {
+	a.streamOutput = output
+}
+
+// OnStreamExit registers function called when the stream process exits without being stopped,
+// e.g. after a camera error, it must be called before Run
+func (a *Arbiter) OnStreamExit(listener func()) {
+	a.streamExit = append(a.streamExit, listener)
+}
+
+// Run processes queued jobs, it never returns
+func (a *Arbiter) Run() {
+	for job := range a.jobs {
+		job()
+	}
+}
+
+// enqueue adds job to the queue and waits until it's processed, wait is false for jobs which may be dropped
+func (a *Arbiter) enqueue(job func(), wait bool) error {
+	done := make(chan struct{})
+	wrapped := func() {
+		job()
+		close(done)
+	}
+
+	if wait {
+		a.jobs <- wrapped
+	} else {
+		select {
+		case a.jobs <- wrapped:
+		default:
+			return ErrQueueFull
+		}
+	}
+	<-done
+	return nil
+}
+
+func (a *Arbiter) Metrics() Metrics {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	metrics := a.metrics
+	metrics.QueueLength = len(a.jobs)
+	return metrics
+}
+
+// UpdateSettings changes settings used by the following captures and restarts running stream with them,
+// it doesn't wait for the camera, a capture which is running finishes with the previous settings
+func (a *Arbiter) UpdateSettings(settings *CameraSettings) {
+	a.mu.Lock()
+	a.pendingSettings = settings
+	a.mu.Unlock()
+	go func() {
+		_ = a.enqueue(a.applySettings, true)
+	}()
+}
+
+func (a *Arbiter) applySettings() {
+	a.mu.Lock()
+	settings := a.pendingSettings
+	a.pendingSettings = nil
+	a.mu.Unlock()
+	if settings == nil {
+		return // applied by the job of an earlier update
+	}
+
+	a.settings = settings
+	a.camera.UpdateSettings(settings)
+	if a.streamCmd != nil {
+		a.stopStream()
+		a.restartStream()
+	}
+}
+
+// StartStream starts the stream process unless it's running already
+func (a *Arbiter) StartStream() error {
+	var startErr error
+	_ = a.enqueue(func() {
+		startErr = a.startStream()
+	}, true)
+	return startErr
+}
+
+func (a *Arbiter) StopStream() {
+	_ = a.enqueue(a.stopStream, true)
+}
+
+func (a *Arbiter) startStream() error {
+	if a.streamCmd != nil {
+		return nil
+	}
+
+	log.Debug().Msg("Opening camera stream")
+	cmd, err := a.camera.OpenStream(a.streamOutput)
+	if err != nil {
+		return fmt.Errorf("open stream: %w", err)
+	}
+	a.streamCmd = cmd
+	a.setStreaming(true)
+	if cmd != nil {
+		exited := make(chan struct{})
+		a.streamExited = exited
+		go a.watchStream(cmd, exited)
+	}
+	return nil
+}
+
+// restartStream starts the stream which was stopped for a capture or new settings, a failure is reported
+// to listeners like an exited stream, so viewers get it started again
+func (a *Arbiter) restartStream() {
+	if err := a.startStream(); err != nil {
+		log.Err(err).Msg("restart stream")
+		go a.notifyStreamExit()
+	}
+}
+
+// notifyStreamExit must be called outside of jobs, so listeners may queue other jobs
+func (a *Arbiter) notifyStreamExit() {
+	for _, listener := range a.streamExit {
+		listener()
+	}
+}
+
+// watchStream waits for the stream process, listeners are notified when it wasn't stopped by the arbiter
+func (a *Arbiter) watchStream(cmd *exec.Cmd, exited chan struct{}) {
+	err := cmd.Wait()
+	close(exited)
+
+	unexpected := false
+	_ = a.enqueue(func() {
+		if a.streamCmd != cmd {
+			return
+		}
+		log.Warn().Err(err).Msg("stream process exited")
+		a.streamCmd, a.streamExited = nil, nil
+		a.setStreaming(false)
+		unexpected = true
+	}, true)
+	if unexpected {
+		a.notifyStreamExit()
+	}
+}
+
+func (a *Arbiter) stopStream() {
+	if a.streamExited != nil && !closed(a.streamExited) {
+		err := a.camera.StopStreaming(a.streamCmd)
+		if err != nil && !closed(a.streamExited) {
+			log.Err(err).Msg("stop stream")
+			return
+		}
+		// waiting also lets the last frames reach the output before another process starts writing
+		<-a.streamExited
+	}
+	a.streamCmd, a.streamExited = nil, nil
+	a.setStreaming(false)
+}
+
+func closed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func (a *Arbiter) setStreaming(streaming bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.metrics.Streaming = streaming
+}
+
+// Capture queues the job and waits for the photo, running stream is paused for the time of the capture
+func (a *Arbiter) Capture(job CaptureJob) (*CaptureResult, error) {
+	if job.Scheduled {
+		a.mu.Lock()
+		if a.scheduledPending {
+			a.metrics.FramesSkipped++
+			a.mu.Unlock()
+			return nil, ErrFrameSkipped
+		}
+		a.scheduledPending = true
+		a.mu.Unlock()
+	}
+
+	var result *CaptureResult
+	var captureErr error
+	err := a.enqueue(func() {
+		result, captureErr = a.capture(job)
+	}, false)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if job.Scheduled {
+		a.scheduledPending = false
+	}
+	if errors.Is(err, ErrQueueFull) && job.Scheduled {
+		a.metrics.FramesSkipped++
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, captureErr
+}
+
+func (a *Arbiter) capture(job CaptureJob) (*CaptureResult, error) {
+	start := time.Now()
+	late := job.Scheduled && !job.Planned.IsZero() && start.Sub(job.Planned) > lateTolerance
+
+	settings := a.settings
+	if job.Settings != nil {
+		settings = job.Settings
+	}
+	result := &CaptureResult{FilePath: job.Path(*settings), Settings: *settings}
+	metadata, err := a.takePhoto(result.FilePath, job.Settings)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err != nil {
+		a.metrics.FailedCaptures++
+		return nil, err
+	}
+	a.metrics.FramesCaptured++
+	a.metrics.LastCaptureDuration = lib.Duration(time.Since(start))
+	if late {
+		a.metrics.FramesLate++
+	}
+
+	result.Metadata = metadata
+	return result, nil
+}
+
+// takePhoto pauses running stream for the time of the capture, settings override the current ones for this photo only
+func (a *Arbiter) takePhoto(filePath string, settings *CameraSettings) (*Metadata, error) {
+	if settings != nil {
+		a.camera.UpdateSettings(settings)
+	}
+	streaming := a.streamCmd != nil
+	if streaming {
+		a.stopStream()
+	}
+
+	metadata, err := a.camera.TakePhoto(filePath)
+
+	if settings != nil {
+		a.camera.UpdateSettings(a.settings)
+	}
+	if streaming {
+		a.restartStream()
+	}
+	return metadata, err
+}
+
+// Preview takes a photo which isn't counted in metrics, it's skipped when other jobs wait for the camera
+// or the stream is running, so previews never hold back timelapse frames nor interrupt viewers of the stream
+func (a *Arbiter) Preview(filePath string, settings CameraSettings) error {
+	if len(a.jobs) > 0 {
+		return ErrQueueFull
+	}
+
+	var previewErr error
+	err := a.enqueue(func() {
+		if a.streamCmd != nil {
+			previewErr = ErrStreamRunning
+			return
+		}
+		_, previewErr = a.takePhoto(filePath, &settings)
+	}, false)
+	if err != nil {
+		return err
+	}
+	return previewErr
+}
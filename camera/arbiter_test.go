@@ -0,0 +1,129 @@
+package camera
+
+import (
+	"errors"
+	"io"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowCamera takes a while to capture and remembers the most captures running at once
+type slowCamera struct {
+	settings   *CameraSettings
+	running    atomic.Int32
+	maxRunning atomic.Int32
+	release    chan struct{}
+}
+
+func (c *slowCamera) TakePhoto(filePath string) (*Metadata, error) {
+	running := c.running.Add(1)
+	defer c.running.Add(-1)
+	if running > c.maxRunning.Load() {
+		c.maxRunning.Store(running)
+	}
+	<-c.release
+	return &Metadata{}, nil
+}
+
+func (c *slowCamera) Settings() *CameraSettings                      { return c.settings }
+func (c *slowCamera) UpdateSettings(settings *CameraSettings)        { c.settings = settings }
+func (c *slowCamera) OpenStream(output io.Writer) (*exec.Cmd, error) { return nil, nil }
+func (c *slowCamera) StopStreaming(streamCmd *exec.Cmd) error        { return nil }
+
+func TestArbiterSerializesCaptures(t *testing.T) {
+	cam := &slowCamera{settings: &CameraSettings{Encoding: EncodingJPEG}, release: make(chan struct{})}
+	arbiter := NewArbiter(cam)
+	go arbiter.Run()
+
+	path := func(settings CameraSettings) string { return "frame." + string(settings.Encoding) }
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	capture := func(scheduled bool) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := arbiter.Capture(CaptureJob{Path: path, Scheduled: scheduled, Planned: time.Now()})
+			errs <- err
+		}()
+	}
+
+	// the next scheduled frame finds the first one still being taken
+	capture(true)
+	for cam.running.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	capture(false)
+	capture(false)
+	if _, err := arbiter.Capture(CaptureJob{Path: path, Scheduled: true}); !errors.Is(err, ErrFrameSkipped) {
+		t.Errorf("expected scheduled frame to be skipped, got %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		cam.release <- struct{}{}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	if cam.maxRunning.Load() != 1 {
+		t.Errorf("expected captures to run one by one, got %d at once", cam.maxRunning.Load())
+	}
+	metrics := arbiter.Metrics()
+	if metrics.FramesCaptured != 3 || metrics.FramesSkipped != 1 {
+		t.Errorf("unexpected metrics %+v", metrics)
+	}
+}
+
+func TestPreviewIsNotCounted(t *testing.T) {
+	cam := &slowCamera{settings: &CameraSettings{Encoding: EncodingJPEG}, release: make(chan struct{})}
+	close(cam.release)
+	arbiter := NewArbiter(cam)
+	go arbiter.Run()
+
+	if err := arbiter.Preview("preview.jpg", CameraSettings{Width: "640", Height: "360"}); err != nil {
+		t.Fatal(err)
+	}
+	if metrics := arbiter.Metrics(); metrics.FramesCaptured != 0 {
+		t.Errorf("expected preview not to be counted, got %d frames", metrics.FramesCaptured)
+	}
+	if cam.settings.Width != "" {
+		t.Errorf("expected settings to be restored after preview, got width %s", cam.settings.Width)
+	}
+}
+
+// crashingCamera runs a stream process which exits right away
+type crashingCamera struct {
+	slowCamera
+}
+
+func (c *crashingCamera) OpenStream(output io.Writer) (*exec.Cmd, error) {
+	cmd := exec.Command("sh", "-c", "exit 1")
+	return cmd, cmd.Start()
+}
+
+func TestArbiterNoticesExitedStream(t *testing.T) {
+	arbiter := NewArbiter(&crashingCamera{slowCamera{settings: &CameraSettings{}}})
+	exited := make(chan struct{}, 1)
+	arbiter.OnStreamExit(func() { exited <- struct{}{} })
+	go arbiter.Run()
+
+	if err := arbiter.StartStream(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected listener to be notified about the exited stream")
+	}
+	if arbiter.Metrics().Streaming {
+		t.Error("expected exited stream not to be reported as running")
+	}
+}
@@ -1,12 +1,17 @@
 package camera
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/macrosiak/rspi-timelaps-manager-go/lib"
+	"github.com/rs/zerolog/log"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
+	"time"
 )
 
 const (
@@ -38,29 +43,96 @@ const (
 
 type AutoFocusRange string
 
+func (r AutoFocusRange) IsValid() bool {
+	switch r {
+	case AutoFocusNormal, AutoFocusMacro, AutoFocusFull:
+		return true
+	}
+	return false
+}
+
 type Encoding string
+
+func (e Encoding) IsValid() bool {
+	switch e {
+	case EncodingJPEG, EncodingPNG, EncodingRGB, EncodingBMP, EncodingYuv420:
+		return true
+	}
+	return false
+}
+
 type Denoise string
 
+func (d Denoise) IsValid() bool {
+	switch d {
+	case DenoiseAuto, DenoiseOff, DenoiseCdnOff, DenoiseCdnFast, DenoiseCdnHq:
+		return true
+	}
+	return false
+}
+
 type AutoFocusMode string
+
+func (m AutoFocusMode) IsValid() bool {
+	switch m {
+	case AutoFocusModeManual, AutoFocusModeAuto:
+		return true
+	}
+	return false
+}
+
 type CameraSettings struct {
-	Width          string
-	Height         string
-	StreamCodec    string // h264
-	AutoFocusRange AutoFocusRange
-	AutoFocusMode  AutoFocusMode
-	Quality        int
-	HDR            bool
-	VFlip          bool
-	HFlip          bool
-	Encoding       Encoding
-	Denoise        Denoise
+	Width          string         `json:"width"`
+	Height         string         `json:"height"`
+	StreamCodec    string         `json:"streamCodec"` // unused, the live stream is always mjpeg
+	AutoFocusRange AutoFocusRange `json:"autoFocusRange"`
+	AutoFocusMode  AutoFocusMode  `json:"autoFocusMode"`
+	Quality        int            `json:"quality"`
+	HDR            bool           `json:"hdr"`
+	VFlip          bool           `json:"vFlip"`
+	HFlip          bool           `json:"hFlip"`
+	Encoding       Encoding       `json:"encoding"`
+	Denoise        Denoise        `json:"denoise"`
+	// Timeout shortens the time libcamera-still lets exposure settle before the capture, zero keeps its default,
+	// it's set only for previews and never stored
+	Timeout time.Duration `json:"-"`
+}
+
+var ErrInvalidSettings = errors.New("invalid camera settings")
+
+func (s CameraSettings) Validate() error {
+	if s.Quality < 1 || s.Quality > 100 {
+		return fmt.Errorf("%w: quality must be between 1 and 100", ErrInvalidSettings)
+	}
+	if !s.Encoding.IsValid() || !s.Denoise.IsValid() || !s.AutoFocusRange.IsValid() || !s.AutoFocusMode.IsValid() {
+		return fmt.Errorf("%w: unknown encoding, denoise or auto focus option", ErrInvalidSettings)
+	}
+	for _, dimension := range []string{s.Width, s.Height} {
+		if dimension == "" {
+			continue
+		}
+		if value, err := strconv.Atoi(dimension); err != nil || value <= 0 {
+			return fmt.Errorf("%w: width and height must be positive numbers", ErrInvalidSettings)
+		}
+	}
+	return nil
+}
+
+// Metadata describes exposure of a captured frame
+type Metadata struct {
+	ExposureTime      int64   `json:"exposureTime"` // microseconds
+	AnalogueGain      float64 `json:"analogueGain"`
+	DigitalGain       float64 `json:"digitalGain"`
+	Lux               float64 `json:"lux"`
+	ColourTemperature int     `json:"colourTemperature"`
 }
 
 type Camera interface {
-	TakePhoto(filePath string) error
+	TakePhoto(filePath string) (*Metadata, error)
 	Settings() *CameraSettings
 	UpdateSettings(settings *CameraSettings)
-	OpenStream(port int) (*exec.Cmd, error)
+	// OpenStream starts a process which writes the live stream as mjpeg into output
+	OpenStream(output io.Writer) (*exec.Cmd, error)
 	StopStreaming(streamCmd *exec.Cmd) error
 }
 
@@ -110,18 +182,19 @@ func (c *LibCamera) commonArgs() []string {
 	}
 }
 
-func (c *LibCamera) OpenStream(port int) (*exec.Cmd, error) {
+func (c *LibCamera) OpenStream(output io.Writer) (*exec.Cmd, error) {
 	args := append(c.commonArgs(),
-		"t", "0",
-		"--width", c.settings.Width,
-		"--height", c.settings.Height,
-		"--codec", c.settings.StreamCodec,
-		"--inline", "--listen", "-o", fmt.Sprintf("tcp://0.0.0.0:%d", port),
+		"-t", "0",
+		"--codec", "mjpeg",
+		"-o", "-",
 	)
+	if c.settings.Width != "" && c.settings.Height != "" {
+		args = append(args, "--width", c.settings.Width, "--height", c.settings.Height)
+	}
 
 	theCmd := exec.Command("libcamera-vid", args...)
 
-	theCmd.Stdout = os.Stdout
+	theCmd.Stdout = output
 	theCmd.Stderr = os.Stderr
 
 	return theCmd, theCmd.Start()
@@ -140,11 +213,52 @@ func (s *LibCamera) StopStreaming(streamCmd *exec.Cmd) error {
 	return ErrNoProcess
 }
 
-func (c *LibCamera) TakePhoto(filePath string) error {
+// libCameraMetadata is subset of what libcamera-still writes with --metadata-format json
+type libCameraMetadata struct {
+	ExposureTime      int64   `json:"ExposureTime"`
+	AnalogueGain      float64 `json:"AnalogueGain"`
+	DigitalGain       float64 `json:"DigitalGain"`
+	Lux               float64 `json:"Lux"`
+	ColourTemperature int     `json:"ColourTemperature"`
+}
+
+func readMetadata(metadataPath string) (*Metadata, error) {
+	by, err := os.ReadFile(metadataPath)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := libCameraMetadata{}
+	if err = json.Unmarshal(by, &raw); err != nil {
+		return nil, fmt.Errorf("unmarshal metadata: %w", err)
+	}
+
+	return &Metadata{
+		ExposureTime:      raw.ExposureTime,
+		AnalogueGain:      raw.AnalogueGain,
+		DigitalGain:       raw.DigitalGain,
+		Lux:               raw.Lux,
+		ColourTemperature: raw.ColourTemperature,
+	}, nil
+}
+
+func (c *LibCamera) TakePhoto(filePath string) (*Metadata, error) {
 	_ = os.Mkdir(filepath.Dir(filePath), 0755)
+	metadataPath := filePath + ".metadata.json"
+	defer os.Remove(metadataPath)
+
 	args := append(c.commonArgs(),
+		"--metadata", metadataPath,
+		"--metadata-format", "json",
 		"-o", filePath,
 	)
+	// stills use the full sensor resolution unless it's overridden, e.g. for a preview shot
+	if c.settings.Width != "" && c.settings.Height != "" {
+		args = append(args, "--width", c.settings.Width, "--height", c.settings.Height)
+	}
+	if c.settings.Timeout > 0 {
+		args = append(args, "-t", strconv.FormatInt(c.settings.Timeout.Milliseconds(), 10))
+	}
 
 	cmd := exec.Command("libcamera-still", args...)
 
@@ -153,8 +267,13 @@ func (c *LibCamera) TakePhoto(filePath string) error {
 
 	err := cmd.Run()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	metadata, err := readMetadata(metadataPath)
+	if err != nil {
+		log.Err(err).Msg("read photo metadata")
+	}
+
+	return metadata, nil
 }
@@ -22,37 +22,44 @@ func (c *FakeCamera) Settings() *CameraSettings {
 	return c.settings
 }
 
-func (c *FakeCamera) OpenStream(port int) (*exec.Cmd, error) {
-	theCmd := exec.Command("gst-launch-1.0",
-		"videotestsrc", "!",
-		"x264enc", "!",
-		"tcpserversink", "host=0.0.0.0", fmt.Sprintf("port=%d", port),
+func (c *FakeCamera) OpenStream(output io.Writer) (*exec.Cmd, error) {
+	theCmd := exec.Command("gst-launch-1.0", "-q",
+		"videotestsrc", "is-live=true", "!",
+		"video/x-raw,width=640,height=480,framerate=10/1", "!",
+		"jpegenc", "!",
+		"fdsink", "fd=1",
 	)
 
-	theCmd.Stdout = os.Stdout
+	theCmd.Stdout = output
 	theCmd.Stderr = os.Stderr
 
 	return theCmd, theCmd.Start()
 }
 
-func (c *FakeCamera) TakePhoto(filePath string) error {
+func (c *FakeCamera) TakePhoto(filePath string) (*Metadata, error) {
 	_ = os.Mkdir(filepath.Dir(filePath), 0755)
 
 	resp, err := http.Get("https://placekitten.com/256/256")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	f, err := os.Create(filePath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	_, err = io.Copy(f, resp.Body)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	return &Metadata{
+		ExposureTime:      10000,
+		AnalogueGain:      1,
+		DigitalGain:       1,
+		Lux:               400,
+		ColourTemperature: 5500,
+	}, nil
 }
 
 func (s *FakeCamera) StopStreaming(streamCmd *exec.Cmd) error {
@@ -0,0 +1,86 @@
+package camera_worker
+
+import (
+	"errors"
+	"fmt"
+	"github.com/macrosiak/rspi-timelaps-manager-go/api"
+	"github.com/macrosiak/rspi-timelaps-manager-go/camera"
+	"github.com/macrosiak/rspi-timelaps-manager-go/config"
+	"github.com/macrosiak/rspi-timelaps-manager-go/settings"
+	"github.com/rs/zerolog/log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// previewStartup is how long libcamera-still takes to start and release the camera on top of PreviewTimeout
+const previewStartup = 2 * time.Second
+
+// PreviewWorker publishes small snapshots to the preview topic while somebody is subscribed,
+// a snapshot is skipped rather than letting it delay a timelapse frame
+type PreviewWorker struct {
+	arbiter  *camera.Arbiter
+	cfg      *config.Config
+	pubSub   *api.PubSub
+	settings *settings.Store
+	frames   *CameraWorker
+	path     string
+}
+
+func NewPreviewWorker(arbiter *camera.Arbiter, cfg *config.Config, pubSub *api.PubSub, settingsStore *settings.Store, frames *CameraWorker) *PreviewWorker {
+	return &PreviewWorker{
+		arbiter:  arbiter,
+		cfg:      cfg,
+		pubSub:   pubSub,
+		settings: settingsStore,
+		frames:   frames,
+		path:     filepath.Join(os.TempDir(), "timelapse-preview.jpg"),
+	}
+}
+
+// Run checks for subscribers every PreviewInterval, it never returns
+func (w *PreviewWorker) Run() {
+	ticker := time.NewTicker(w.cfg.PreviewInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if w.pubSub.Subscribers(api.PreviewTopic) == 0 {
+			continue
+		}
+		// the arbiter only skips previews when a frame is queued already, one due soon would wait for the preview
+		if next := w.frames.NextPlanned(); !next.IsZero() && time.Until(next) < w.cfg.PreviewTimeout+previewStartup {
+			log.Debug().Time("next", next).Msg("preview skipped, timelapse frame is due")
+			continue
+		}
+
+		preview, err := w.take()
+		if errors.Is(err, camera.ErrQueueFull) || errors.Is(err, camera.ErrStreamRunning) {
+			log.Debug().Err(err).Msg("preview skipped")
+			continue
+		} else if err != nil {
+			log.Err(err).Msg("take preview")
+			continue
+		}
+		w.pubSub.PublishBinary(api.PreviewTopic, preview)
+	}
+}
+
+// take captures a jpeg with the current settings scaled down to the preview resolution and quality
+func (w *PreviewWorker) take() ([]byte, error) {
+	previewSettings := w.settings.Get().CameraSettings()
+	previewSettings.Width = strconv.Itoa(w.cfg.PreviewWidth)
+	previewSettings.Height = strconv.Itoa(w.cfg.PreviewHeight)
+	previewSettings.Quality = w.cfg.PreviewQuality
+	previewSettings.Encoding = camera.EncodingJPEG
+	previewSettings.Timeout = w.cfg.PreviewTimeout
+
+	defer os.Remove(w.path)
+	if err := w.arbiter.Preview(w.path, *previewSettings); err != nil {
+		return nil, err
+	}
+	preview, err := os.ReadFile(w.path)
+	if err != nil {
+		return nil, fmt.Errorf("read preview: %w", err)
+	}
+	return preview, nil
+}
@@ -4,97 +4,230 @@ import (
 	"errors"
 	"fmt"
 	"github.com/macrosiak/rspi-timelaps-manager-go/api"
+	"github.com/macrosiak/rspi-timelaps-manager-go/auth"
 	"github.com/macrosiak/rspi-timelaps-manager-go/camera"
+	"github.com/macrosiak/rspi-timelaps-manager-go/catalog"
 	"github.com/macrosiak/rspi-timelaps-manager-go/config"
+	"github.com/macrosiak/rspi-timelaps-manager-go/derivatives"
+	"github.com/macrosiak/rspi-timelaps-manager-go/lib"
+	"github.com/macrosiak/rspi-timelaps-manager-go/retention"
+	"github.com/macrosiak/rspi-timelaps-manager-go/safeguard"
+	"github.com/macrosiak/rspi-timelaps-manager-go/schedule"
+	"github.com/macrosiak/rspi-timelaps-manager-go/session"
+	"github.com/macrosiak/rspi-timelaps-manager-go/settings"
+	"github.com/macrosiak/rspi-timelaps-manager-go/upload"
 	"github.com/rs/zerolog/log"
-	"os/exec"
+	"os"
 	"path/filepath"
+	"sync"
 	"time"
 )
 
 type CameraWorker struct {
-	camera    camera.Camera
-	cfg       *config.Config
-	streamCmd *exec.Cmd
-	pubSub    *api.PubSub
+	arbiter     *camera.Arbiter
+	cfg         *config.Config
+	pubSub      *api.PubSub
+	catalog     *catalog.Catalog
+	schedule    *schedule.Store
+	settings    *settings.Store
+	sessions    *session.Manager
+	retention   *retention.Enforcer
+	guard       *safeguard.Guard
+	uploads     *upload.Spooler
+	signer      *auth.Signer
+	derivatives *derivatives.Cache
+
+	mu          sync.Mutex
+	nextPlanned time.Time
 }
 
-func NewCameraWorker(camera camera.Camera, cfg *config.Config, pubSub *api.PubSub) *CameraWorker {
-	return &CameraWorker{camera: camera, cfg: cfg, pubSub: pubSub}
+func NewCameraWorker(arbiter *camera.Arbiter, cfg *config.Config, pubSub *api.PubSub, photoCatalog *catalog.Catalog, scheduleStore *schedule.Store, settingsStore *settings.Store, sessions *session.Manager, retentionEnforcer *retention.Enforcer, guard *safeguard.Guard, uploads *upload.Spooler, signer *auth.Signer, derivativesCache *derivatives.Cache) *CameraWorker {
+	w := &CameraWorker{arbiter: arbiter, cfg: cfg, pubSub: pubSub, catalog: photoCatalog, schedule: scheduleStore, settings: settingsStore, sessions: sessions, retention: retentionEnforcer, guard: guard, uploads: uploads, signer: signer, derivatives: derivativesCache}
+	settingsStore.OnChange(w.onSettingsChanged)
+	return w
 }
 
-const timeFormat = "2006-01-02__15-04-05"
+// onSettingsChanged passes the new settings to the camera, so changes are used by the next capture,
+// the live stream is started by its viewers
+func (w *CameraWorker) onSettingsChanged(current settings.Settings) {
+	w.arbiter.UpdateSettings(current.CameraSettings())
+}
 
-func (w *CameraWorker) configToCameraSettings() {
-	w.cfg = config.New()
-	w.camera.UpdateSettings(&camera.CameraSettings{
-		AutoFocusRange: w.cfg.AutoFocusRange,
-		AutoFocusMode:  w.cfg.AutoFocusMode,
+func (w *CameraWorker) takePhoto(planned time.Time) {
+	w.retention.BeforeCapture()
+	_, err := w.capture(api.CaptureRequest{}, true, planned)
+	if errors.Is(err, safeguard.ErrCapturePaused) {
+		log.Warn().Time("planned", planned).Msg("not enough free space, scheduled frame skipped")
+	} else if errors.Is(err, camera.ErrFrameSkipped) || errors.Is(err, camera.ErrQueueFull) {
+		log.Warn().Err(err).Time("planned", planned).Msg("scheduled frame skipped")
+	} else if err != nil {
+		log.Err(err).Time("planned", planned).Msg("take scheduled photo")
+	}
+}
 
-		Quality:  w.cfg.Quality,
-		HDR:      w.cfg.Hdr,
-		VFlip:    w.cfg.VFlip,
-		HFlip:    w.cfg.HFlip,
-		Encoding: w.cfg.Encoding,
-		Denoise:  w.cfg.Denoise,
-	})
+// Capture takes a photo right away into the directory of the current session, adds it to the catalog
+// and notifies subscribers, without a session the photo is stored directly in the output directory
+// and photos excluded from the sequence go to the manual directory
+func (w *CameraWorker) Capture(request api.CaptureRequest) (*catalog.Photo, error) {
+	return w.capture(request, false, time.Time{})
 }
 
-func (w *CameraWorker) takePhoto() {
-	w.configToCameraSettings()
+// capture refuses photos while the safeguard pauses capture and lowers their quality while space is low
+func (w *CameraWorker) capture(request api.CaptureRequest, scheduled bool, planned time.Time) (*catalog.Photo, error) {
+	if !w.guard.Check().CaptureAllowed() {
+		return nil, safeguard.ErrCapturePaused
+	}
+	requested := request.Settings
+	if requested == nil {
+		requested = w.settings.Get().CameraSettings()
+	}
+	if adjusted := w.guard.AdjustSettings(requested); adjusted != nil {
+		request.Settings = adjusted
+	}
+
+	sessionId := ""
+	dir := w.cfg.OutputDir
+	if request.ExcludeFromSequence {
+		sessionId = session.ManualId
+	} else if status := w.sessions.Status(); status.Session != nil {
+		sessionId = status.Session.Id
+	}
+	if sessionId != "" {
+		dir = w.sessions.Dir(sessionId)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("create session dir: %w", err)
+		}
+	}
 
-	if w.cfg.Streaming {
-		w.stopStreaming()
+	result, err := w.arbiter.Capture(camera.CaptureJob{
+		Path: func(cameraSettings camera.CameraSettings) string {
+			return filepath.Join(dir, lib.PhotoFileName(w.uniqueCaptureTime(), string(cameraSettings.Encoding)))
+		},
+		Settings:  request.Settings,
+		Scheduled: scheduled,
+		Planned:   planned,
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	fileName := fmt.Sprintf("%s.%s", time.Now().Format(timeFormat), w.cfg.Encoding)
-	err := w.camera.TakePhoto(filepath.Join(w.cfg.OutputDir, fileName))
+	photo, err := catalog.NewPhoto(result.FilePath, sessionId, &result.Settings, result.Metadata)
 	if err != nil {
-		log.Printf("failed to take photo: %v", err)
-	} else {
-		err := w.pubSub.PublishJson(api.PhotosTopic, api.PhotoResponse{
-			Photo:     fileName,
-			CreatedAt: time.Now().Unix(),
-		})
-		if err != nil {
-			log.Err(err).Msg("notify subscribers about new photo")
+		return nil, fmt.Errorf("create catalog entry: %w", err)
+	}
+	if err = w.catalog.Add(*photo); err != nil {
+		log.Err(err).Str("file", result.FilePath).Msg("add photo to catalog")
+	}
+	// decoding a full size photo takes seconds, so derivatives are generated in the background,
+	// links published below generate them on request when they aren't ready yet
+	w.derivatives.Enqueue(*photo)
+	// uploads are optional, the spooler is nil when no backend is configured
+	if w.uploads != nil {
+		if err = w.uploads.Enqueue(*photo); err != nil {
+			log.Err(err).Str("file", result.FilePath).Msg("queue photo upload")
 		}
 	}
 
-	if w.cfg.Streaming {
-		w.openStream()
+	if sessionId != "" && !request.ExcludeFromSequence {
+		takenAt := photo.TakenAtTime()
+		interval, _ := w.schedule.Get().IntervalAt(takenAt)
+		if err = w.sessions.FrameCaptured(sessionId, takenAt, interval, &result.Settings); err != nil {
+			log.Err(err).Str("session", sessionId).Msg("record captured frame")
+		}
 	}
-}
 
-func (w *CameraWorker) stopStreaming() {
-	err := w.camera.StopStreaming(w.streamCmd)
-	if err != nil && !errors.Is(err, camera.ErrNoProcess) {
-		log.Printf("failed to stop streamCmd: %v", err)
-	} else {
-		w.streamCmd = nil
+	err = w.pubSub.PublishJson(api.PhotosTopic, api.NewPhotoResponse(photo, w.signer))
+	if err != nil {
+		log.Err(err).Msg("notify subscribers about new photo")
 	}
+	return photo, nil
 }
 
-func (w *CameraWorker) openStream() {
-	var err error
-	w.configToCameraSettings()
-	if w.streamCmd == nil {
-		log.Debug().Msg("Opening camera stream")
-		go func() {
-			w.streamCmd, err = w.camera.OpenStream(8888)
-			if err != nil {
-				log.Printf("failed to open streamCmd: %v", err)
-			}
-		}()
+// uniqueCaptureTime returns the current time, or waits for the next second when a photo was taken
+// in this one already, names are unique only to the second and photos of all sessions share the catalog
+func (w *CameraWorker) uniqueCaptureTime() time.Time {
+	now := time.Now()
+	latest, err := w.catalog.Latest()
+	if err == nil && latest.TakenAt >= now.Unix() {
+		time.Sleep(time.Until(time.Unix(latest.TakenAt+1, 0)))
+		return time.Now()
 	}
+	return now
 }
 
+// Run takes photos according to the schedule while a session is running, it sleeps until the next capture
+// and recalculates it whenever the schedule changes or the session is started, paused, resumed or stopped,
+// the camera arbiter makes sure captures never overlap and skips a frame which is due before the previous one is taken
 func (w *CameraWorker) Run() {
-	if w.cfg.Streaming {
-		w.openStream()
-	}
+	w.onSettingsChanged(w.settings.Get())
+
+	timer := time.NewTimer(0)
+	stopTimer(timer)
+	planned := w.planNext(timer, time.Now(), true)
+
 	for {
-		go w.takePhoto()
-		time.Sleep(w.cfg.Delay)
+		select {
+		case <-timer.C:
+			takenAt := time.Now()
+			go w.takePhoto(planned)
+			planned = w.planNext(timer, takenAt, false)
+		case <-w.schedule.Changed():
+			planned = w.planNext(timer, time.Now(), false)
+		case <-w.sessions.StateChanged():
+			planned = w.planNext(timer, time.Now(), true)
+		}
+	}
+}
+
+func stopTimer(timer *time.Timer) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+}
+
+// NextPlanned returns when the next scheduled frame is due, zero time when none is planned
+func (w *CameraWorker) NextPlanned() time.Time {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.nextPlanned
+}
+
+// planNext arms the timer for the next photo and returns when it's planned
+func (w *CameraWorker) planNext(timer *time.Timer, since time.Time, immediate bool) time.Time {
+	next := w.armNext(timer, since, immediate)
+	w.mu.Lock()
+	w.nextPlanned = next
+	w.mu.Unlock()
+	return next
+}
+
+// armNext is planNext without remembering the time, immediate takes photo right away if the schedule is active
+func (w *CameraWorker) armNext(timer *time.Timer, since time.Time, immediate bool) time.Time {
+	stopTimer(timer)
+	if !w.sessions.IsCapturing() {
+		return time.Time{}
+	}
+
+	currentSchedule := w.schedule.Get()
+	if _, active := currentSchedule.IntervalAt(since); active && immediate {
+		timer.Reset(0)
+		return since
+	}
+
+	next, ok := currentSchedule.Next(since)
+	if !ok {
+		log.Info().Msg("schedule has no more captures planned, waiting for schedule change")
+		return time.Time{}
 	}
+	// low disk space stretches the regular interval, waits for the next active period stay as they are
+	if interval, active := currentSchedule.IntervalAt(since); active && next.Sub(since) <= interval {
+		next = since.Add(w.guard.AdjustInterval(next.Sub(since)))
+	}
+
+	log.Debug().Time("next", next).Msg("next photo scheduled")
+	timer.Reset(time.Until(next))
+	return next
 }
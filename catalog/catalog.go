@@ -0,0 +1,372 @@
+package catalog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/macrosiak/rspi-timelaps-manager-go/camera"
+	"github.com/macrosiak/rspi-timelaps-manager-go/lib"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// photos are keyed by file name, which starts with capture time, so badger keeps them in chronological order
+const photoPrefix = "photo/"
+
+var ErrNotFound = errors.New("photo not found")
+
+type Photo struct {
+	FileName string `json:"fileName"`
+	// Session is the id of the session directory the photo is stored in, empty for photos lying in the output directory
+	Session  string                 `json:"session"`
+	TakenAt  int64                  `json:"takenAt"`
+	Size     int64                  `json:"size"`
+	Encoding camera.Encoding        `json:"encoding"`
+	Settings *camera.CameraSettings `json:"settings"`
+	Metadata *camera.Metadata       `json:"metadata"`
+	// Thinned is set on photos kept by retention thinning, so they aren't thinned again
+	Thinned bool `json:"thinned"`
+}
+
+func (p Photo) TakenAtTime() time.Time {
+	return time.Unix(p.TakenAt, 0)
+}
+
+// RelativePath returns slash separated path of the photo relative to the output directory
+func (p Photo) RelativePath() string {
+	if p.Session == "" {
+		return p.FileName
+	}
+	return p.Session + "/" + p.FileName
+}
+
+type Catalog struct {
+	db *badger.DB
+}
+
+func New(db *badger.DB) *Catalog {
+	return &Catalog{db: db}
+}
+
+func photoKey(fileName string) []byte {
+	return []byte(photoPrefix + fileName)
+}
+
+func (c *Catalog) Add(photo Photo) error {
+	by, err := json.Marshal(photo)
+	if err != nil {
+		return fmt.Errorf("json marshal: %w", err)
+	}
+
+	return c.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(photoKey(photo.FileName), by)
+	})
+}
+
+func (c *Catalog) Remove(fileName string) error {
+	return c.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(photoKey(fileName))
+	})
+}
+
+func (c *Catalog) Get(fileName string) (*Photo, error) {
+	photo := &Photo{}
+	err := c.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(photoKey(fileName))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			return json.Unmarshal(val, photo)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return photo, nil
+}
+
+// iterate walks photos in chronological order (or newest first when reverse is set) until fn returns false
+func (c *Catalog) iterate(reverse bool, fn func(photo Photo) bool) error {
+	start := []byte(photoPrefix)
+	if reverse {
+		start = []byte(photoPrefix + "\xff")
+	}
+	return c.iterateFrom(start, reverse, fn)
+}
+
+func (c *Catalog) iterateFrom(start []byte, reverse bool, fn func(photo Photo) bool) error {
+	return c.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Reverse = reverse
+		opts.Prefix = []byte(photoPrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek(start); it.Valid(); it.Next() {
+			photo, err := itemPhoto(it.Item())
+			if err != nil {
+				return err
+			}
+			if !fn(*photo) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+// Newest returns up to n photos, newest first
+func (c *Catalog) Newest(n int) ([]Photo, error) {
+	photos := make([]Photo, 0, n)
+	err := c.iterate(true, func(photo Photo) bool {
+		photos = append(photos, photo)
+		return len(photos) < n
+	})
+	return photos, err
+}
+
+func (c *Catalog) Latest() (*Photo, error) {
+	photos, err := c.Newest(1)
+	if err != nil {
+		return nil, err
+	}
+	if len(photos) == 0 {
+		return nil, ErrNotFound
+	}
+	return &photos[0], nil
+}
+
+// Range returns photos taken between from and to (inclusive) in chronological order, zero value means no limit
+func (c *Catalog) Range(from, to time.Time) ([]Photo, error) {
+	return c.SessionRange("", from, to)
+}
+
+// SessionRange works like Range, but returns only photos of the given session unless sessionId is empty
+func (c *Catalog) SessionRange(sessionId string, from, to time.Time) ([]Photo, error) {
+	// keys start with the capture time, so photos taken before from are skipped right away
+	start := []byte(photoPrefix)
+	if !from.IsZero() {
+		start = photoKey(from.Format(lib.PhotoTimeFormat))
+	}
+
+	var photos []Photo
+	err := c.iterateFrom(start, false, func(photo Photo) bool {
+		takenAt := photo.TakenAtTime()
+		if !to.IsZero() && takenAt.After(to) {
+			return false
+		}
+		if !takenAt.Before(from) && (sessionId == "" || photo.Session == sessionId) {
+			photos = append(photos, photo)
+		}
+		return true
+	})
+	return photos, err
+}
+
+func (c *Catalog) All() ([]Photo, error) {
+	return c.Range(time.Time{}, time.Time{})
+}
+
+// Summary describes photos of one session
+type Summary struct {
+	Count int   `json:"count"`
+	Size  int64 `json:"size"`
+}
+
+// Summaries returns amount and size of photos for every session, photos outside of sessions are under empty id
+func (c *Catalog) Summaries() (map[string]Summary, error) {
+	summaries := make(map[string]Summary)
+	err := c.iterate(false, func(photo Photo) bool {
+		summary := summaries[photo.Session]
+		summary.Count++
+		summary.Size += photo.Size
+		summaries[photo.Session] = summary
+		return true
+	})
+	return summaries, err
+}
+
+// Query selects photos taken between From and To (inclusive), zero value means no limit,
+// non-empty Session limits results to the given session
+type Query struct {
+	From    time.Time
+	To      time.Time
+	Session string
+	Offset  int
+	Limit   int
+}
+
+// List returns requested page of photos, newest first, together with amount of all photos matching the query
+func (c *Catalog) List(query Query) (photos []Photo, total int, err error) {
+	photos = []Photo{}
+	err = c.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Reverse = true
+		opts.PrefetchValues = false
+		opts.Prefix = []byte(photoPrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek([]byte(photoPrefix + "\xff")); it.Valid(); it.Next() {
+			// time is parsed from the key, so values are read only for the requested page
+			fileName := strings.TrimPrefix(string(it.Item().Key()), photoPrefix)
+			takenAt, err := lib.ParsePhotoTime(fileName)
+			if err != nil {
+				continue
+			}
+			if !query.To.IsZero() && takenAt.After(query.To) {
+				continue
+			}
+			if takenAt.Before(query.From) {
+				break
+			}
+
+			var photo *Photo
+			if query.Session != "" {
+				if photo, err = itemPhoto(it.Item()); err != nil {
+					return err
+				}
+				if photo.Session != query.Session {
+					continue
+				}
+			}
+
+			total++
+			if total <= query.Offset || len(photos) >= query.Limit {
+				continue
+			}
+
+			if photo == nil {
+				if photo, err = itemPhoto(it.Item()); err != nil {
+					return err
+				}
+			}
+			photos = append(photos, *photo)
+		}
+		return nil
+	})
+	return photos, total, err
+}
+
+func itemPhoto(item *badger.Item) (*Photo, error) {
+	photo := &Photo{}
+	err := item.Value(func(val []byte) error {
+		return json.Unmarshal(val, photo)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal %s: %w", item.Key(), err)
+	}
+	return photo, nil
+}
+
+// NewPhoto builds catalog entry for a frame which already exists on disk, sessionId is the directory it is stored in
+func NewPhoto(path string, sessionId string, settings *camera.CameraSettings, metadata *camera.Metadata) (*Photo, error) {
+	fileName := filepath.Base(path)
+	takenAt, err := lib.ParsePhotoTime(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("parse photo time: %w", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Photo{
+		FileName: fileName,
+		Session:  sessionId,
+		TakenAt:  takenAt.Unix(),
+		Size:     info.Size(),
+		Encoding: camera.Encoding(strings.TrimPrefix(filepath.Ext(fileName), ".")),
+		Settings: settings,
+		Metadata: metadata,
+	}, nil
+}
+
+// framesOnDisk maps file names of frames in dir and its direct subdirectories to the session they belong to
+func framesOnDisk(dir string) (map[string]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read dir: %w", err)
+	}
+
+	onDisk := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			onDisk[entry.Name()] = ""
+			continue
+		}
+
+		files, err := os.ReadDir(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("read session dir: %w", err)
+		}
+		for _, file := range files {
+			if !file.IsDir() {
+				onDisk[file.Name()] = entry.Name()
+			}
+		}
+	}
+	return onDisk, nil
+}
+
+// Reconcile makes catalog match frames present in dir and its session subdirectories, it indexes files
+// which are missing, forgets photos which were deleted from disk and updates photos moved to another session
+func (c *Catalog) Reconcile(dir string) (added int, removed int, err error) {
+	onDisk, err := framesOnDisk(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	indexed := make(map[string]Photo)
+	err = c.iterate(false, func(photo Photo) bool {
+		indexed[photo.FileName] = photo
+		return true
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for fileName := range indexed {
+		if _, ok := onDisk[fileName]; ok {
+			continue
+		}
+		if err = c.Remove(fileName); err != nil {
+			return added, removed, fmt.Errorf("remove %s: %w", fileName, err)
+		}
+		removed++
+	}
+
+	for fileName, sessionId := range onDisk {
+		photo, ok := indexed[fileName]
+		if ok && photo.Session == sessionId {
+			continue
+		}
+
+		if ok {
+			// moved between sessions, e.g. by legacy import, settings and metadata are kept
+			photo.Session = sessionId
+			if err = c.Add(photo); err != nil {
+				return added, removed, fmt.Errorf("move %s: %w", fileName, err)
+			}
+			continue
+		}
+
+		newPhoto, err := NewPhoto(filepath.Join(dir, sessionId, fileName), sessionId, nil, nil)
+		if err != nil {
+			continue // not a timelapse frame
+		}
+		if err = c.Add(*newPhoto); err != nil {
+			return added, removed, fmt.Errorf("add %s: %w", fileName, err)
+		}
+		added++
+	}
+
+	return added, removed, nil
+}
@@ -0,0 +1,109 @@
+package catalog
+
+import (
+	"github.com/macrosiak/rspi-timelaps-manager-go/camera"
+	"github.com/macrosiak/rspi-timelaps-manager-go/database"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestCatalog(t *testing.T) *Catalog {
+	db, err := database.OpenInMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return New(db)
+}
+
+func TestReconcile(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"2023-10-01__10-00-00.jpg", "2023-10-01__10-01-00.jpg", "2023-10-01__10-02-00.png", "README.md"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("frame"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := newTestCatalog(t)
+	if err := c.Add(Photo{FileName: "2023-09-30__10-00-00.jpg"}); err != nil {
+		t.Fatal(err)
+	}
+
+	added, removed, err := c.Reconcile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 3 || removed != 1 {
+		t.Fatalf("expected 3 added and 1 removed, got %d and %d", added, removed)
+	}
+
+	latest, err := c.Latest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.FileName != "2023-10-01__10-02-00.png" || latest.Size != 5 || latest.Encoding != "png" {
+		t.Errorf("unexpected latest photo %+v", latest)
+	}
+
+	newest, err := c.Newest(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(newest) != 2 || newest[1].FileName != "2023-10-01__10-01-00.jpg" {
+		t.Errorf("unexpected newest photos %+v", newest)
+	}
+
+	if _, err = c.Get("2023-09-30__10-00-00.jpg"); err != ErrNotFound {
+		t.Errorf("expected removed photo to be missing, got %v", err)
+	}
+}
+
+func TestReconcileSessions(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "garden"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"2023-10-01__10-00-00.jpg", "garden/2023-10-02__10-00-00.jpg", "garden/manifest.json"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("frame"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := newTestCatalog(t)
+	if err := c.Add(Photo{FileName: "2023-10-02__10-00-00.jpg", Metadata: &camera.Metadata{Lux: 100}}); err != nil {
+		t.Fatal(err)
+	}
+
+	added, removed, err := c.Reconcile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 1 || removed != 0 {
+		t.Fatalf("expected 1 added and 0 removed, got %d and %d", added, removed)
+	}
+
+	moved, err := c.Get("2023-10-02__10-00-00.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.Session != "garden" || moved.Metadata == nil || moved.RelativePath() != "garden/2023-10-02__10-00-00.jpg" {
+		t.Errorf("unexpected moved photo %+v", moved)
+	}
+
+	photos, total, err := c.List(Query{Session: "garden", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 1 || len(photos) != 1 || photos[0].FileName != moved.FileName {
+		t.Errorf("unexpected session photos %d %+v", total, photos)
+	}
+
+	summaries, err := c.Summaries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summaries["garden"].Count != 1 || summaries[""].Count != 1 {
+		t.Errorf("unexpected summaries %+v", summaries)
+	}
+}
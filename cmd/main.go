@@ -1,40 +1,34 @@
 package main
 
 import (
-	"fmt"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/template/html/v2"
 	"github.com/macrosiak/rspi-timelaps-manager-go/api"
+	"github.com/macrosiak/rspi-timelaps-manager-go/auth"
 	"github.com/macrosiak/rspi-timelaps-manager-go/camera"
 	"github.com/macrosiak/rspi-timelaps-manager-go/camera_worker"
+	"github.com/macrosiak/rspi-timelaps-manager-go/catalog"
+	"github.com/macrosiak/rspi-timelaps-manager-go/commands"
 	"github.com/macrosiak/rspi-timelaps-manager-go/config"
+	"github.com/macrosiak/rspi-timelaps-manager-go/database"
+	"github.com/macrosiak/rspi-timelaps-manager-go/derivatives"
+	"github.com/macrosiak/rspi-timelaps-manager-go/retention"
+	"github.com/macrosiak/rspi-timelaps-manager-go/safeguard"
+	"github.com/macrosiak/rspi-timelaps-manager-go/schedule"
+	"github.com/macrosiak/rspi-timelaps-manager-go/server"
+	"github.com/macrosiak/rspi-timelaps-manager-go/session"
+	"github.com/macrosiak/rspi-timelaps-manager-go/settings"
+	"github.com/macrosiak/rspi-timelaps-manager-go/stream"
 	"github.com/macrosiak/rspi-timelaps-manager-go/system_stats"
+	"github.com/macrosiak/rspi-timelaps-manager-go/upload"
 	"github.com/macrosiak/rspi-timelaps-manager-go/views"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"net/http"
-	"os"
 	"path/filepath"
+	"time"
 )
 
-func getLatestFile(dir string) string {
-	files, _ := os.ReadDir(dir)
-	var newestFile string
-	var newestTime int64 = 0
-	for _, f := range files {
-		fi, err := os.Stat(filepath.Join(dir, f.Name()))
-		if err != nil {
-			fmt.Println(err)
-		}
-		currTime := fi.ModTime().Unix()
-		if currTime > newestTime {
-			newestTime = currTime
-			newestFile = f.Name()
-		}
-	}
-	return newestFile
-}
-
 func main() {
 	//log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 	cfg := config.New()
@@ -51,21 +45,108 @@ func main() {
 		cam = camera.NewLibCamera(&camera.CameraSettings{})
 	}
 
-	pubSub := api.NewPubSub()
-	timelapseWorker := camera_worker.NewCameraWorker(cam, cfg, pubSub)
+	db, err := database.Open(filepath.Join(cfg.DataDir, "db"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to open database")
+	}
+	defer db.Close()
+
+	photoCatalog := catalog.New(db)
+	added, removed, err := photoCatalog.Reconcile(cfg.OutputDir)
+	if err != nil {
+		log.Err(err).Msg("reconcile photo catalog")
+	} else {
+		log.Info().Int("added", added).Int("removed", removed).Msg("photo catalog reconciled")
+	}
+
+	settingsStore, err := settings.NewStore(cfg.SettingsFile, settings.FromConfig(cfg))
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load settings")
+	}
+
+	scheduleStore, err := schedule.NewStore(cfg.ScheduleFile, time.Duration(settingsStore.Get().Delay), cfg.Location())
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load schedule")
+	}
+	settingsStore.OnChange(func(current settings.Settings) {
+		scheduleStore.SetFallbackInterval(time.Duration(current.Delay))
+	})
+
+	sessions, restored, err := session.NewManager(filepath.Join(cfg.DataDir, "session.json"), cfg.OutputDir)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load session state")
+	}
+	if !restored && cfg.AutoStartSession {
+		if _, err = sessions.Start("timelapse"); err != nil {
+			log.Err(err).Msg("start session")
+		}
+	}
+
+	retentionStore, err := retention.NewStore(cfg.RetentionFile)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load retention policy")
+	}
+	// thumbnails and web previews of new photos are generated in the background, removals clean them up
+	derivativesCache := derivatives.NewCache(cfg)
+	go derivativesCache.Run()
+	commandsService := commands.NewCommendsService(cfg, photoCatalog, sessions, derivativesCache)
+	retentionEnforcer := retention.NewEnforcer(retentionStore, photoCatalog, commandsService, cfg.OutputDir)
+
+	uploader, err := upload.New(cfg)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to configure uploads")
+	}
+	var uploads *upload.Spooler
+	if uploader != nil {
+		queue, err := upload.NewQueue(db)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to open upload queue")
+		}
+		uploads = upload.NewSpooler(uploader, queue, photoCatalog, commandsService, upload.OptionsFromConfig(cfg))
+		retentionEnforcer.SetUploadQueue(uploads)
+		go uploads.Run()
+	}
+	go retentionEnforcer.Run(cfg.RetentionInterval)
+
+	guard := safeguard.NewGuard(safeguard.ThresholdsFromConfig(cfg), cfg.OutputDir)
+	go guard.Run()
+
+	arbiter := camera.NewArbiter(cam)
+	// the live stream runs only while somebody watches it, the streaming setting allows it
+	liveStream := stream.NewHub(arbiter, cfg.StreamStopDelay)
+	arbiter.SetStreamOutput(liveStream)
+	arbiter.OnStreamExit(liveStream.StreamExited)
+	go arbiter.Run()
+	liveStream.SetEnabled(settingsStore.Get().Streaming)
+	settingsStore.OnChange(func(current settings.Settings) {
+		liveStream.SetEnabled(current.Streaming)
+	})
+
+	authenticator, err := auth.FromConfig(cfg)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load users")
+	}
+	signer, err := auth.LoadSigner(filepath.Join(cfg.DataDir, "url_signing.key"), cfg.SignedUrlTtl)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load url signing key")
+	}
+
+	pubSub := api.NewPubSub(cfg.WsQueueSize, api.SlowConsumerPolicy(cfg.WsSlowConsumerPolicy))
+	timelapseWorker := camera_worker.NewCameraWorker(arbiter, cfg, pubSub, photoCatalog, scheduleStore, settingsStore, sessions, retentionEnforcer, guard, uploads, signer, derivativesCache)
 	go timelapseWorker.Run()
+	go camera_worker.NewPreviewWorker(arbiter, cfg, pubSub, settingsStore, timelapseWorker).Run()
 
 	engine := html.NewFileSystem(http.FS(views.GetViewsFileSystem()), ".html")
 	app := fiber.New(fiber.Config{
 		Views: engine,
 	})
 
-	systemStatsSrv := system_stats.NewSystemStats()
+	systemStatsSrv := system_stats.NewSystemStats(photoCatalog, settingsStore, sessions, arbiter, guard, uploads)
 	if cfg.WebInterface {
-		_ = api.NewApi(app, systemStatsSrv, pubSub)
+		_ = api.NewApi(app, systemStatsSrv, pubSub, photoCatalog, scheduleStore, timelapseWorker, settingsStore, sessions, retentionEnforcer, guard, authenticator, signer, liveStream, derivativesCache)
 	}
 
-	err := app.Listen(":80")
+	err = server.Listen(app, cfg)
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to start server")
 	}
@@ -2,92 +2,140 @@ package commands
 
 import (
 	"fmt"
+	"github.com/macrosiak/rspi-timelaps-manager-go/catalog"
 	"github.com/macrosiak/rspi-timelaps-manager-go/config"
+	"github.com/macrosiak/rspi-timelaps-manager-go/derivatives"
+	"github.com/macrosiak/rspi-timelaps-manager-go/session"
 	"github.com/rs/zerolog/log"
 	"os"
 	"path/filepath"
-	"sort"
 	"time"
 )
 
 type CommendsService struct {
-	cfg *config.Config
+	cfg         *config.Config
+	catalog     *catalog.Catalog
+	sessions    *session.Manager
+	derivatives *derivatives.Cache
 }
 
-func NewCommendsService(cfg *config.Config) *CommendsService {
-	return &CommendsService{cfg: cfg}
+// NewCommendsService removes derivatives of removed photos from derivativesCache, it may be nil for services
+// which never remove photos
+func NewCommendsService(cfg *config.Config, photoCatalog *catalog.Catalog, sessions *session.Manager, derivativesCache *derivatives.Cache) *CommendsService {
+	return &CommendsService{cfg: cfg, catalog: photoCatalog, sessions: sessions, derivatives: derivativesCache}
 }
 
 func (c CommendsService) GetLastPhotoTakenDate() (*time.Time, error) {
-	var latestTime time.Time
-
-	files, err := os.ReadDir(c.cfg.OutputDir)
+	photo, err := c.catalog.Latest()
 	if err != nil {
 		return nil, err
 	}
 
-	for _, file := range files {
-		fileInfo, err := os.Stat(filepath.Join(c.cfg.OutputDir, file.Name()))
-		if err != nil {
-			return nil, err
-		}
-
-		fileTime := fileInfo.ModTime()
-		if fileTime.After(latestTime) {
-			latestTime = fileTime
-		}
-	}
-
+	latestTime := photo.TakenAtTime()
 	return &latestTime, nil
 }
 
-func (c CommendsService) RemoveAllPhotos() error {
+// RemoveAllPhotos removes photos of the given session, or of all sessions when sessionId is empty,
+// the 10 newest photos and photos taken in the last 10 minutes are kept
+func (c CommendsService) RemoveAllPhotos(sessionId string) error {
 	// Check if the directory exists
 	_, err := os.Stat(c.cfg.OutputDir)
 	if os.IsNotExist(err) {
 		return fmt.Errorf("directory %s does not exist", c.cfg.OutputDir)
 	}
 
-	// Read the directory contents
-	files, err := os.ReadDir(c.cfg.OutputDir)
+	// Photos are returned in chronological order
+	photos, err := c.catalog.SessionRange(sessionId, time.Time{}, time.Time{})
 	if err != nil {
-		return fmt.Errorf("failed to read directory %s: %w", c.cfg.OutputDir, err)
+		return fmt.Errorf("list photos: %w", err)
+	}
+
+	// Filter photos older than 10 minutes
+	var oldPhotos []catalog.Photo
+	for _, photo := range photos {
+		if time.Since(photo.TakenAtTime()).Minutes() > 10 {
+			oldPhotos = append(oldPhotos, photo)
+		}
 	}
 
-	type FileData struct {
-		Info os.FileInfo
-		Path string
+	// Delete all but the 10 newest files
+	if len(oldPhotos) > 10 {
+		for _, photo := range oldPhotos[:len(oldPhotos)-10] {
+			if err := c.RemovePhoto(photo); err != nil {
+				log.Err(err).Str("file", photo.FileName).Msg("remove photo")
+			}
+		}
 	}
 
-	var fileDataList []FileData
+	return nil
+}
 
-	// Filter files older than 10 minutes
-	for _, file := range files {
-		modInfo, err := file.Info()
-		if err != nil {
-			log.Printf("Failed to get file info: %s", err)
+// RemovePhotos removes photos taken between from and to (inclusive) and returns how many were removed,
+// non-empty sessionId limits removal to the given session
+func (c CommendsService) RemovePhotos(sessionId string, from, to time.Time) (int, error) {
+	photos, err := c.catalog.SessionRange(sessionId, from, to)
+	if err != nil {
+		return 0, fmt.Errorf("list photos: %w", err)
+	}
+
+	removed := 0
+	for _, photo := range photos {
+		if err := c.RemovePhoto(photo); err != nil {
+			log.Err(err).Str("file", photo.FileName).Msg("remove photo")
 			continue
 		}
+		removed++
+	}
+	return removed, nil
+}
 
-		if time.Since(modInfo.ModTime()).Minutes() > 10 {
-			fileDataList = append(fileDataList, FileData{Info: modInfo, Path: filepath.Join(c.cfg.OutputDir, file.Name())})
+// RemoveSession deletes session directory and forgets its photos, it returns how many photos were removed
+func (c CommendsService) RemoveSession(sessionId string) (int, error) {
+	if err := c.sessions.Remove(sessionId); err != nil {
+		return 0, err
+	}
+	if err := c.derivatives.RemoveSession(sessionId); err != nil {
+		log.Err(err).Str("session", sessionId).Msg("remove derivatives")
+	}
+
+	photos, err := c.catalog.SessionRange(sessionId, time.Time{}, time.Time{})
+	if err != nil {
+		return 0, fmt.Errorf("list photos: %w", err)
+	}
+	for _, photo := range photos {
+		if err = c.catalog.Remove(photo.FileName); err != nil {
+			return 0, fmt.Errorf("remove from catalog: %w", err)
 		}
 	}
+	return len(photos), nil
+}
+
+// ImportLegacyPhotos moves photos taken before sessions existed into the legacy session
+func (c CommendsService) ImportLegacyPhotos() (*session.Session, error) {
+	legacy, moved, err := c.sessions.ImportLegacy()
+	if err != nil {
+		return nil, err
+	}
 
-	// Sort files by modification time
-	sort.Slice(fileDataList, func(i, j int) bool {
-		return fileDataList[i].Info.ModTime().Before(fileDataList[j].Info.ModTime())
-	})
+	if _, _, err = c.catalog.Reconcile(c.cfg.OutputDir); err != nil {
+		return nil, fmt.Errorf("reconcile catalog: %w", err)
+	}
+	log.Info().Int("photos", moved).Msg("imported legacy photos")
+	return legacy, nil
+}
 
-	// Delete all but the 10 newest files
-	if len(fileDataList) > 10 {
-		for _, fileData := range fileDataList[:len(fileDataList)-10] {
-			err := os.Remove(fileData.Path)
-			if err != nil {
-				log.Printf("Failed to remove file: %s", fileData.Path)
-			}
-		}
+// RemovePhoto removes photo file, its derivatives and its catalog entry
+func (c CommendsService) RemovePhoto(photo catalog.Photo) error {
+	err := os.Remove(filepath.Join(c.cfg.OutputDir, photo.Session, photo.FileName))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove file: %w", err)
+	}
+	if err = c.derivatives.Remove(photo); err != nil {
+		log.Err(err).Str("file", photo.FileName).Msg("remove derivatives")
 	}
 
+	if err = c.catalog.Remove(photo.FileName); err != nil {
+		return fmt.Errorf("remove from catalog: %w", err)
+	}
 	return nil
 }
@@ -5,8 +5,10 @@ import (
 	_ "github.com/joho/godotenv/autoload"
 	"github.com/kelseyhightower/envconfig"
 	"github.com/macrosiak/rspi-timelaps-manager-go/camera"
+	"github.com/macrosiak/rspi-timelaps-manager-go/solar"
 	"github.com/rs/zerolog/log"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"time"
@@ -15,14 +17,101 @@ import (
 
 type Config struct {
 	Development bool `default:"false" split_words:"true"`
-	Streaming   bool `default:"false" split_words:"true"`
+	// Streaming allows the live stream, it runs only while somebody watches it and stops StreamStopDelay
+	// after the last viewer left
+	Streaming       bool          `default:"false" split_words:"true"`
+	StreamStopDelay time.Duration `default:"5s" split_words:"true"`
+	// PreviewInterval is how often a small photo is published to subscribers of the preview topic
+	PreviewInterval time.Duration `default:"5s" split_words:"true"`
+	PreviewWidth    int           `default:"640" split_words:"true"`
+	PreviewHeight   int           `default:"360" split_words:"true"`
+	PreviewQuality  int           `default:"40" split_words:"true"`
+	// PreviewTimeout is how long the camera adjusts exposure for a preview, previews are skipped
+	// when a timelapse frame is due sooner
+	PreviewTimeout time.Duration `default:"500ms" split_words:"true"`
+
+	// ListenAddress serves plain HTTP, with TLS enabled it only redirects to TlsListenAddress when HttpRedirect is set,
+	// without TlsCertFile and TlsKeyFile a self-signed certificate is generated in DataDir
+	ListenAddress    string `default:":80" split_words:"true"`
+	TlsEnabled       bool   `default:"false" split_words:"true"`
+	TlsListenAddress string `default:":443" split_words:"true"`
+	TlsCertFile      string `default:"" split_words:"true"`
+	TlsKeyFile       string `default:"" split_words:"true"`
+	HttpRedirect     bool   `default:"false" split_words:"true"`
 
 	WebInterface          bool   `default:"true" split_words:"true"`
 	WebInterfaceFilesPath string `default:"./web_client" split_words:"true"`
-	Password              string `default:"admin" split_words:"true"`
+	// Password of the admin account created on the first start, a bcrypt hash is accepted too,
+	// afterwards accounts are read from UsersFile
+	Password     string        `default:"admin" split_words:"true"`
+	UsersFile    string        `default:"users.json" split_words:"true"`
+	AuthTokenTtl time.Duration `default:"24h" split_words:"true"`
+	// AuthBackoffDelay is the wait after a failed login, it doubles with every next failure
+	// until AuthMaxAttempts failures ban the address or the account for AuthBanDuration
+	AuthMaxAttempts  int           `default:"5" split_words:"true"`
+	AuthBackoffDelay time.Duration `default:"1s" split_words:"true"`
+	AuthBanDuration  time.Duration `default:"15m" split_words:"true"`
+	// SignedUrlTtl is how long links to photos and renders in responses work, ShareMaxTtl limits links shared on request
+	SignedUrlTtl time.Duration `default:"24h" split_words:"true"`
+	ShareMaxTtl  time.Duration `default:"168h" split_words:"true"`
+	// WsQueueSize is how many messages wait for a slow websocket client, then WsSlowConsumerPolicy
+	// either drops topic messages ("drop") or closes the connection ("disconnect")
+	WsQueueSize          int    `default:"64" split_words:"true"`
+	WsSlowConsumerPolicy string `default:"drop" split_words:"true"`
+
+	// relative paths of UsersFile, ScheduleFile, SettingsFile and RetentionFile are resolved in DataDir
+	DataDir      string        `default:"data" split_words:"true"`
+	OutputDir    string        `default:"photos" split_words:"true"`
+	Delay        time.Duration `default:"1m" split_words:"true"`
+	ScheduleFile string        `default:"schedule.json" split_words:"true"`
+	SettingsFile string        `default:"settings.json" split_words:"true"`
+	// RetentionFile holds retention policy, RetentionInterval is how often it's enforced besides before captures
+	RetentionFile     string        `default:"retention.json" split_words:"true"`
+	RetentionInterval time.Duration `default:"10m" split_words:"true"`
+	// AutoStartSession starts a session on the first boot, later the persisted session state is restored
+	AutoStartSession bool    `default:"true" split_words:"true"`
+	Latitude         float64 `default:"0" split_words:"true"`
+	Longitude        float64 `default:"0" split_words:"true"`
+
+	// DiskWarningFreeMb, DiskReduceFreeMb and DiskPauseFreeMb are free space thresholds in megabytes
+	// below which a warning is published, scheduled frames use lower quality and longer interval
+	// and capture is paused, zero disables a level
+	DiskWarningFreeMb         int `default:"2048" split_words:"true"`
+	DiskReduceFreeMb          int `default:"1024" split_words:"true"`
+	DiskPauseFreeMb           int `default:"256" split_words:"true"`
+	DiskReducedQuality        int `default:"70" split_words:"true"`
+	DiskReducedIntervalFactor int `default:"2" split_words:"true"`
+
+	// UploadBackend is one of dir, s3 and sftp, empty disables uploads of new photos,
+	// UploadDir is the target directory of the dir and sftp backends
+	UploadBackend       string        `default:"" split_words:"true"`
+	UploadDir           string        `default:"" split_words:"true"`
+	UploadPrefix        string        `default:"" split_words:"true"`
+	UploadBandwidthKbps int           `default:"0" split_words:"true"`
+	UploadRetryDelay    time.Duration `default:"30s" split_words:"true"`
+	UploadMaxRetryDelay time.Duration `default:"1h" split_words:"true"`
+	UploadDeleteAfter   bool          `default:"false" split_words:"true"`
+	UploadS3Endpoint    string        `default:"" split_words:"true"`
+	UploadS3Region      string        `default:"us-east-1" split_words:"true"`
+	UploadS3Bucket      string        `default:"" split_words:"true"`
+	UploadS3AccessKey   string        `default:"" split_words:"true"`
+	UploadS3SecretKey   string        `default:"" split_words:"true"`
+	// UploadSftpAddress is host:port of the ssh server, its host key must be listed in UploadSftpKnownHostsFile
+	UploadSftpAddress        string `default:"" split_words:"true"`
+	UploadSftpUser           string `default:"" split_words:"true"`
+	UploadSftpPassword       string `default:"" split_words:"true"`
+	UploadSftpKeyFile        string `default:"" split_words:"true"`
+	UploadSftpKnownHostsFile string `default:"" split_words:"true"`
 
-	OutputDir string        `default:"photos" split_words:"true"`
-	Delay     time.Duration `default:"1m" split_words:"true"`
+	RenderOutputDir  string `default:"renders" split_words:"true"`
+	RenderFfmpegPath string `default:"ffmpeg" split_words:"true"`
+
+	// DerivativesDir caches thumbnails and web previews of photos, ThumbnailSize and WebPreviewSize
+	// are their longer sides in pixels
+	DerivativesDir    string `default:"derivatives" split_words:"true"`
+	ThumbnailSize     int    `default:"320" split_words:"true"`
+	WebPreviewSize    int    `default:"1280" split_words:"true"`
+	DerivativeQuality int    `default:"80" split_words:"true"`
 
 	AutoFocusRange camera.AutoFocusRange `default:"normal" split_words:"true"`
 	AutoFocusMode  camera.AutoFocusMode  `default:"auto" split_words:"true"`
@@ -42,10 +131,41 @@ func New() *Config {
 		return nil
 	}
 
+	_ = os.Mkdir(cfg.DataDir, 0755)
 	_ = os.Mkdir(cfg.OutputDir, 0755)
+	_ = os.Mkdir(cfg.RenderOutputDir, 0755)
+	_ = os.Mkdir(cfg.DerivativesDir, 0755)
+	cfg.resolveDataFiles()
 	return cfg
 }
 
+// resolveDataFiles makes relative state files paths in DataDir, files which older versions kept
+// in the working directory are moved there
+func (c *Config) resolveDataFiles() {
+	for _, file := range []*string{&c.UsersFile, &c.ScheduleFile, &c.SettingsFile, &c.RetentionFile} {
+		if *file == "" || filepath.IsAbs(*file) {
+			continue
+		}
+		resolved := filepath.Join(c.DataDir, *file)
+		if _, err := os.Stat(resolved); os.IsNotExist(err) {
+			if err = os.Rename(*file, resolved); err == nil {
+				log.Info().Str("from", *file).Str("to", resolved).Msg("moved state file into data dir")
+			} else if !os.IsNotExist(err) {
+				log.Err(err).Str("file", *file).Msg("move state file into data dir")
+			}
+		}
+		*file = resolved
+	}
+}
+
+// Location returns nil when coordinates of the camera weren't configured
+func (c *Config) Location() *solar.Location {
+	if c.Latitude == 0 && c.Longitude == 0 {
+		return nil
+	}
+	return &solar.Location{Latitude: c.Latitude, Longitude: c.Longitude}
+}
+
 func GenerateEnvTemplate() {
 	cfg := Config{}
 	t := reflect.TypeOf(cfg)
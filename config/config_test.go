@@ -1,7 +1,28 @@
 package config
 
-import "testing"
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
 
 func TestGenerateEnvTemplate(t *testing.T) {
 	GenerateEnvTemplate()
 }
+
+func TestDataFilesAreResolvedInDataDir(t *testing.T) {
+	dir := t.TempDir()
+	users := filepath.Join(dir, "users.json")
+	cfg := &Config{DataDir: filepath.Join(dir, "data"), UsersFile: users, ScheduleFile: "schedule.json", SettingsFile: "settings.json"}
+	if err := os.Mkdir(cfg.DataDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.resolveDataFiles()
+	if cfg.ScheduleFile != filepath.Join(cfg.DataDir, "schedule.json") || cfg.SettingsFile != filepath.Join(cfg.DataDir, "settings.json") {
+		t.Errorf("expected relative files in data dir, got %s %s", cfg.ScheduleFile, cfg.SettingsFile)
+	}
+	if cfg.UsersFile != users {
+		t.Errorf("expected absolute path to stay, got %s", cfg.UsersFile)
+	}
+}
@@ -0,0 +1,50 @@
+package database
+
+import (
+	"fmt"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/rs/zerolog/log"
+	"strings"
+)
+
+type badgerLogger struct{}
+
+func (badgerLogger) Errorf(format string, args ...interface{}) {
+	log.Error().Str("component", "badger").Msg(strings.TrimSpace(fmt.Sprintf(format, args...)))
+}
+
+func (badgerLogger) Warningf(format string, args ...interface{}) {
+	log.Warn().Str("component", "badger").Msg(strings.TrimSpace(fmt.Sprintf(format, args...)))
+}
+
+func (badgerLogger) Infof(format string, args ...interface{}) {
+	log.Debug().Str("component", "badger").Msg(strings.TrimSpace(fmt.Sprintf(format, args...)))
+}
+
+func (badgerLogger) Debugf(format string, args ...interface{}) {}
+
+// options are tuned for Raspberry Pi, default badger settings reserve too much memory
+func options(dir string) badger.Options {
+	return badger.DefaultOptions(dir).
+		WithLogger(badgerLogger{}).
+		WithNumVersionsToKeep(1).
+		WithMemTableSize(8 << 20).
+		WithNumMemtables(2).
+		WithValueLogFileSize(32 << 20).
+		WithBlockCacheSize(8 << 20).
+		WithIndexCacheSize(4 << 20).
+		WithNumCompactors(2)
+}
+
+func Open(dir string) (*badger.DB, error) {
+	db, err := badger.Open(options(dir))
+	if err != nil {
+		return nil, fmt.Errorf("open badger in %s: %w", dir, err)
+	}
+	return db, nil
+}
+
+// OpenInMemory returns database which is not persisted anywhere, useful for tests
+func OpenInMemory() (*badger.DB, error) {
+	return badger.Open(options("").WithInMemory(true))
+}
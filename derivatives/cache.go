@@ -0,0 +1,222 @@
+package derivatives
+
+import (
+	"errors"
+	"fmt"
+	"github.com/macrosiak/rspi-timelaps-manager-go/catalog"
+	"github.com/macrosiak/rspi-timelaps-manager-go/config"
+	"github.com/rs/zerolog/log"
+	"image"
+	"image/jpeg"
+	_ "image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// queueSize is how many new photos wait for their derivatives, more are generated on request
+	queueSize = 32
+	// maxGenerating limits decodes of full size photos running at once, each takes tens of megabytes
+	maxGenerating = 2
+)
+
+// Kind is a downscaled variant of a photo
+type Kind string
+
+const (
+	KindThumbnail Kind = "thumbnail"
+	KindWeb       Kind = "web"
+)
+
+// Kinds are generated from the largest to the smallest, so each one is scaled from the previous one
+var Kinds = []Kind{KindWeb, KindThumbnail}
+
+var (
+	ErrUnsupported = errors.New("derivatives are generated only for jpeg and png photos")
+	ErrUnknownKind = errors.New("unknown derivative kind")
+)
+
+// Cache keeps JPEG derivatives of photos in its own directory, laid out like the output directory
+// under a directory of each kind, so the catalog never mistakes them for photos
+type Cache struct {
+	dir     string
+	outDir  string
+	sizes   map[Kind]int
+	quality int
+
+	queue      chan catalog.Photo
+	generating chan struct{}
+
+	mu       sync.Mutex
+	inflight map[string]*generation
+}
+
+// generation of derivatives of one photo, others asking for the same photo wait for it
+type generation struct {
+	done chan struct{}
+	err  error
+}
+
+func NewCache(cfg *config.Config) *Cache {
+	return &Cache{
+		dir:    cfg.DerivativesDir,
+		outDir: cfg.OutputDir,
+		sizes: map[Kind]int{
+			KindThumbnail: cfg.ThumbnailSize,
+			KindWeb:       cfg.WebPreviewSize,
+		},
+		quality:    cfg.DerivativeQuality,
+		queue:      make(chan catalog.Photo, queueSize),
+		generating: make(chan struct{}, maxGenerating),
+		inflight:   make(map[string]*generation),
+	}
+}
+
+// Run generates derivatives of queued photos one by one, it never returns
+func (c *Cache) Run() {
+	for photo := range c.queue {
+		if err := c.generateOnce(photo); err != nil {
+			log.Err(err).Str("file", photo.FileName).Msg("generate derivatives")
+		}
+	}
+}
+
+// Enqueue queues generation of derivatives of a new photo without waiting for it,
+// photos which don't fit into the queue get their derivatives on request
+func (c *Cache) Enqueue(photo catalog.Photo) {
+	if !Supported(photo) {
+		return
+	}
+	select {
+	case c.queue <- photo:
+	default:
+		log.Warn().Str("file", photo.FileName).Msg("derivatives queue is full, generation deferred")
+	}
+}
+
+// Supported tells whether derivatives can be generated for the photo
+func Supported(photo catalog.Photo) bool {
+	ext := strings.ToLower(filepath.Ext(photo.FileName))
+	return ext == ".jpg" || ext == ".jpeg" || ext == ".png"
+}
+
+// Path returns path of the derivative file
+func (c *Cache) Path(photo catalog.Photo, kind Kind) string {
+	return filepath.Join(c.dir, string(kind), photo.Session, photo.FileName+".jpg")
+}
+
+// Ensure returns path of the derivative, generating all derivatives of the photo when it's missing,
+// e.g. for photos taken before derivatives existed
+func (c *Cache) Ensure(photo catalog.Photo, kind Kind) (string, error) {
+	if _, ok := c.sizes[kind]; !ok {
+		return "", ErrUnknownKind
+	}
+	path := c.Path(photo, kind)
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	if err := c.generateOnce(photo); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// generateOnce waits for a generation of the photo which is already running or starts one,
+// generations of different photos wait for each other once maxGenerating are running
+func (c *Cache) generateOnce(photo catalog.Photo) error {
+	c.mu.Lock()
+	if running, ok := c.inflight[photo.FileName]; ok {
+		c.mu.Unlock()
+		<-running.done
+		return running.err
+	}
+	current := &generation{done: make(chan struct{})}
+	c.inflight[photo.FileName] = current
+	c.mu.Unlock()
+
+	c.generating <- struct{}{}
+	current.err = c.generate(photo)
+	<-c.generating
+
+	c.mu.Lock()
+	delete(c.inflight, photo.FileName)
+	c.mu.Unlock()
+	close(current.done)
+	return current.err
+}
+
+// generate decodes the photo once and writes all its derivatives
+func (c *Cache) generate(photo catalog.Photo) error {
+	if !Supported(photo) {
+		return ErrUnsupported
+	}
+
+	original := filepath.Join(c.outDir, photo.Session, photo.FileName)
+	f, err := os.Open(original)
+	if err != nil {
+		return fmt.Errorf("open photo: %w", err)
+	}
+	img, _, err := image.Decode(f)
+	_ = f.Close()
+	if err != nil {
+		return fmt.Errorf("decode photo: %w", err)
+	}
+
+	for _, kind := range Kinds {
+		img = fit(img, c.sizes[kind])
+		if err = c.write(c.Path(photo, kind), img); err != nil {
+			return fmt.Errorf("write %s: %w", kind, err)
+		}
+	}
+	// the photo may have been removed while it was decoded, its derivatives would stay forever
+	if _, err = os.Stat(original); os.IsNotExist(err) {
+		return c.Remove(photo)
+	}
+	return nil
+}
+
+// write encodes into a temporary file first, so a half written derivative is never served
+func (c *Cache) write(path string, img image.Image) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".derivative-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err = jpeg.Encode(tmp, img, &jpeg.Options{Quality: c.quality}); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Remove deletes all derivatives of the photo
+func (c *Cache) Remove(photo catalog.Photo) error {
+	for _, kind := range Kinds {
+		if err := os.Remove(c.Path(photo, kind)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveSession deletes derivatives of all photos of the session
+func (c *Cache) RemoveSession(sessionId string) error {
+	if sessionId == "" {
+		return nil
+	}
+	for _, kind := range Kinds {
+		if err := os.RemoveAll(filepath.Join(c.dir, string(kind), sessionId)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
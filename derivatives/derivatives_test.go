@@ -0,0 +1,171 @@
+package derivatives
+
+import (
+	"errors"
+	"github.com/macrosiak/rspi-timelaps-manager-go/catalog"
+	"github.com/macrosiak/rspi-timelaps-manager-go/config"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestCache(t *testing.T) (*Cache, *config.Config) {
+	dir := t.TempDir()
+	cfg := &config.Config{
+		OutputDir:         filepath.Join(dir, "photos"),
+		DerivativesDir:    filepath.Join(dir, "derivatives"),
+		ThumbnailSize:     32,
+		WebPreviewSize:    100,
+		DerivativeQuality: 80,
+	}
+	if err := os.MkdirAll(filepath.Join(cfg.OutputDir, "s1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return NewCache(cfg), cfg
+}
+
+func writeImage(t *testing.T, path string, width, height int) {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if filepath.Ext(path) == ".png" {
+		err = png.Encode(f, img)
+	} else {
+		err = jpeg.Encode(f, img, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func decodedSize(t *testing.T, path string) (int, int) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	cfg, err := jpeg.DecodeConfig(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg.Width, cfg.Height
+}
+
+func TestGenerateAndRemove(t *testing.T) {
+	cache, cfg := newTestCache(t)
+	for _, name := range []string{"2023-10-02__10-00-00.jpg", "2023-10-02__10-01-00.png"} {
+		photo := catalog.Photo{FileName: name, Session: "s1"}
+		writeImage(t, filepath.Join(cfg.OutputDir, "s1", name), 400, 200)
+
+		if err := cache.generate(photo); err != nil {
+			t.Fatal(err)
+		}
+		if w, h := decodedSize(t, cache.Path(photo, KindWeb)); w != 100 || h != 50 {
+			t.Errorf("%s: web preview is %dx%d, expected 100x50", name, w, h)
+		}
+		if w, h := decodedSize(t, cache.Path(photo, KindThumbnail)); w != 32 || h != 16 {
+			t.Errorf("%s: thumbnail is %dx%d, expected 32x16", name, w, h)
+		}
+
+		if err := cache.Remove(photo); err != nil {
+			t.Fatal(err)
+		}
+		for _, kind := range Kinds {
+			if _, err := os.Stat(cache.Path(photo, kind)); !os.IsNotExist(err) {
+				t.Errorf("%s: %s wasn't removed", name, kind)
+			}
+		}
+	}
+}
+
+func TestEnsureGeneratesMissing(t *testing.T) {
+	cache, cfg := newTestCache(t)
+	photo := catalog.Photo{FileName: "2023-10-02__10-00-00.jpg", Session: "s1"}
+	writeImage(t, filepath.Join(cfg.OutputDir, "s1", photo.FileName), 20, 40)
+
+	path, err := cache.Ensure(photo, KindThumbnail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// smaller photos aren't enlarged
+	if w, h := decodedSize(t, path); w != 16 || h != 32 {
+		t.Errorf("thumbnail is %dx%d, expected 16x32", w, h)
+	}
+
+	if _, err = cache.Ensure(photo, "huge"); !errors.Is(err, ErrUnknownKind) {
+		t.Errorf("expected ErrUnknownKind, got %v", err)
+	}
+	if err = cache.generate(catalog.Photo{FileName: "2023-10-02__10-00-00.yuv420", Session: "s1"}); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("expected ErrUnsupported, got %v", err)
+	}
+
+	if err = cache.RemoveSession("s1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Error("derivatives of the session weren't removed")
+	}
+}
+
+func TestConcurrentRequestsAndQueue(t *testing.T) {
+	cache, cfg := newTestCache(t)
+	var photos []catalog.Photo
+	for _, name := range []string{"2023-10-02__10-00-00.jpg", "2023-10-02__10-01-00.jpg", "2023-10-02__10-02-00.jpg"} {
+		photo := catalog.Photo{FileName: name, Session: "s1"}
+		writeImage(t, filepath.Join(cfg.OutputDir, "s1", name), 400, 200)
+		photos = append(photos, photo)
+	}
+
+	// a gallery asks for the same photos many times at once, the requests share generations
+	var wg sync.WaitGroup
+	errs := make(chan error, 30)
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func(photo catalog.Photo) {
+			defer wg.Done()
+			_, err := cache.Ensure(photo, KindThumbnail)
+			errs <- err
+		}(photos[i%len(photos)])
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(cache.inflight) != 0 || len(cache.generating) != 0 {
+		t.Error("expected finished generations to be forgotten")
+	}
+
+	// new photos are generated in the background
+	if err := cache.RemoveSession("s1"); err != nil {
+		t.Fatal(err)
+	}
+	go cache.Run()
+	cache.Enqueue(photos[0])
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(cache.Path(photos[0], KindWeb)); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected queued photo to get its derivatives")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
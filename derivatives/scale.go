@@ -0,0 +1,80 @@
+package derivatives
+
+import (
+	"image"
+	"image/color"
+)
+
+// fit scales the image down, so its longer side is at most size, smaller images are returned as they are
+func fit(src image.Image, size int) image.Image {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= size && height <= size {
+		return src
+	}
+
+	dstWidth, dstHeight := size, height*size/width
+	if height > width {
+		dstWidth, dstHeight = width*size/height, size
+	}
+	if dstWidth < 1 {
+		dstWidth = 1
+	}
+	if dstHeight < 1 {
+		dstHeight = 1
+	}
+
+	if ycbcr, ok := src.(*image.YCbCr); ok {
+		return boxYCbCr(ycbcr, dstWidth, dstHeight)
+	}
+	return box(src, dstWidth, dstHeight)
+}
+
+// box averages all source pixels covered by each destination pixel, which keeps fine detail
+// from turning into noise the way picking single pixels does
+func box(src image.Image, dstWidth, dstHeight int) *image.RGBA {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		y0, y1 := y*height/dstHeight, (y+1)*height/dstHeight
+		for x := 0; x < dstWidth; x++ {
+			x0, x1 := x*width/dstWidth, (x+1)*width/dstWidth
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(bounds.Min.X+sx, bounds.Min.Y+sy).RGBA()
+					r, g, b, a, n = r+pr>>8, g+pg>>8, b+pb>>8, a+pa>>8, n+1
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2], dst.Pix[i+3] = uint8(r/n), uint8(g/n), uint8(b/n), uint8(a/n)
+		}
+	}
+	return dst
+}
+
+// boxYCbCr is box for decoded JPEGs, it reads the planes directly instead of converting every pixel through At
+func boxYCbCr(src *image.YCbCr, dstWidth, dstHeight int) *image.RGBA {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		y0, y1 := y*height/dstHeight, (y+1)*height/dstHeight
+		for x := 0; x < dstWidth; x++ {
+			x0, x1 := x*width/dstWidth, (x+1)*width/dstWidth
+			var sumY, sumCb, sumCr, n uint32
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					px, py := bounds.Min.X+sx, bounds.Min.Y+sy
+					ci := src.COffset(px, py)
+					sumY, sumCb, sumCr, n = sumY+uint32(src.Y[src.YOffset(px, py)]), sumCb+uint32(src.Cb[ci]), sumCr+uint32(src.Cr[ci]), n+1
+				}
+			}
+			r, g, b := color.YCbCrToRGB(uint8(sumY/n), uint8(sumCb/n), uint8(sumCr/n))
+			i := dst.PixOffset(x, y)
+			dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2], dst.Pix[i+3] = r, g, b, 0xff
+		}
+	}
+	return dst
+}
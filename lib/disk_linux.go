@@ -1,13 +1,14 @@
 //go:build linux
 // +build linux
 
-package system_stats
+package lib
 
 import (
 	"golang.org/x/sys/unix"
 )
 
-func getDiskUsage(path string) (total, free uint64, err error) {
+// DiskUsage returns size and free space of the filesystem containing path
+func DiskUsage(path string) (total, free uint64, err error) {
 	var stat unix.Statfs_t
 	err = unix.Statfs(path, &stat)
 	if err != nil {
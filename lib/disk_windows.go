@@ -0,0 +1,12 @@
+//go:build windows
+// +build windows
+
+package lib
+
+// DiskUsage returns size and free space of the filesystem containing path
+func DiskUsage(path string) (total, free uint64, err error) {
+	// Mockowane wartości
+	total = 1000000000
+	free = 500000000
+	return total, free, nil
+}
@@ -0,0 +1,22 @@
+package lib
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// PhotoTimeFormat is the layout used for naming captured frames, e.g. 2006-01-02__15-04-05.jpg
+const PhotoTimeFormat = "2006-01-02__15-04-05"
+
+func PhotoFileName(takenAt time.Time, encoding string) string {
+	return fmt.Sprintf("%s.%s", takenAt.Format(PhotoTimeFormat), encoding)
+}
+
+// ParsePhotoTime returns the capture time encoded in the name of a frame
+func ParsePhotoTime(fileName string) (time.Time, error) {
+	name := filepath.Base(fileName)
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	return time.ParseInLocation(PhotoTimeFormat, name, time.Local)
+}
@@ -0,0 +1,178 @@
+package render
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	gifMaxWidth  = 480
+	gifMaxFrames = 300
+	jpegQuality  = 95
+)
+
+var ErrTooManyFramesForGif = fmt.Errorf("gif supports up to %d frames, use mp4 instead", gifMaxFrames)
+
+// frameJPEG returns frame as JPEG bytes, re-encoding it if it was saved in a different format
+func frameJPEG(frame Frame) ([]byte, error) {
+	data, err := os.ReadFile(frame.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	ext := strings.ToLower(filepath.Ext(frame.Path))
+	if ext == ".jpg" || ext == ".jpeg" {
+		return data, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decode %s: %w", frame.Path, err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err = jpeg.Encode(buf, img, &jpeg.Options{Quality: jpegQuality}); err != nil {
+		return nil, fmt.Errorf("encode %s: %w", frame.Path, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeMP4 pipes frames into ffmpeg which encodes them with h264
+func encodeMP4(ffmpegPath string, frames []Frame, fps int, outputPath string, progress func(framesDone int)) error {
+	cmd := exec.Command(ffmpegPath,
+		"-y", "-loglevel", "error",
+		"-f", "image2pipe",
+		"-c:v", "mjpeg",
+		"-framerate", strconv.Itoa(fps),
+		"-i", "-",
+		"-c:v", "libx264",
+		"-pix_fmt", "yuv420p",
+		"-movflags", "+faststart",
+		outputPath,
+	)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("stdin pipe: %w", err)
+	}
+
+	if err = cmd.Start(); err != nil {
+		return fmt.Errorf("start ffmpeg: %w", err)
+	}
+
+	for i, frame := range frames {
+		data, err := frameJPEG(frame)
+		if err == nil {
+			_, err = stdin.Write(data)
+		}
+		if err != nil {
+			_ = stdin.Close()
+			_ = cmd.Wait()
+			return err
+		}
+		progress(i + 1)
+	}
+
+	_ = stdin.Close()
+	if err = cmd.Wait(); err != nil {
+		return fmt.Errorf("ffmpeg: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// encodeMJPEG writes frames one after another as a raw motion JPEG stream
+func encodeMJPEG(frames []Frame, outputPath string, progress func(framesDone int)) error {
+	f, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for i, frame := range frames {
+		data, err := frameJPEG(frame)
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(data); err != nil {
+			return err
+		}
+		progress(i + 1)
+	}
+	return w.Flush()
+}
+
+func downscale(src image.Image, maxWidth int) image.Image {
+	bounds := src.Bounds()
+	if bounds.Dx() <= maxWidth {
+		return src
+	}
+
+	height := bounds.Dy() * maxWidth / bounds.Dx()
+	dst := image.NewRGBA(image.Rect(0, 0, maxWidth, height))
+	for y := 0; y < height; y++ {
+		srcY := bounds.Min.Y + y*bounds.Dy()/height
+		for x := 0; x < maxWidth; x++ {
+			dst.Set(x, y, src.At(bounds.Min.X+x*bounds.Dx()/maxWidth, srcY))
+		}
+	}
+	return dst
+}
+
+// encodeGIF produces downscaled animated gif, it keeps every frame in memory so amount of frames is limited
+func encodeGIF(frames []Frame, fps int, outputPath string, progress func(framesDone int)) error {
+	if len(frames) > gifMaxFrames {
+		return ErrTooManyFramesForGif
+	}
+
+	delay := 100 / fps
+	if delay < 2 {
+		delay = 2 // most browsers treat lower values as 10
+	}
+
+	animation := &gif.GIF{}
+	for i, frame := range frames {
+		f, err := os.Open(frame.Path)
+		if err != nil {
+			return err
+		}
+		img, _, err := image.Decode(f)
+		_ = f.Close()
+		if err != nil {
+			return fmt.Errorf("decode %s: %w", frame.Path, err)
+		}
+
+		img = downscale(img, gifMaxWidth)
+		paletted := image.NewPaletted(img.Bounds(), palette.Plan9)
+		draw.FloydSteinberg.Draw(paletted, img.Bounds(), img, image.Point{})
+
+		animation.Image = append(animation.Image, paletted)
+		animation.Delay = append(animation.Delay, delay)
+		progress(i + 1)
+	}
+
+	f, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+
+	if err = gif.EncodeAll(f, animation); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,295 @@
+package render
+
+import (
+	"errors"
+	"fmt"
+	"github.com/macrosiak/rspi-timelaps-manager-go/catalog"
+	"github.com/macrosiak/rspi-timelaps-manager-go/config"
+	"github.com/macrosiak/rspi-timelaps-manager-go/session"
+	"github.com/rs/zerolog/log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Format string
+
+const (
+	FormatMP4   Format = "mp4"
+	FormatMJPEG Format = "mjpeg"
+	FormatGIF   Format = "gif"
+)
+
+type JobState string
+
+const (
+	JobStateQueued  JobState = "QUEUED"
+	JobStateRunning JobState = "RUNNING"
+	JobStateDone    JobState = "DONE"
+	JobStateFailed  JobState = "FAILED"
+)
+
+const (
+	maxFps       = 120
+	jobQueueSize = 8
+	// jobHistory is how many finished jobs are remembered, older ones are forgotten, their output stays
+	jobHistory = 20
+)
+
+var (
+	ErrInvalidFormat = errors.New("invalid render format")
+	ErrInvalidFps    = errors.New("invalid fps")
+	ErrInvalidRange  = errors.New("invalid time range")
+	ErrNoFrames      = errors.New("no frames in given time range")
+	ErrQueueFull     = errors.New("render queue is full")
+)
+
+// Request describes which frames should be rendered, From and To are unix timestamps (inclusive)
+type Request struct {
+	From   int64  `json:"from"`
+	To     int64  `json:"to"`
+	Fps    int    `json:"fps"`
+	Format Format `json:"format"`
+	// Session limits frames to one session, empty means frames of all sessions
+	Session string `json:"session"`
+}
+
+func (r Request) Validate() error {
+	switch r.Format {
+	case FormatMP4, FormatMJPEG, FormatGIF:
+	default:
+		return ErrInvalidFormat
+	}
+	if r.Fps <= 0 || r.Fps > maxFps {
+		return ErrInvalidFps
+	}
+	if r.To != 0 && r.To < r.From {
+		return ErrInvalidRange
+	}
+	return nil
+}
+
+type Job struct {
+	Id          string   `json:"id"`
+	Request     Request  `json:"request"`
+	State       JobState `json:"state"`
+	FramesTotal int      `json:"framesTotal"`
+	FramesDone  int      `json:"framesDone"`
+	Output      string   `json:"output"`
+	Error       *string  `json:"error"`
+	CreatedAt   int64    `json:"createdAt"`
+	FinishedAt  *int64   `json:"finishedAt"`
+}
+
+// Progress returns value between 0 and 1
+func (j Job) Progress() float64 {
+	if j.FramesTotal == 0 {
+		return 0
+	}
+	return float64(j.FramesDone) / float64(j.FramesTotal)
+}
+
+type Frame struct {
+	Path    string
+	TakenAt time.Time
+}
+
+type Renderer struct {
+	cfg        *config.Config
+	catalog    *catalog.Catalog
+	mu         sync.Mutex
+	jobs       map[string]*Job
+	queue      chan *Job
+	onProgress func(job Job)
+}
+
+// NewRenderer starts background worker which renders queued jobs one at a time,
+// onProgress is called with a copy of the job every time its state or progress changes
+func NewRenderer(cfg *config.Config, photoCatalog *catalog.Catalog, onProgress func(job Job)) *Renderer {
+	r := &Renderer{
+		cfg:        cfg,
+		catalog:    photoCatalog,
+		jobs:       make(map[string]*Job),
+		queue:      make(chan *Job, jobQueueSize),
+		onProgress: onProgress,
+	}
+	go r.run()
+	return r
+}
+
+func (r *Renderer) Enqueue(req Request) (*Job, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	job := &Job{
+		Id:        strconv.FormatInt(now.UnixNano(), 36),
+		Request:   req,
+		State:     JobStateQueued,
+		CreatedAt: now.Unix(),
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	select {
+	case r.queue <- job:
+	default:
+		return nil, ErrQueueFull
+	}
+	r.jobs[job.Id] = job
+	r.prune()
+	jobCopy := *job
+	return &jobCopy, nil
+}
+
+// prune forgets the oldest finished jobs beyond jobHistory, it must be called with mu held
+func (r *Renderer) prune() {
+	var finished []*Job
+	for _, job := range r.jobs {
+		if job.State == JobStateDone || job.State == JobStateFailed {
+			finished = append(finished, job)
+		}
+	}
+	if len(finished) <= jobHistory {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return *finished[i].FinishedAt < *finished[j].FinishedAt
+	})
+	for _, job := range finished[:len(finished)-jobHistory] {
+		delete(r.jobs, job.Id)
+	}
+}
+
+func (r *Renderer) Jobs() []Job {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	jobs := make([]Job, 0, len(r.jobs))
+	for _, job := range r.jobs {
+		jobs = append(jobs, *job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt < jobs[j].CreatedAt
+	})
+	return jobs
+}
+
+func (r *Renderer) update(job *Job, fn func(job *Job)) {
+	r.mu.Lock()
+	fn(job)
+	jobCopy := *job
+	r.mu.Unlock()
+
+	if r.onProgress != nil {
+		r.onProgress(jobCopy)
+	}
+}
+
+func (r *Renderer) run() {
+	for job := range r.queue {
+		r.process(job)
+	}
+}
+
+func (r *Renderer) process(job *Job) {
+	fail := func(err error) {
+		log.Err(err).Str("job", job.Id).Msg("render timelapse")
+		r.update(job, func(job *Job) {
+			msg := err.Error()
+			finishedAt := time.Now().Unix()
+			job.State = JobStateFailed
+			job.Error = &msg
+			job.FinishedAt = &finishedAt
+		})
+	}
+
+	frames, err := r.collectFrames(job.Request)
+	if err != nil {
+		fail(fmt.Errorf("collect frames: %w", err))
+		return
+	}
+	if len(frames) == 0 {
+		fail(ErrNoFrames)
+		return
+	}
+
+	// job ids are unique, timestamps with second resolution aren't
+	outputName := fmt.Sprintf("timelapse_%s.%s", job.Id, job.Request.Format)
+	r.update(job, func(job *Job) {
+		job.State = JobStateRunning
+		job.FramesTotal = len(frames)
+		job.Output = outputName
+	})
+
+	lastPercent := 0
+	progress := func(framesDone int) {
+		percent := framesDone * 100 / len(frames)
+		if percent == lastPercent && framesDone != len(frames) {
+			return
+		}
+		lastPercent = percent
+		r.update(job, func(job *Job) {
+			job.FramesDone = framesDone
+		})
+	}
+
+	outputPath := filepath.Join(r.cfg.RenderOutputDir, outputName)
+	err = r.encode(job.Request, frames, outputPath, progress)
+	if err != nil {
+		_ = os.Remove(outputPath)
+		fail(fmt.Errorf("encode %s: %w", job.Request.Format, err))
+		return
+	}
+
+	r.update(job, func(job *Job) {
+		finishedAt := time.Now().Unix()
+		job.State = JobStateDone
+		job.FinishedAt = &finishedAt
+	})
+}
+
+func (r *Renderer) encode(req Request, frames []Frame, outputPath string, progress func(framesDone int)) error {
+	switch req.Format {
+	case FormatMP4:
+		return encodeMP4(r.cfg.RenderFfmpegPath, frames, req.Fps, outputPath, progress)
+	case FormatMJPEG:
+		return encodeMJPEG(frames, outputPath, progress)
+	case FormatGIF:
+		return encodeGIF(frames, req.Fps, outputPath, progress)
+	}
+	return ErrInvalidFormat
+}
+
+func isRenderable(fileName string) bool {
+	ext := strings.ToLower(filepath.Ext(fileName))
+	return ext == ".jpg" || ext == ".jpeg" || ext == ".png"
+}
+
+// collectFrames returns catalogued frames in the requested range, ordered by the capture time encoded in their names
+func (r *Renderer) collectFrames(req Request) ([]Frame, error) {
+	var from, to time.Time
+	from = time.Unix(req.From, 0)
+	if req.To != 0 {
+		to = time.Unix(req.To, 0)
+	}
+
+	photos, err := r.catalog.SessionRange(req.Session, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("list photos: %w", err)
+	}
+
+	var frames []Frame
+	for _, photo := range photos {
+		if !isRenderable(photo.FileName) || (req.Session == "" && photo.Session == session.ManualId) {
+			continue
+		}
+		frames = append(frames, Frame{Path: filepath.Join(r.cfg.OutputDir, photo.Session, photo.FileName), TakenAt: photo.TakenAtTime()})
+	}
+	return frames, nil
+}
@@ -0,0 +1,89 @@
+package render
+
+import (
+	"github.com/macrosiak/rspi-timelaps-manager-go/catalog"
+	"github.com/macrosiak/rspi-timelaps-manager-go/config"
+	"github.com/macrosiak/rspi-timelaps-manager-go/database"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCollectFramesOrdersByFileName(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{
+		"2023-10-02__10-00-00.jpg",
+		"2023-10-01__23-59-00.jpg",
+		"2023-10-02__09-00-00.png",
+		"2023-10-03__00-00-00.jpg",
+		"2023-10-02__09-30-00.yuv420",
+		"notes.txt",
+	}
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte{}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := database.OpenInMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	photoCatalog := catalog.New(db)
+	if _, _, err = photoCatalog.Reconcile(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	from := time.Date(2023, 10, 1, 0, 0, 0, 0, time.Local)
+	to := time.Date(2023, 10, 2, 23, 59, 59, 0, time.Local)
+	r := &Renderer{cfg: &config.Config{OutputDir: dir}, catalog: photoCatalog}
+	frames, err := r.collectFrames(Request{From: from.Unix(), To: to.Unix(), Fps: 25, Format: FormatMP4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"2023-10-01__23-59-00.jpg", "2023-10-02__09-00-00.png", "2023-10-02__10-00-00.jpg"}
+	if len(frames) != len(expected) {
+		t.Fatalf("expected %d frames, got %d", len(expected), len(frames))
+	}
+	for i, frame := range frames {
+		if filepath.Base(frame.Path) != expected[i] {
+			t.Errorf("frame %d: expected %s, got %s", i, expected[i], filepath.Base(frame.Path))
+		}
+	}
+}
+
+func TestRequestValidate(t *testing.T) {
+	cases := []struct {
+		request Request
+		err     error
+	}{
+		{Request{Fps: 25, Format: FormatMP4}, nil},
+		{Request{Fps: 25, Format: "avi"}, ErrInvalidFormat},
+		{Request{Fps: 0, Format: FormatGIF}, ErrInvalidFps},
+		{Request{From: 10, To: 5, Fps: 10, Format: FormatMJPEG}, ErrInvalidRange},
+	}
+	for _, c := range cases {
+		if err := c.request.Validate(); err != c.err {
+			t.Errorf("%+v: expected %v, got %v", c.request, c.err, err)
+		}
+	}
+}
+
+func TestFinishedJobsArePruned(t *testing.T) {
+	r := &Renderer{jobs: make(map[string]*Job)}
+	for i := int64(0); i < jobHistory+5; i++ {
+		finishedAt := i
+		id := strconv.FormatInt(i, 10)
+		r.jobs[id] = &Job{Id: id, State: JobStateDone, FinishedAt: &finishedAt}
+	}
+	r.jobs["queued"] = &Job{Id: "queued", State: JobStateQueued}
+
+	r.prune()
+	if len(r.jobs) != jobHistory+1 || r.jobs["queued"] == nil || r.jobs["4"] != nil || r.jobs["5"] == nil {
+		t.Errorf("expected oldest finished jobs to be forgotten, got %d jobs", len(r.jobs))
+	}
+}
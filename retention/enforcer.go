@@ -0,0 +1,171 @@
+package retention
+
+import (
+	"fmt"
+	"github.com/macrosiak/rspi-timelaps-manager-go/catalog"
+	"github.com/macrosiak/rspi-timelaps-manager-go/commands"
+	"github.com/macrosiak/rspi-timelaps-manager-go/lib"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"time"
+)
+
+// before a capture policies are evaluated at most this often, unless free space is below the limit
+const minEnforceGap = time.Minute
+
+type RemovalReport struct {
+	FileName string `json:"fileName"`
+	Session  string `json:"session"`
+	Size     int64  `json:"size"`
+	Reason   Reason `json:"reason"`
+}
+
+// Report describes what one run removed, or would remove in dry-run mode
+type Report struct {
+	DryRun         bool            `json:"dryRun"`
+	RanAt          int64           `json:"ranAt"`
+	FreeSpace      int64           `json:"freeSpace"`
+	Removals       []RemovalReport `json:"removals"`
+	Files          int             `json:"files"`
+	ReclaimedBytes int64           `json:"reclaimedBytes"`
+	Thinned        int             `json:"thinned"`
+}
+
+// UploadQueue tells which photos weren't uploaded to remote storage yet
+type UploadQueue interface {
+	Pending(fileName string) bool
+}
+
+// Enforcer removes photos according to the policy in the store
+type Enforcer struct {
+	store     *Store
+	catalog   *catalog.Catalog
+	commands  *commands.CommendsService
+	outputDir string
+	uploads   UploadQueue
+
+	mu      sync.Mutex
+	lastRun time.Time
+}
+
+func NewEnforcer(store *Store, photoCatalog *catalog.Catalog, commandsService *commands.CommendsService, outputDir string) *Enforcer {
+	return &Enforcer{store: store, catalog: photoCatalog, commands: commandsService, outputDir: outputDir}
+}
+
+// SetUploadQueue lets policies with KeepPendingUploads skip photos waiting for upload
+func (e *Enforcer) SetUploadQueue(uploads UploadQueue) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.uploads = uploads
+}
+
+func (e *Enforcer) Policy() Policy {
+	return e.store.Get()
+}
+
+func (e *Enforcer) SetPolicy(policy Policy) error {
+	return e.store.Set(policy)
+}
+
+// Enforce evaluates the policy, dryRun only reports which photos would be removed
+func (e *Enforcer) Enforce(dryRun bool) (Report, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	report := Report{DryRun: dryRun, RanAt: now.Unix(), Removals: []RemovalReport{}}
+
+	_, free, err := lib.DiskUsage(e.outputDir)
+	if err != nil {
+		return report, fmt.Errorf("get disk usage: %w", err)
+	}
+	report.FreeSpace = int64(free)
+
+	policy := e.store.Get()
+	if !policy.Enabled() {
+		return report, nil
+	}
+
+	photos, err := e.catalog.All()
+	if err != nil {
+		return report, fmt.Errorf("list photos: %w", err)
+	}
+	if policy.KeepPendingUploads && e.uploads != nil {
+		var uploaded []catalog.Photo
+		for _, photo := range photos {
+			if !e.uploads.Pending(photo.FileName) {
+				uploaded = append(uploaded, photo)
+			}
+		}
+		photos = uploaded
+	}
+
+	plan := NewPlan(policy, photos, report.FreeSpace, now)
+	for _, removal := range plan.Removals {
+		if !dryRun {
+			if err = e.commands.RemovePhoto(removal.Photo); err != nil {
+				log.Err(err).Str("file", removal.Photo.FileName).Msg("retention remove photo")
+				continue
+			}
+		}
+		report.Removals = append(report.Removals, RemovalReport{
+			FileName: removal.Photo.FileName,
+			Session:  removal.Photo.Session,
+			Size:     removal.Photo.Size,
+			Reason:   removal.Reason,
+		})
+		report.Files++
+		report.ReclaimedBytes += removal.Photo.Size
+	}
+
+	report.Thinned = len(plan.Thinned)
+	if !dryRun {
+		for _, photo := range plan.Thinned {
+			photo.Thinned = true
+			if err = e.catalog.Add(photo); err != nil {
+				log.Err(err).Str("file", photo.FileName).Msg("mark photo as thinned")
+			}
+		}
+		e.lastRun = now
+	}
+	return report, nil
+}
+
+func (e *Enforcer) enforceAndLog() {
+	report, err := e.Enforce(false)
+	if err != nil {
+		log.Err(err).Msg("enforce retention policy")
+		return
+	}
+	if report.Files > 0 {
+		log.Info().Int("files", report.Files).Int64("reclaimed", report.ReclaimedBytes).Msg("retention policy removed photos")
+	}
+}
+
+// BeforeCapture enforces the policy unless it ran recently and there is enough free space
+func (e *Enforcer) BeforeCapture() {
+	policy := e.store.Get()
+	if !policy.Enabled() {
+		return
+	}
+
+	e.mu.Lock()
+	recent := time.Since(e.lastRun) < minEnforceGap
+	e.mu.Unlock()
+	if recent && policy.MinFreeSpace > 0 {
+		_, free, err := lib.DiskUsage(e.outputDir)
+		recent = err == nil && int64(free) >= policy.MinFreeSpace
+	}
+	if recent {
+		return
+	}
+	e.enforceAndLog()
+}
+
+// Run enforces the policy every interval, it never returns
+func (e *Enforcer) Run(interval time.Duration) {
+	for {
+		e.enforceAndLog()
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,204 @@
+package retention
+
+import (
+	"errors"
+	"github.com/macrosiak/rspi-timelaps-manager-go/catalog"
+	"github.com/macrosiak/rspi-timelaps-manager-go/lib"
+	"time"
+)
+
+var (
+	ErrNegativeLimit    = errors.New("retention limits can't be negative")
+	ErrInvalidThinning  = errors.New("thinning must start after a positive age")
+	ErrInvalidKeepEvery = errors.New("keep every must be at least 2")
+)
+
+type Reason string
+
+const (
+	ReasonMaxAge       Reason = "MAX_AGE"
+	ReasonThinning     Reason = "THINNING"
+	ReasonSessionQuota Reason = "SESSION_QUOTA"
+	ReasonMaxTotalSize Reason = "MAX_TOTAL_SIZE"
+	ReasonMinFreeSpace Reason = "MIN_FREE_SPACE"
+)
+
+// Thinning keeps only every KeepEvery-th frame of photos older than After
+type Thinning struct {
+	After     lib.Duration `json:"after"`
+	KeepEvery int          `json:"keepEvery"`
+}
+
+// Policy limits how much space photos take, zero value disables a limit
+type Policy struct {
+	// MaxTotalSize of all photos in bytes
+	MaxTotalSize int64 `json:"maxTotalSize"`
+	// MinFreeSpace on the photos disk in bytes
+	MinFreeSpace int64        `json:"minFreeSpace"`
+	MaxAge       lib.Duration `json:"maxAge"`
+	Thinning     *Thinning    `json:"thinning"`
+	// SessionQuota is the maximum size of photos of a single session in bytes
+	SessionQuota int64 `json:"sessionQuota"`
+	// KeepPendingUploads never removes photos still waiting for upload to remote storage
+	KeepPendingUploads bool `json:"keepPendingUploads"`
+}
+
+func (p Policy) Validate() error {
+	if p.MaxTotalSize < 0 || p.MinFreeSpace < 0 || p.MaxAge < 0 || p.SessionQuota < 0 {
+		return ErrNegativeLimit
+	}
+	if p.Thinning != nil {
+		if p.Thinning.After <= 0 {
+			return ErrInvalidThinning
+		}
+		if p.Thinning.KeepEvery < 2 {
+			return ErrInvalidKeepEvery
+		}
+	}
+	return nil
+}
+
+func (p Policy) Enabled() bool {
+	return p.MaxTotalSize > 0 || p.MinFreeSpace > 0 || p.MaxAge > 0 || p.Thinning != nil || p.SessionQuota > 0
+}
+
+type Removal struct {
+	Photo  catalog.Photo
+	Reason Reason
+}
+
+// Plan lists photos to remove and photos which survived thinning and should be marked as thinned
+type Plan struct {
+	Removals []Removal
+	Thinned  []catalog.Photo
+}
+
+type planner struct {
+	policy  Policy
+	photos  []catalog.Photo
+	removed map[string]bool
+	plan    Plan
+}
+
+func (p *planner) remove(photo catalog.Photo, reason Reason) int64 {
+	p.removed[photo.FileName] = true
+	p.plan.Removals = append(p.plan.Removals, Removal{Photo: photo, Reason: reason})
+	return photo.Size
+}
+
+// remaining returns photos which aren't planned for removal yet, in chronological order
+func (p *planner) remaining() []catalog.Photo {
+	var photos []catalog.Photo
+	for _, photo := range p.photos {
+		if !p.removed[photo.FileName] {
+			photos = append(photos, photo)
+		}
+	}
+	return photos
+}
+
+// NewPlan applies policies in order: max age, thinning, session quotas, max total size and min free space,
+// photos must be in chronological order, the oldest photos are removed first
+func NewPlan(policy Policy, photos []catalog.Photo, freeSpace int64, now time.Time) Plan {
+	p := &planner{policy: policy, photos: photos, removed: make(map[string]bool)}
+
+	if policy.MaxAge > 0 {
+		oldest := now.Add(-time.Duration(policy.MaxAge))
+		for _, photo := range p.remaining() {
+			if photo.TakenAtTime().Before(oldest) {
+				p.remove(photo, ReasonMaxAge)
+			}
+		}
+	}
+
+	if policy.Thinning != nil {
+		p.thin(now.Add(-time.Duration(policy.Thinning.After)))
+	}
+
+	if policy.SessionQuota > 0 {
+		sizes := make(map[string]int64)
+		for _, photo := range p.remaining() {
+			sizes[photo.Session] += photo.Size
+		}
+		for _, photo := range p.remaining() {
+			if sizes[photo.Session] > policy.SessionQuota {
+				sizes[photo.Session] -= p.remove(photo, ReasonSessionQuota)
+			}
+		}
+	}
+
+	if policy.MaxTotalSize > 0 {
+		var total int64
+		for _, photo := range p.remaining() {
+			total += photo.Size
+		}
+		for _, photo := range p.remaining() {
+			if total <= policy.MaxTotalSize {
+				break
+			}
+			total -= p.remove(photo, ReasonMaxTotalSize)
+		}
+	}
+
+	if policy.MinFreeSpace > 0 {
+		free := freeSpace
+		for _, removal := range p.plan.Removals {
+			free += removal.Photo.Size
+		}
+		for _, photo := range p.remaining() {
+			if free >= policy.MinFreeSpace {
+				break
+			}
+			free += p.remove(photo, ReasonMinFreeSpace)
+		}
+	}
+
+	// photos kept by thinning may still be removed by the size limits
+	var thinned []catalog.Photo
+	for _, photo := range p.plan.Thinned {
+		if !p.removed[photo.FileName] {
+			thinned = append(thinned, photo)
+		}
+	}
+	p.plan.Thinned = thinned
+	return p.plan
+}
+
+// thin keeps every n-th photo of each session taken before, photos kept by previous runs aren't thinned again,
+// runs usually see a single newly aged frame, so a frame is kept once KeepEvery capture intervals passed
+// since the last kept one, the interval is the gap to the next photo of the session
+func (p *planner) thin(before time.Time) {
+	gaps := make(map[string]time.Duration)
+	last := make(map[string]catalog.Photo)
+	for _, photo := range p.photos {
+		if prev, ok := last[photo.Session]; ok {
+			gap := photo.TakenAtTime().Sub(prev.TakenAtTime())
+			gaps[prev.FileName] = gap
+			// the last photo of a session has no next one, the gap to the previous one is used instead
+			gaps[photo.FileName] = gap
+		}
+		last[photo.Session] = photo
+	}
+
+	// half an interval tolerates capture times drifting by a second or two
+	keepAfter := float64(p.policy.Thinning.KeepEvery) - 0.5
+	lastKept := make(map[string]time.Time)
+	for _, photo := range p.remaining() {
+		takenAt := photo.TakenAtTime()
+		if photo.Thinned {
+			lastKept[photo.Session] = takenAt
+			continue
+		}
+		if !takenAt.Before(before) {
+			continue
+		}
+
+		kept, ok := lastKept[photo.Session]
+		if !ok || takenAt.Sub(kept) >= time.Duration(keepAfter*float64(gaps[photo.FileName])) {
+			p.plan.Thinned = append(p.plan.Thinned, photo)
+			lastKept[photo.Session] = takenAt
+		} else {
+			p.remove(photo, ReasonThinning)
+		}
+	}
+}
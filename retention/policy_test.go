@@ -0,0 +1,120 @@
+package retention
+
+import (
+	"github.com/macrosiak/rspi-timelaps-manager-go/catalog"
+	"github.com/macrosiak/rspi-timelaps-manager-go/lib"
+	"testing"
+	"time"
+)
+
+// hourlyPhotos returns n photos of the session taken every hour until now, each one 10 bytes
+func hourlyPhotos(session string, n int, now time.Time) []catalog.Photo {
+	var photos []catalog.Photo
+	for i := n - 1; i >= 0; i-- {
+		takenAt := now.Add(-time.Duration(i) * time.Hour)
+		photos = append(photos, catalog.Photo{
+			FileName: lib.PhotoFileName(takenAt, "jpg"),
+			Session:  session,
+			TakenAt:  takenAt.Unix(),
+			Size:     10,
+		})
+	}
+	return photos
+}
+
+func reasons(plan Plan) map[Reason]int {
+	counts := make(map[Reason]int)
+	for _, removal := range plan.Removals {
+		counts[removal.Reason]++
+	}
+	return counts
+}
+
+func TestPlanMaxAgeAndThinning(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	photos := hourlyPhotos("garden", 10, now)
+
+	policy := Policy{
+		MaxAge:   lib.Duration(7*time.Hour + time.Minute),
+		Thinning: &Thinning{After: lib.Duration(3*time.Hour + time.Minute), KeepEvery: 2},
+	}
+	plan := NewPlan(policy, photos, 0, now)
+
+	// 2 photos are older than 7 hours, 4 remaining photos older than 3 hours are thinned to every 2nd
+	if counts := reasons(plan); counts[ReasonMaxAge] != 2 || counts[ReasonThinning] != 2 || len(plan.Thinned) != 2 {
+		t.Errorf("unexpected plan %+v", counts)
+	}
+
+	// photos kept by thinning aren't thinned again
+	photos = apply(photos, plan)
+	policy.MaxAge = 0
+	plan = NewPlan(policy, photos, 0, now)
+	if counts := reasons(plan); counts[ReasonThinning] != 0 {
+		t.Errorf("expected no photos to be thinned again, got %+v", counts)
+	}
+}
+
+// apply removes photos planned for removal and marks the kept ones as thinned, like the enforcer does
+func apply(photos []catalog.Photo, plan Plan) []catalog.Photo {
+	removed := make(map[string]bool)
+	for _, removal := range plan.Removals {
+		removed[removal.Photo.FileName] = true
+	}
+	thinned := make(map[string]bool)
+	for _, photo := range plan.Thinned {
+		thinned[photo.FileName] = true
+	}
+
+	var remaining []catalog.Photo
+	for _, photo := range photos {
+		if removed[photo.FileName] {
+			continue
+		}
+		photo.Thinned = photo.Thinned || thinned[photo.FileName]
+		remaining = append(remaining, photo)
+	}
+	return remaining
+}
+
+func TestThinningAcrossRuns(t *testing.T) {
+	start := time.Now().Truncate(time.Second).Add(-24 * time.Hour)
+	policy := Policy{Thinning: &Thinning{After: lib.Duration(time.Hour), KeepEvery: 4}}
+
+	// retention runs before every capture, so each run sees a single newly aged frame
+	var photos []catalog.Photo
+	for i := 0; i < 600; i++ {
+		// capture times drift by a second now and then
+		takenAt := start.Add(time.Duration(i)*time.Minute + time.Duration(i%3)*time.Second)
+		photos = append(photos, catalog.Photo{FileName: lib.PhotoFileName(takenAt, "jpg"), Session: "garden", TakenAt: takenAt.Unix()})
+		photos = apply(photos, NewPlan(policy, photos, 0, takenAt))
+	}
+
+	aged, kept := 600-60, 0
+	for _, photo := range photos {
+		if photo.Thinned {
+			kept++
+		}
+	}
+	if kept < aged/4-2 || kept > aged/4+2 {
+		t.Errorf("expected about %d of %d aged frames to be kept, got %d", aged/4, aged, kept)
+	}
+}
+
+func TestPlanSizeLimits(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	photos := append(hourlyPhotos("a", 5, now.Add(-10*time.Hour)), hourlyPhotos("b", 5, now)...)
+
+	plan := NewPlan(Policy{SessionQuota: 30, MaxTotalSize: 50, MinFreeSpace: 100}, photos, 60, now)
+	counts := reasons(plan)
+	if counts[ReasonSessionQuota] != 4 || counts[ReasonMaxTotalSize] != 1 || counts[ReasonMinFreeSpace] != 0 {
+		t.Errorf("unexpected plan %+v", counts)
+	}
+	if plan.Removals[0].Photo.FileName != photos[0].FileName {
+		t.Errorf("expected the oldest photo to be removed first, got %s", plan.Removals[0].Photo.FileName)
+	}
+
+	plan = NewPlan(Policy{MinFreeSpace: 100}, photos, 75, now)
+	if counts = reasons(plan); counts[ReasonMinFreeSpace] != 3 {
+		t.Errorf("expected 3 photos to be removed to free space, got %+v", counts)
+	}
+}
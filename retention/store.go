@@ -0,0 +1,62 @@
+package retention
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Store keeps retention policy in a json file, without the file no photos are removed automatically
+type Store struct {
+	path   string
+	mu     sync.RWMutex
+	policy Policy
+}
+
+func NewStore(path string) (*Store, error) {
+	store := &Store{path: path}
+
+	by, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("read retention policy: %w", err)
+	}
+
+	policy := Policy{}
+	if err = json.Unmarshal(by, &policy); err != nil {
+		return nil, fmt.Errorf("unmarshal retention policy: %w", err)
+	}
+	if err = policy.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid retention policy in %s: %w", path, err)
+	}
+
+	store.policy = policy
+	return store, nil
+}
+
+func (s *Store) Get() Policy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.policy
+}
+
+func (s *Store) Set(policy Policy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+
+	by, err := json.MarshalIndent(policy, "", "  ")
+	if err != nil {
+		return fmt.Errorf("json marshal: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err = os.WriteFile(s.path, by, 0644); err != nil {
+		return fmt.Errorf("write retention policy: %w", err)
+	}
+	s.policy = policy
+	return nil
+}
@@ -0,0 +1,159 @@
+package safeguard
+
+import (
+	"errors"
+	"github.com/macrosiak/rspi-timelaps-manager-go/camera"
+	"github.com/macrosiak/rspi-timelaps-manager-go/config"
+	"github.com/macrosiak/rspi-timelaps-manager-go/lib"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"time"
+)
+
+const (
+	megabyte      = 1024 * 1024
+	checkInterval = 30 * time.Second
+)
+
+// ErrCapturePaused is returned for photos which would be taken while capture is paused
+var ErrCapturePaused = errors.New("capture is paused, there is not enough free space")
+
+type Level string
+
+const (
+	LevelOk      Level = "OK"
+	LevelWarning Level = "WARNING"
+	LevelReduced Level = "REDUCED"
+	LevelPaused  Level = "PAUSED"
+)
+
+// Thresholds are free space limits in bytes, zero disables a level
+type Thresholds struct {
+	Warning        uint64
+	Reduce         uint64
+	Pause          uint64
+	ReducedQuality int
+	IntervalFactor int
+}
+
+func ThresholdsFromConfig(cfg *config.Config) Thresholds {
+	return Thresholds{
+		Warning:        uint64(cfg.DiskWarningFreeMb) * megabyte,
+		Reduce:         uint64(cfg.DiskReduceFreeMb) * megabyte,
+		Pause:          uint64(cfg.DiskPauseFreeMb) * megabyte,
+		ReducedQuality: cfg.DiskReducedQuality,
+		IntervalFactor: cfg.DiskReducedIntervalFactor,
+	}
+}
+
+// LevelFor returns the most severe level whose threshold free space is below
+func (t Thresholds) LevelFor(free uint64) Level {
+	switch {
+	case t.Pause > 0 && free < t.Pause:
+		return LevelPaused
+	case t.Reduce > 0 && free < t.Reduce:
+		return LevelReduced
+	case t.Warning > 0 && free < t.Warning:
+		return LevelWarning
+	}
+	return LevelOk
+}
+
+type State struct {
+	Level     Level  `json:"level"`
+	FreeSpace uint64 `json:"freeSpace"`
+	// Since is when the current level was entered
+	Since int64 `json:"since"`
+}
+
+// Guard watches free space of the photos disk and tells the camera worker how to capture
+type Guard struct {
+	thresholds Thresholds
+	dir        string
+
+	mu        sync.Mutex
+	state     State
+	listeners []func(state State)
+}
+
+func NewGuard(thresholds Thresholds, dir string) *Guard {
+	return &Guard{thresholds: thresholds, dir: dir, state: State{Level: LevelOk, Since: time.Now().Unix()}}
+}
+
+// Check reads free space and updates the level, listeners are notified when the level changes
+func (g *Guard) Check() State {
+	_, free, err := lib.DiskUsage(g.dir)
+	if err != nil {
+		log.Err(err).Msg("get disk usage")
+		return g.State()
+	}
+
+	g.mu.Lock()
+	level := g.thresholds.LevelFor(free)
+	changed := level != g.state.Level
+	g.state.FreeSpace = free
+	if changed {
+		g.state.Level = level
+		g.state.Since = time.Now().Unix()
+	}
+	state := g.state
+	listeners := g.listeners
+	g.mu.Unlock()
+
+	if changed {
+		log.Warn().Str("level", string(level)).Uint64("free", free).Msg("disk safeguard level changed")
+		for _, listener := range listeners {
+			listener(state)
+		}
+	}
+	return state
+}
+
+func (g *Guard) State() State {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.state
+}
+
+// CaptureAllowed is false while capture is paused to keep the card from filling up
+func (s State) CaptureAllowed() bool {
+	return s.Level != LevelPaused
+}
+
+func (g *Guard) reduced() bool {
+	level := g.State().Level
+	return level == LevelReduced || level == LevelPaused
+}
+
+// AdjustSettings lowers quality of photos while free space is low, nil means no change
+func (g *Guard) AdjustSettings(settings *camera.CameraSettings) *camera.CameraSettings {
+	if !g.reduced() || g.thresholds.ReducedQuality <= 0 || settings.Quality <= g.thresholds.ReducedQuality {
+		return nil
+	}
+	adjusted := *settings
+	adjusted.Quality = g.thresholds.ReducedQuality
+	return &adjusted
+}
+
+// AdjustInterval stretches the wait for the next frame while free space is low
+func (g *Guard) AdjustInterval(interval time.Duration) time.Duration {
+	if !g.reduced() || g.thresholds.IntervalFactor <= 1 {
+		return interval
+	}
+	return interval * time.Duration(g.thresholds.IntervalFactor)
+}
+
+// OnChange registers function called with the new state every time the level changes
+func (g *Guard) OnChange(listener func(state State)) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.listeners = append(g.listeners, listener)
+}
+
+// Run checks free space periodically, it never returns
+func (g *Guard) Run() {
+	for {
+		g.Check()
+		time.Sleep(checkInterval)
+	}
+}
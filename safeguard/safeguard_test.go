@@ -0,0 +1,44 @@
+package safeguard
+
+import (
+	"github.com/macrosiak/rspi-timelaps-manager-go/camera"
+	"testing"
+	"time"
+)
+
+func TestThresholdsLevelFor(t *testing.T) {
+	thresholds := Thresholds{Warning: 300, Reduce: 200, Pause: 100}
+	cases := map[uint64]Level{
+		500: LevelOk,
+		250: LevelWarning,
+		150: LevelReduced,
+		50:  LevelPaused,
+	}
+	for free, expected := range cases {
+		if level := thresholds.LevelFor(free); level != expected {
+			t.Errorf("free %d: expected %s, got %s", free, expected, level)
+		}
+	}
+
+	if level := (Thresholds{Pause: 100}).LevelFor(150); level != LevelOk {
+		t.Errorf("expected disabled levels to be skipped, got %s", level)
+	}
+}
+
+func TestGuardAdjustments(t *testing.T) {
+	guard := NewGuard(Thresholds{Reduce: 200, ReducedQuality: 70, IntervalFactor: 3}, t.TempDir())
+	settings := &camera.CameraSettings{Quality: 95}
+
+	if guard.AdjustSettings(settings) != nil || guard.AdjustInterval(time.Minute) != time.Minute {
+		t.Error("expected no adjustments with enough free space")
+	}
+
+	guard.state.Level = LevelReduced
+	adjusted := guard.AdjustSettings(settings)
+	if adjusted == nil || adjusted.Quality != 70 || settings.Quality != 95 {
+		t.Errorf("expected lower quality copy of settings, got %+v", adjusted)
+	}
+	if interval := guard.AdjustInterval(time.Minute); interval != 3*time.Minute {
+		t.Errorf("expected longer interval, got %s", interval)
+	}
+}
@@ -0,0 +1,327 @@
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"github.com/macrosiak/rspi-timelaps-manager-go/lib"
+	"github.com/macrosiak/rspi-timelaps-manager-go/solar"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	clockFormat = "15:04"
+	dateFormat  = "2006-01-02"
+	// how far ahead Next looks for an active period before giving up
+	lookAheadDays = 400
+)
+
+var (
+	ErrInvalidWeekday    = errors.New("invalid weekday")
+	ErrInvalidInterval   = errors.New("interval must be at least one second")
+	ErrInvalidDates      = errors.New("end date is before start date")
+	ErrNegativeSunOffset = errors.New("sun offsets can't be negative")
+)
+
+// Clock is a time of the day in "15:04" format
+type Clock string
+
+func (c Clock) minutes() (int, error) {
+	t, err := time.Parse(clockFormat, string(c))
+	if err != nil {
+		return 0, fmt.Errorf("invalid clock %q, expected HH:MM", c)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Date is a calendar day in "2006-01-02" format
+type Date string
+
+func (d Date) time(loc *time.Location) (time.Time, error) {
+	t, err := time.ParseInLocation(dateFormat, string(d), loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q, expected YYYY-MM-DD", d)
+	}
+	return t, nil
+}
+
+// Window is a part of the day with its own capture interval, To before From means the window passes midnight
+type Window struct {
+	From     Clock        `json:"from"`
+	To       Clock        `json:"to"`
+	Interval lib.Duration `json:"interval"`
+}
+
+func (w Window) contains(minute int) bool {
+	from, _ := w.From.minutes()
+	to, _ := w.To.minutes()
+	if from <= to {
+		return minute >= from && minute < to
+	}
+	return minute >= from || minute < to
+}
+
+// Sun limits taking photos to the daylight, it requires location to be configured
+type Sun struct {
+	// BeforeDawn starts taking photos this long before civil dawn
+	BeforeDawn lib.Duration `json:"beforeDawn"`
+	// AfterDusk keeps taking photos this long after civil dusk
+	AfterDusk lib.Duration `json:"afterDusk"`
+	// GoldenHourInterval replaces the interval during golden hour when it's shorter, zero disables it
+	GoldenHourInterval lib.Duration `json:"goldenHourInterval"`
+}
+
+type Schedule struct {
+	// Weekdays on which photos are taken, e.g. "monday", empty means every day
+	Weekdays []string `json:"weekdays"`
+	// Windows are checked in order, the first one containing given time wins
+	Windows []Window `json:"windows"`
+	// Interval used outside of windows, zero means no photos outside of windows
+	Interval  lib.Duration `json:"interval"`
+	StartDate *Date        `json:"startDate"`
+	EndDate   *Date        `json:"endDate"`
+	Sun       *Sun         `json:"sun"`
+
+	location *solar.Location
+}
+
+// WithLocation returns copy of the schedule which uses given location for the sun calculations
+func (s Schedule) WithLocation(location *solar.Location) Schedule {
+	s.location = location
+	return s
+}
+
+// Every returns schedule which takes photos all the time with the same interval
+func Every(interval time.Duration) Schedule {
+	return Schedule{Interval: lib.Duration(interval)}
+}
+
+func parseWeekday(name string) (time.Weekday, error) {
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if strings.EqualFold(day.String(), name) {
+			return day, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %s", ErrInvalidWeekday, name)
+}
+
+func (s Schedule) Validate() error {
+	for _, name := range s.Weekdays {
+		if _, err := parseWeekday(name); err != nil {
+			return err
+		}
+	}
+
+	for _, window := range s.Windows {
+		if _, err := window.From.minutes(); err != nil {
+			return err
+		}
+		if _, err := window.To.minutes(); err != nil {
+			return err
+		}
+		if time.Duration(window.Interval) < time.Second {
+			return fmt.Errorf("window %s-%s: %w", window.From, window.To, ErrInvalidInterval)
+		}
+	}
+
+	if s.Interval != 0 && time.Duration(s.Interval) < time.Second {
+		return ErrInvalidInterval
+	}
+
+	if s.Sun != nil {
+		if s.Sun.BeforeDawn < 0 || s.Sun.AfterDusk < 0 {
+			return ErrNegativeSunOffset
+		}
+		if s.Sun.GoldenHourInterval != 0 && time.Duration(s.Sun.GoldenHourInterval) < time.Second {
+			return fmt.Errorf("golden hour: %w", ErrInvalidInterval)
+		}
+	}
+
+	var start, end time.Time
+	var err error
+	if s.StartDate != nil {
+		if start, err = s.StartDate.time(time.Local); err != nil {
+			return err
+		}
+	}
+	if s.EndDate != nil {
+		if end, err = s.EndDate.time(time.Local); err != nil {
+			return err
+		}
+	}
+	if s.StartDate != nil && s.EndDate != nil && end.Before(start) {
+		return ErrInvalidDates
+	}
+	return nil
+}
+
+func (s Schedule) isActiveDay(t time.Time) bool {
+	if s.StartDate != nil {
+		start, err := s.StartDate.time(t.Location())
+		if err == nil && t.Before(start) {
+			return false
+		}
+	}
+	if s.EndDate != nil {
+		end, err := s.EndDate.time(t.Location())
+		if err == nil && !t.Before(end.AddDate(0, 0, 1)) {
+			return false
+		}
+	}
+
+	if len(s.Weekdays) == 0 {
+		return true
+	}
+	for _, name := range s.Weekdays {
+		if day, err := parseWeekday(name); err == nil && day == t.Weekday() {
+			return true
+		}
+	}
+	return false
+}
+
+// IntervalAt returns capture interval which applies at given time, false means no photos should be taken
+func (s Schedule) IntervalAt(t time.Time) (time.Duration, bool) {
+	if !s.isActiveDay(t) {
+		return 0, false
+	}
+
+	interval, ok := s.windowInterval(t)
+	if !ok || s.Sun == nil || s.location == nil {
+		return interval, ok
+	}
+
+	if !s.isDaylight(t) {
+		return 0, false
+	}
+	if s.Sun.GoldenHourInterval > 0 && s.isGoldenHour(t) && time.Duration(s.Sun.GoldenHourInterval) < interval {
+		return time.Duration(s.Sun.GoldenHourInterval), true
+	}
+	return interval, true
+}
+
+func (s Schedule) windowInterval(t time.Time) (time.Duration, bool) {
+	minute := t.Hour()*60 + t.Minute()
+	for _, window := range s.Windows {
+		if window.contains(minute) {
+			return time.Duration(window.Interval), true
+		}
+	}
+
+	if s.Interval > 0 {
+		return time.Duration(s.Interval), true
+	}
+	return 0, false
+}
+
+// isDaylight checks whether t is between civil dawn and dusk extended by the configured offsets
+func (s Schedule) isDaylight(t time.Time) bool {
+	dawn, dawnOk := s.location.EventTime(t, solar.ElevationCivil, true)
+	dusk, duskOk := s.location.EventTime(t, solar.ElevationCivil, false)
+	if !dawnOk || !duskOk {
+		// polar day or night
+		return s.location.IsAbove(t, solar.ElevationCivil)
+	}
+
+	start := dawn.Add(-time.Duration(s.Sun.BeforeDawn))
+	end := dusk.Add(time.Duration(s.Sun.AfterDusk))
+	return !t.Before(start) && t.Before(end)
+}
+
+func (s Schedule) isGoldenHour(t time.Time) bool {
+	return s.location.IsAbove(t, solar.ElevationGoldenLow) && !s.location.IsAbove(t, solar.ElevationGoldenHigh)
+}
+
+// sunBoundaries returns moments of the day on which daylight or golden hour starts or ends
+func (s Schedule) sunBoundaries(day time.Time) []time.Time {
+	if s.Sun == nil || s.location == nil {
+		return nil
+	}
+
+	var result []time.Time
+	if dawn, ok := s.location.EventTime(day, solar.ElevationCivil, true); ok {
+		result = append(result, dawn.Add(-time.Duration(s.Sun.BeforeDawn)))
+	}
+	if dusk, ok := s.location.EventTime(day, solar.ElevationCivil, false); ok {
+		result = append(result, dusk.Add(time.Duration(s.Sun.AfterDusk)))
+	}
+	for _, elevation := range []float64{solar.ElevationGoldenLow, solar.ElevationGoldenHigh} {
+		for _, rising := range []bool{true, false} {
+			if event, ok := s.location.EventTime(day, elevation, rising); ok {
+				result = append(result, event)
+			}
+		}
+	}
+	return result
+}
+
+// boundaries returns sorted moments of the day starting at t's midnight on which the interval may change
+func (s Schedule) boundaries(day time.Time) []time.Time {
+	midnight := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, day.Location())
+	result := []time.Time{midnight}
+	for _, window := range s.Windows {
+		for _, clock := range []Clock{window.From, window.To} {
+			minutes, err := clock.minutes()
+			if err != nil {
+				continue
+			}
+			result = append(result, midnight.Add(time.Duration(minutes)*time.Minute))
+		}
+	}
+	result = append(result, s.sunBoundaries(midnight)...)
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Before(result[j])
+	})
+	return result
+}
+
+// nextBoundary returns the first moment after t on which the interval may change
+func (s Schedule) nextBoundary(t time.Time) time.Time {
+	for day := 0; day <= 1; day++ {
+		for _, boundary := range s.boundaries(t.AddDate(0, 0, day)) {
+			if boundary.After(t) {
+				return boundary
+			}
+		}
+	}
+	return t.AddDate(0, 0, 1)
+}
+
+// nextActiveStart returns the first moment after t on which photos should be taken
+func (s Schedule) nextActiveStart(t time.Time) (time.Time, bool) {
+	for day := 0; day <= lookAheadDays; day++ {
+		for _, boundary := range s.boundaries(t.AddDate(0, 0, day)) {
+			if !boundary.After(t) {
+				continue
+			}
+			if _, ok := s.IntervalAt(boundary); ok {
+				return boundary, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// Next returns when the next photo should be taken if the previous one was taken at t,
+// false means the schedule will never be active again
+func (s Schedule) Next(t time.Time) (time.Time, bool) {
+	interval, ok := s.IntervalAt(t)
+	if !ok {
+		return s.nextActiveStart(t)
+	}
+
+	candidate := t.Add(interval)
+	boundary := s.nextBoundary(t)
+	if boundary.Before(candidate) {
+		// don't wait for the long interval to pass when a denser window is about to start
+		if boundaryInterval, ok := s.IntervalAt(boundary); ok && boundaryInterval < interval {
+			return boundary, true
+		}
+	}
+
+	if _, ok := s.IntervalAt(candidate); ok {
+		return candidate, true
+	}
+	return s.nextActiveStart(t)
+}
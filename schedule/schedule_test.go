@@ -0,0 +1,113 @@
+package schedule
+
+import (
+	"encoding/json"
+	"github.com/macrosiak/rspi-timelaps-manager-go/lib"
+	"github.com/macrosiak/rspi-timelaps-manager-go/solar"
+	"testing"
+	"time"
+)
+
+func at(day, hour, minute, second int) time.Time {
+	// 2023-10-02 is monday
+	return time.Date(2023, 10, day, hour, minute, second, 0, time.Local)
+}
+
+func TestNext(t *testing.T) {
+	s := Schedule{
+		Weekdays: []string{"monday", "tuesday"},
+		Windows:  []Window{{From: "07:00", To: "09:00", Interval: lib.Duration(30 * time.Second)}},
+		Interval: lib.Duration(5 * time.Minute),
+	}
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		previous time.Time
+		expected time.Time
+	}{
+		{"inside window", at(2, 7, 10, 0), at(2, 7, 10, 30)},
+		{"outside window", at(2, 10, 0, 0), at(2, 10, 5, 0)},
+		{"denser window starts", at(2, 6, 58, 0), at(2, 7, 0, 0)},
+		{"window ends", at(2, 8, 59, 50), at(2, 9, 0, 20)},
+		{"end of active days", at(3, 23, 58, 0), at(9, 0, 0, 0)},
+		{"inactive day", at(5, 12, 0, 0), at(9, 0, 0, 0)},
+	}
+	for _, c := range cases {
+		next, ok := s.Next(c.previous)
+		if !ok || !next.Equal(c.expected) {
+			t.Errorf("%s: expected %s, got %s (%v)", c.name, c.expected, next, ok)
+		}
+	}
+}
+
+func TestNextOnlyInsideWindows(t *testing.T) {
+	end := Date("2023-10-03")
+	s := Schedule{
+		Windows: []Window{{From: "22:00", To: "02:00", Interval: lib.Duration(time.Hour)}},
+		EndDate: &end,
+	}
+
+	next, ok := s.Next(at(2, 12, 0, 0))
+	if !ok || !next.Equal(at(2, 22, 0, 0)) {
+		t.Errorf("expected window start, got %s (%v)", next, ok)
+	}
+
+	next, ok = s.Next(at(3, 1, 30, 0))
+	if !ok || !next.Equal(at(3, 22, 0, 0)) {
+		t.Errorf("expected next evening, got %s (%v)", next, ok)
+	}
+
+	if next, ok = s.Next(at(3, 23, 30, 0)); ok {
+		t.Errorf("expected no more captures after end date, got %s", next)
+	}
+}
+
+func TestScheduleJson(t *testing.T) {
+	s := Schedule{}
+	err := json.Unmarshal([]byte(`{"weekdays":["Friday"],"windows":[{"from":"07:00","to":"09:00","interval":"30s"}],"interval":"5m"}`), &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if time.Duration(s.Windows[0].Interval) != 30*time.Second || time.Duration(s.Interval) != 5*time.Minute {
+		t.Errorf("unexpected intervals %+v", s)
+	}
+
+	s.Weekdays = []string{"someday"}
+	if err = s.Validate(); err == nil {
+		t.Error("expected invalid weekday error")
+	}
+}
+
+func TestNextFollowsSun(t *testing.T) {
+	s := Schedule{
+		Interval: lib.Duration(10 * time.Minute),
+		Sun: &Sun{
+			BeforeDawn:         lib.Duration(30 * time.Minute),
+			GoldenHourInterval: lib.Duration(time.Minute),
+		},
+	}.WithLocation(&solar.Location{Latitude: 52.23, Longitude: 21.01})
+
+	midnight := time.Date(2023, 6, 21, 0, 0, 0, 0, time.UTC)
+	dawn, _ := solar.Location{Latitude: 52.23, Longitude: 21.01}.EventTime(midnight, solar.ElevationCivil, true)
+
+	next, ok := s.Next(midnight)
+	if !ok || !next.Equal(dawn.Add(-30*time.Minute)) {
+		t.Fatalf("expected first photo 30 minutes before dawn (%s), got %s", dawn, next)
+	}
+
+	if interval, _ := s.IntervalAt(dawn.Add(time.Hour)); interval != time.Minute {
+		t.Errorf("expected golden hour interval after dawn, got %s", interval)
+	}
+	if interval, _ := s.IntervalAt(dawn.Add(5 * time.Hour)); interval != 10*time.Minute {
+		t.Errorf("expected default interval during the day, got %s", interval)
+	}
+	if _, ok = s.IntervalAt(midnight.Add(22 * time.Hour)); ok {
+		t.Error("expected no photos at night")
+	}
+}
@@ -0,0 +1,114 @@
+package schedule
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/macrosiak/rspi-timelaps-manager-go/solar"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrNoLocation = errors.New("following the sun requires latitude and longitude in config")
+
+// Store keeps the active schedule and persists it as json file
+type Store struct {
+	path     string
+	location *solar.Location
+	mu       sync.RWMutex
+	schedule Schedule
+	changed  chan struct{}
+	// custom is set once schedule was loaded from file or set by user, otherwise it follows the fallback interval
+	custom bool
+}
+
+// NewStore loads schedule from path, when the file doesn't exist photos are taken every fallbackInterval,
+// location may be nil when it isn't configured
+func NewStore(path string, fallbackInterval time.Duration, location *solar.Location) (*Store, error) {
+	store := &Store{
+		path:     path,
+		location: location,
+		schedule: Every(fallbackInterval),
+		changed:  make(chan struct{}, 1),
+	}
+
+	by, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("read schedule: %w", err)
+	}
+
+	schedule := Schedule{}
+	if err = json.Unmarshal(by, &schedule); err != nil {
+		return nil, fmt.Errorf("unmarshal schedule: %w", err)
+	}
+	if err = store.validate(schedule); err != nil {
+		return nil, fmt.Errorf("invalid schedule in %s: %w", path, err)
+	}
+
+	store.schedule = schedule
+	store.custom = true
+	return store, nil
+}
+
+func (s *Store) validate(schedule Schedule) error {
+	if err := schedule.Validate(); err != nil {
+		return err
+	}
+	if schedule.Sun != nil && s.location == nil {
+		return ErrNoLocation
+	}
+	return nil
+}
+
+func (s *Store) Get() Schedule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.schedule.WithLocation(s.location)
+}
+
+func (s *Store) Set(schedule Schedule) error {
+	if err := s.validate(schedule); err != nil {
+		return err
+	}
+
+	by, err := json.MarshalIndent(schedule, "", "  ")
+	if err != nil {
+		return fmt.Errorf("json marshal: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err = os.WriteFile(s.path, by, 0644); err != nil {
+		return fmt.Errorf("write schedule: %w", err)
+	}
+	s.schedule = schedule
+	s.custom = true
+	s.notify()
+	return nil
+}
+
+// SetFallbackInterval changes interval of the default schedule, it has no effect once custom schedule is set
+func (s *Store) SetFallbackInterval(interval time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.custom || time.Duration(s.schedule.Interval) == interval {
+		return
+	}
+	s.schedule = Every(interval)
+	s.notify()
+}
+
+func (s *Store) notify() {
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Changed receives a value every time the schedule is replaced
+func (s *Store) Changed() <-chan struct{} {
+	return s.changed
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"github.com/macrosiak/rspi-timelaps-manager-go/config"
+	"github.com/rs/zerolog/log"
+	"net"
+	"net/http"
+	"path/filepath"
+)
+
+// Listen serves the app over plain HTTP, or over HTTPS when TLS is enabled, then the plain listener
+// only redirects to HTTPS if HttpRedirect is set, it returns when the server stops
+func Listen(app *fiber.App, cfg *config.Config) error {
+	if !cfg.TlsEnabled {
+		return app.Listen(cfg.ListenAddress)
+	}
+
+	certFile, keyFile := cfg.TlsCertFile, cfg.TlsKeyFile
+	if certFile == "" && keyFile == "" {
+		certFile, keyFile = filepath.Join(cfg.DataDir, "tls_cert.pem"), filepath.Join(cfg.DataDir, "tls_key.pem")
+		if err := EnsureSelfSigned(certFile, keyFile); err != nil {
+			return fmt.Errorf("self-signed certificate: %w", err)
+		}
+		log.Info().Str("cert", certFile).Msg("using self-signed certificate")
+	} else if certFile == "" || keyFile == "" {
+		return fmt.Errorf("both certificate and key file must be configured")
+	}
+
+	if cfg.HttpRedirect {
+		go func() {
+			redirect := &http.Server{Addr: cfg.ListenAddress, Handler: RedirectHandler(cfg.TlsListenAddress)}
+			if err := redirect.ListenAndServe(); err != nil {
+				log.Err(err).Msg("http redirect listener stopped")
+			}
+		}()
+	}
+	return app.ListenTLS(cfg.TlsListenAddress, certFile, keyFile)
+}
+
+// RedirectHandler sends clients to the same host and path on the HTTPS address
+func RedirectHandler(tlsAddress string) http.Handler {
+	_, tlsPort, _ := net.SplitHostPort(tlsAddress)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if tlsPort != "" && tlsPort != "443" {
+			host = net.JoinHostPort(host, tlsPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
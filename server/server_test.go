@@ -0,0 +1,43 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnsureSelfSignedIsPersisted(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := EnsureSelfSigned(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	first, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = EnsureSelfSigned(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := os.ReadFile(certFile)
+	if string(first) != string(second) {
+		t.Error("expected valid certificate to be reused")
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	cases := map[string]string{
+		":443":  "https://camera.local/photos?limit=5",
+		":8443": "https://camera.local:8443/photos?limit=5",
+	}
+	for address, expected := range cases {
+		recorder := httptest.NewRecorder()
+		RedirectHandler(address).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://camera.local:8080/photos?limit=5", nil))
+		if location := recorder.Header().Get("Location"); recorder.Code != http.StatusMovedPermanently || location != expected {
+			t.Errorf("%s: expected redirect to %s, got %d %s", address, expected, recorder.Code, location)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/macrosiak/rspi-timelaps-manager-go/lib"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	ManifestFileName = "manifest.json"
+	// LegacyId is the session into which photos taken before sessions existed are imported
+	LegacyId = "legacy"
+	// ManualId is the directory of manual shots which are not part of any timelapse sequence
+	ManualId = "manual"
+	// a pause between frames longer than gapFactor intervals is recorded as a gap
+	gapFactor = 2
+)
+
+// Gap is a period in which frames were expected but none were taken, e.g. session was paused or the Pi was off
+type Gap struct {
+	From int64 `json:"from"`
+	To   int64 `json:"to"`
+}
+
+func isGap(previous, next time.Time, interval time.Duration) bool {
+	return interval > 0 && next.Sub(previous) > gapFactor*interval
+}
+
+func (s *Session) addFrame(takenAt time.Time, interval time.Duration) {
+	if s.LastFrameAt != nil && isGap(time.Unix(*s.LastFrameAt, 0), takenAt, interval) {
+		s.Gaps = append(s.Gaps, Gap{From: *s.LastFrameAt, To: takenAt.Unix()})
+	}
+
+	takenAtUnix := takenAt.Unix()
+	s.LastFrameAt = &takenAtUnix
+	s.Interval = lib.Duration(interval)
+	s.FramesCaptured++
+}
+
+func WriteManifest(dir string, s Session) error {
+	by, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("json marshal: %w", err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, ManifestFileName), by, 0644); err != nil {
+		return fmt.Errorf("write manifest: %w", err)
+	}
+	return nil
+}
+
+func ReadManifest(dir string) (*Session, error) {
+	by, err := os.ReadFile(filepath.Join(dir, ManifestFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Session{}
+	if err = json.Unmarshal(by, s); err != nil {
+		return nil, fmt.Errorf("unmarshal manifest: %w", err)
+	}
+	return s, nil
+}
+
+// Sessions returns manifests of all sessions found in the output directory, newest first
+func (m *Manager) Sessions() ([]Session, error) {
+	entries, err := os.ReadDir(m.outputDir)
+	if err != nil {
+		return nil, fmt.Errorf("read dir: %w", err)
+	}
+
+	sessions := []Session{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		s, err := m.read(entry.Name())
+		if errors.Is(err, os.ErrNotExist) {
+			continue // not a session directory
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+		sessions = append(sessions, *s)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].StartedAt > sessions[j].StartedAt
+	})
+	return sessions, nil
+}
+
+func validId(id string) bool {
+	return id != "" && id != "." && id != ".." && !strings.ContainsAny(id, `/\`)
+}
+
+// Get returns manifest of the session with given id
+func (m *Manager) Get(id string) (*Session, error) {
+	if !validId(id) {
+		return nil, ErrNotFound
+	}
+
+	s, err := m.read(id)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return s, err
+}
+
+// read returns manifest of the session, the manual directory has none, so it is described by its photos
+func (m *Manager) read(id string) (*Session, error) {
+	if id == ManualId {
+		return manualManifest(m.Dir(id))
+	}
+	return ReadManifest(m.Dir(id))
+}
+
+// manualManifest describes manual shots in dir, they aren't a sequence, so there are no interval and gaps
+func manualManifest(dir string) (*Session, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	manual := &Session{Id: ManualId, Name: "Manual", Gaps: []Gap{}}
+	for _, entry := range entries {
+		takenAt, err := lib.ParsePhotoTime(entry.Name())
+		if err != nil || entry.IsDir() {
+			continue
+		}
+		takenAtUnix := takenAt.Unix()
+		if manual.FramesCaptured == 0 || takenAtUnix < manual.StartedAt {
+			manual.StartedAt = takenAtUnix
+		}
+		if manual.LastFrameAt == nil || takenAtUnix > *manual.LastFrameAt {
+			manual.LastFrameAt = &takenAtUnix
+		}
+		manual.FramesCaptured++
+	}
+	return manual, nil
+}
+
+// Remove deletes directory of the session with all its frames, the current session can't be removed
+func (m *Manager) Remove(id string) error {
+	if _, err := m.Get(id); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	active := m.status.Session != nil && m.status.Session.Id == id
+	m.mu.Unlock()
+	if active {
+		return ErrSessionActive
+	}
+
+	// removing thousands of frames takes a while, status and captured frames shouldn't wait for it
+	if err := os.RemoveAll(m.Dir(id)); err != nil {
+		return fmt.Errorf("remove session dir: %w", err)
+	}
+	return nil
+}
+
+// ImportLegacy moves photos lying directly in the output directory into the legacy session
+// and rebuilds its manifest, it returns the manifest and how many photos were moved
+func (m *Manager) ImportLegacy() (*Session, int, error) {
+	dir := m.Dir(LegacyId)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, 0, fmt.Errorf("create legacy dir: %w", err)
+	}
+
+	entries, err := os.ReadDir(m.outputDir)
+	if err != nil {
+		return nil, 0, fmt.Errorf("read dir: %w", err)
+	}
+
+	moved := 0
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if _, err := lib.ParsePhotoTime(entry.Name()); err != nil {
+			continue // not a timelapse frame
+		}
+		if err = os.Rename(filepath.Join(m.outputDir, entry.Name()), filepath.Join(dir, entry.Name())); err != nil {
+			return nil, moved, fmt.Errorf("move %s: %w", entry.Name(), err)
+		}
+		moved++
+	}
+
+	legacy, err := legacyManifest(dir)
+	if err != nil {
+		return nil, moved, err
+	}
+	if err = WriteManifest(dir, *legacy); err != nil {
+		return nil, moved, err
+	}
+	return legacy, moved, nil
+}
+
+// legacyManifest describes frames in dir, the interval isn't known, so the most common one is used
+func legacyManifest(dir string) (*Session, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read dir: %w", err)
+	}
+
+	var frames []time.Time
+	for _, entry := range entries {
+		if takenAt, err := lib.ParsePhotoTime(entry.Name()); err == nil && !entry.IsDir() {
+			frames = append(frames, takenAt)
+		}
+	}
+	sort.Slice(frames, func(i, j int) bool {
+		return frames[i].Before(frames[j])
+	})
+
+	legacy := &Session{Id: LegacyId, Name: "Legacy", Legacy: true, Gaps: []Gap{}}
+	if len(frames) == 0 {
+		return legacy, nil
+	}
+
+	interval := commonInterval(frames)
+	legacy.StartedAt = frames[0].Unix()
+	endedAt := frames[len(frames)-1].Unix()
+	legacy.EndedAt = &endedAt
+	for _, takenAt := range frames {
+		legacy.addFrame(takenAt, interval)
+	}
+	return legacy, nil
+}
+
+func commonInterval(frames []time.Time) time.Duration {
+	counts := make(map[time.Duration]int)
+	var common time.Duration
+	for i := 1; i < len(frames); i++ {
+		interval := frames[i].Sub(frames[i-1])
+		counts[interval]++
+		if counts[interval] > counts[common] {
+			common = interval
+		}
+	}
+	return common
+}
@@ -0,0 +1,287 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/macrosiak/rspi-timelaps-manager-go/camera"
+	"github.com/macrosiak/rspi-timelaps-manager-go/lib"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	// counters of captured frames are persisted after persistFrames frames or persistInterval,
+	// whichever comes first, so the card isn't written twice for every frame
+	persistFrames   = 10
+	persistInterval = time.Minute
+)
+
+type State string
+
+const (
+	StateIdle    State = "IDLE"
+	StateRunning State = "RUNNING"
+	StatePaused  State = "PAUSED"
+)
+
+var (
+	ErrAlreadyStarted = errors.New("session is already started, stop it first")
+	ErrNotRunning     = errors.New("session is not running")
+	ErrNotPaused      = errors.New("session is not paused")
+	ErrNoSession      = errors.New("there is no session to stop")
+	ErrInvalidName    = errors.New("session name can't be empty")
+	ErrNotFound       = errors.New("session not found")
+	ErrSessionActive  = errors.New("session is active, stop it first")
+)
+
+// Session is also written as a manifest into the session directory, so the directory describes itself
+type Session struct {
+	Id        string `json:"id"`
+	Name      string `json:"name"`
+	StartedAt int64  `json:"startedAt"`
+	EndedAt   *int64 `json:"endedAt"`
+	// Interval is the capture interval used for the last frame
+	Interval       lib.Duration           `json:"interval"`
+	Settings       *camera.CameraSettings `json:"settings"`
+	FramesCaptured int                    `json:"framesCaptured"`
+	LastFrameAt    *int64                 `json:"lastFrameAt"`
+	Gaps           []Gap                  `json:"gaps"`
+	Legacy         bool                   `json:"legacy"`
+}
+
+type Status struct {
+	State   State    `json:"state"`
+	Session *Session `json:"session"`
+}
+
+// slug turns session name into something which is safe to use in paths
+func slug(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			b.WriteRune(r)
+		case r == ' ' || r == '-' || r == '_':
+			b.WriteRune('-')
+		}
+	}
+	return strings.Trim(b.String(), "-")
+}
+
+func newSession(name string, startedAt time.Time) *Session {
+	id := startedAt.Format(lib.PhotoTimeFormat)
+	if s := slug(name); s != "" {
+		id += "_" + s
+	}
+	return &Session{Id: id, Name: name, StartedAt: startedAt.Unix()}
+}
+
+// Manager tracks the lifecycle of the current timelapse session and persists it,
+// so a session which was running before reboot is resumed
+type Manager struct {
+	path         string
+	outputDir    string
+	mu           sync.Mutex
+	status       Status
+	stateChanged chan struct{}
+	listeners    []func(status Status)
+	// unpersisted frames were captured since the state was last written at persistedAt
+	unpersisted int
+	persistedAt time.Time
+}
+
+// NewManager loads state persisted in path, frames of every session are stored in a subdirectory of outputDir,
+// exists is false when there was nothing persisted yet
+func NewManager(path string, outputDir string) (manager *Manager, exists bool, err error) {
+	manager = &Manager{
+		path:         path,
+		outputDir:    outputDir,
+		status:       Status{State: StateIdle},
+		stateChanged: make(chan struct{}, 1),
+	}
+
+	by, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return manager, false, nil
+	} else if err != nil {
+		return nil, false, fmt.Errorf("read session state: %w", err)
+	}
+
+	if err = json.Unmarshal(by, &manager.status); err != nil {
+		return nil, false, fmt.Errorf("unmarshal session state: %w", err)
+	}
+	return manager, true, nil
+}
+
+func (m *Manager) Status() Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.copyStatus()
+}
+
+func (m *Manager) copyStatus() Status {
+	status := m.status
+	if status.Session != nil {
+		sessionCopy := *status.Session
+		status.Session = &sessionCopy
+	}
+	return status
+}
+
+// IsCapturing reports whether scheduled photos should be taken
+func (m *Manager) IsCapturing() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status.State == StateRunning
+}
+
+// Dir returns directory in which frames of the session are stored
+func (m *Manager) Dir(id string) string {
+	return filepath.Join(m.outputDir, id)
+}
+
+func (m *Manager) Start(name string) (Status, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return m.Status(), ErrInvalidName
+	}
+
+	return m.transition(true, func(status *Status) error {
+		if status.State != StateIdle {
+			return ErrAlreadyStarted
+		}
+		started := newSession(name, time.Now())
+		if err := os.MkdirAll(m.Dir(started.Id), 0755); err != nil {
+			return fmt.Errorf("create session dir: %w", err)
+		}
+		status.State = StateRunning
+		status.Session = started
+		return nil
+	})
+}
+
+func (m *Manager) Pause() (Status, error) {
+	return m.transition(true, func(status *Status) error {
+		if status.State != StateRunning {
+			return ErrNotRunning
+		}
+		status.State = StatePaused
+		return nil
+	})
+}
+
+func (m *Manager) Resume() (Status, error) {
+	return m.transition(true, func(status *Status) error {
+		if status.State != StatePaused {
+			return ErrNotPaused
+		}
+		status.State = StateRunning
+		return nil
+	})
+}
+
+func (m *Manager) Stop() (Status, error) {
+	return m.transition(true, func(status *Status) error {
+		if status.State == StateIdle {
+			return ErrNoSession
+		}
+
+		ended := *status.Session
+		endedAt := time.Now().Unix()
+		ended.EndedAt = &endedAt
+		if err := WriteManifest(m.Dir(ended.Id), ended); err != nil {
+			return err
+		}
+		status.State = StateIdle
+		status.Session = nil
+		return nil
+	})
+}
+
+// FrameCaptured records a frame of the session with given id, interval is the one planned by the schedule
+// and it is used to detect gaps, frames of a session which is no longer current are ignored,
+// after a crash the persisted counters may miss frames captured since the last write
+func (m *Manager) FrameCaptured(id string, takenAt time.Time, interval time.Duration, settings *camera.CameraSettings) error {
+	_, err := m.transition(false, func(status *Status) error {
+		if status.Session == nil || status.Session.Id != id {
+			return ErrNoSession
+		}
+		status.Session.addFrame(takenAt, interval)
+		status.Session.Settings = settings
+		return nil
+	})
+	return err
+}
+
+// transition applies fn to a copy of the status, persists the result and notifies listeners,
+// stateChange also wakes up whoever waits on StateChanged, other changes are persisted only now and then
+func (m *Manager) transition(stateChange bool, fn func(status *Status) error) (Status, error) {
+	m.mu.Lock()
+	status := m.copyStatus()
+	if err := fn(&status); err != nil {
+		m.mu.Unlock()
+		return status, err
+	}
+
+	persist := stateChange || m.unpersisted+1 >= persistFrames || time.Since(m.persistedAt) >= persistInterval
+	if !persist {
+		m.unpersisted++
+	} else if status.Session != nil {
+		if err := WriteManifest(m.Dir(status.Session.Id), *status.Session); err != nil {
+			current := m.copyStatus()
+			m.mu.Unlock()
+			return current, err
+		}
+	}
+	if persist {
+		if err := m.persist(status); err != nil {
+			current := m.copyStatus()
+			m.mu.Unlock()
+			return current, err
+		}
+		m.unpersisted, m.persistedAt = 0, time.Now()
+	}
+	m.status = status
+	listeners := m.listeners
+	result := m.copyStatus()
+	m.mu.Unlock()
+
+	if stateChange {
+		select {
+		case m.stateChanged <- struct{}{}:
+		default:
+		}
+	}
+	for _, listener := range listeners {
+		listener(result)
+	}
+	return result, nil
+}
+
+func (m *Manager) persist(status Status) error {
+	by, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return fmt.Errorf("json marshal: %w", err)
+	}
+	if err = os.WriteFile(m.path, by, 0644); err != nil {
+		return fmt.Errorf("write session state: %w", err)
+	}
+	return nil
+}
+
+// StateChanged receives a value when session is started, paused, resumed or stopped
+func (m *Manager) StateChanged() <-chan struct{} {
+	return m.stateChanged
+}
+
+// OnChange registers function called with the new status after every change, including captured frames
+func (m *Manager) OnChange(listener func(status Status)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.listeners = append(m.listeners, listener)
+}
@@ -0,0 +1,167 @@
+package session
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestManagerTransitions(t *testing.T) {
+	dir := t.TempDir()
+	manager, exists, err := NewManager(filepath.Join(dir, "session.json"), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Error("expected no persisted state")
+	}
+
+	if _, err = manager.Pause(); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("expected ErrNotRunning, got %v", err)
+	}
+	if _, err = manager.Start(" "); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("expected ErrInvalidName, got %v", err)
+	}
+
+	status, err := manager.Start("Garden Spring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != StateRunning || status.Session == nil || status.Session.Name != "Garden Spring" {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if _, err = manager.Start("other"); !errors.Is(err, ErrAlreadyStarted) {
+		t.Errorf("expected ErrAlreadyStarted, got %v", err)
+	}
+
+	if status, err = manager.Pause(); err != nil || status.State != StatePaused || manager.IsCapturing() {
+		t.Errorf("expected paused session, got %+v %v", status, err)
+	}
+	if status, err = manager.Resume(); err != nil || status.State != StateRunning || !manager.IsCapturing() {
+		t.Errorf("expected running session, got %+v %v", status, err)
+	}
+	if status, err = manager.Stop(); err != nil || status.State != StateIdle || status.Session != nil {
+		t.Errorf("expected idle manager, got %+v %v", status, err)
+	}
+}
+
+func TestManagerRestoresState(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "session.json")
+	manager, _, err := NewManager(path, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started, err := manager.Start("roof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, takenAt := range []time.Time{now, now.Add(time.Minute), now.Add(10 * time.Minute)} {
+		if err = manager.FrameCaptured(started.Session.Id, takenAt, time.Minute, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = manager.FrameCaptured("other", now, time.Minute, nil); !errors.Is(err, ErrNoSession) {
+		t.Errorf("expected frame of other session to be rejected, got %v", err)
+	}
+	// counters are written only now and then, the next transition writes them
+	if manifest, err := ReadManifest(manager.Dir(started.Session.Id)); err != nil || manifest.FramesCaptured != 0 {
+		t.Errorf("expected frames not to be persisted yet, got %+v %v", manifest, err)
+	}
+	if _, err = manager.Pause(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, exists, err := NewManager(path, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Fatal("expected persisted state")
+	}
+
+	status := restored.Status()
+	if status.State != StatePaused || status.Session.Id != started.Session.Id || status.Session.FramesCaptured != 3 {
+		t.Errorf("unexpected restored status %+v", status.Session)
+	}
+
+	manifest, err := ReadManifest(manager.Dir(started.Session.Id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedGap := Gap{From: now.Add(time.Minute).Unix(), To: now.Add(10 * time.Minute).Unix()}
+	if manifest.FramesCaptured != 3 || len(manifest.Gaps) != 1 || manifest.Gaps[0] != expectedGap {
+		t.Errorf("unexpected manifest %+v", manifest)
+	}
+
+	if err = restored.Remove(started.Session.Id); !errors.Is(err, ErrSessionActive) {
+		t.Errorf("expected active session to be kept, got %v", err)
+	}
+	if _, err = restored.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if manifest, err = ReadManifest(manager.Dir(started.Session.Id)); err != nil || manifest.EndedAt == nil {
+		t.Errorf("expected end of session in manifest, got %+v %v", manifest, err)
+	}
+	if err = restored.Remove(started.Session.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = restored.Get(started.Session.Id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected removed session to be missing, got %v", err)
+	}
+}
+
+func TestImportLegacy(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{"2023-10-01__10-00-00.jpg", "2023-10-01__10-01-00.jpg", "2023-10-01__10-02-00.jpg", "2023-10-01__11-00-00.jpg", "notes.txt"}
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("frame"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	manager, _, err := NewManager(filepath.Join(t.TempDir(), "session.json"), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	legacy, moved, err := manager.ImportLegacy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 4 || legacy.FramesCaptured != 4 || time.Duration(legacy.Interval) != time.Minute || len(legacy.Gaps) != 1 {
+		t.Errorf("unexpected legacy import %d %+v", moved, legacy)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "notes.txt")); err != nil {
+		t.Errorf("expected other files to stay in place, got %v", err)
+	}
+
+	sessions, err := manager.Sessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].Id != LegacyId {
+		t.Errorf("unexpected sessions %+v", sessions)
+	}
+
+	// manual shots have no manifest, but they are listed and removed like sessions
+	if err = os.MkdirAll(manager.Dir(ManualId), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(manager.Dir(ManualId), "2023-10-02__09-00-00.jpg"), []byte("shot"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if sessions, err = manager.Sessions(); err != nil || len(sessions) != 2 || sessions[0].Id != ManualId || sessions[0].FramesCaptured != 1 {
+		t.Errorf("expected manual shots to be listed, got %+v %v", sessions, err)
+	}
+	if err = manager.Remove(ManualId); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = manager.Get(ManualId); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected manual shots to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,190 @@
+package settings
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/macrosiak/rspi-timelaps-manager-go/camera"
+	"github.com/macrosiak/rspi-timelaps-manager-go/config"
+	"github.com/macrosiak/rspi-timelaps-manager-go/lib"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrInvalidDelay = errors.New("delay must be at least one second")
+
+// Settings are camera and timelapse options which can be changed while the manager is running
+type Settings struct {
+	Quality        int                   `json:"quality"`
+	Hdr            bool                  `json:"hdr"`
+	VFlip          bool                  `json:"vFlip"`
+	HFlip          bool                  `json:"hFlip"`
+	Denoise        camera.Denoise        `json:"denoise"`
+	Encoding       camera.Encoding       `json:"encoding"`
+	AutoFocusRange camera.AutoFocusRange `json:"autoFocusRange"`
+	AutoFocusMode  camera.AutoFocusMode  `json:"autoFocusMode"`
+	Delay          lib.Duration          `json:"delay"`
+	Streaming      bool                  `json:"streaming"`
+}
+
+// Patch changes only the fields which are present
+type Patch struct {
+	Quality        *int                   `json:"quality"`
+	Hdr            *bool                  `json:"hdr"`
+	VFlip          *bool                  `json:"vFlip"`
+	HFlip          *bool                  `json:"hFlip"`
+	Denoise        *camera.Denoise        `json:"denoise"`
+	Encoding       *camera.Encoding       `json:"encoding"`
+	AutoFocusRange *camera.AutoFocusRange `json:"autoFocusRange"`
+	AutoFocusMode  *camera.AutoFocusMode  `json:"autoFocusMode"`
+	Delay          *lib.Duration          `json:"delay"`
+	Streaming      *bool                  `json:"streaming"`
+}
+
+func FromConfig(cfg *config.Config) Settings {
+	return Settings{
+		Quality:        cfg.Quality,
+		Hdr:            cfg.Hdr,
+		VFlip:          cfg.VFlip,
+		HFlip:          cfg.HFlip,
+		Denoise:        cfg.Denoise,
+		Encoding:       cfg.Encoding,
+		AutoFocusRange: cfg.AutoFocusRange,
+		AutoFocusMode:  cfg.AutoFocusMode,
+		Delay:          lib.Duration(cfg.Delay),
+		Streaming:      cfg.Streaming,
+	}
+}
+
+// Validate checks camera options the way manual shots are checked, camera.ErrInvalidSettings is returned for them
+func (s Settings) Validate() error {
+	if err := s.CameraSettings().Validate(); err != nil {
+		return err
+	}
+	if time.Duration(s.Delay) < time.Second {
+		return ErrInvalidDelay
+	}
+	return nil
+}
+
+func (s Settings) Apply(patch Patch) Settings {
+	if patch.Quality != nil {
+		s.Quality = *patch.Quality
+	}
+	if patch.Hdr != nil {
+		s.Hdr = *patch.Hdr
+	}
+	if patch.VFlip != nil {
+		s.VFlip = *patch.VFlip
+	}
+	if patch.HFlip != nil {
+		s.HFlip = *patch.HFlip
+	}
+	if patch.Denoise != nil {
+		s.Denoise = *patch.Denoise
+	}
+	if patch.Encoding != nil {
+		s.Encoding = *patch.Encoding
+	}
+	if patch.AutoFocusRange != nil {
+		s.AutoFocusRange = *patch.AutoFocusRange
+	}
+	if patch.AutoFocusMode != nil {
+		s.AutoFocusMode = *patch.AutoFocusMode
+	}
+	if patch.Delay != nil {
+		s.Delay = *patch.Delay
+	}
+	if patch.Streaming != nil {
+		s.Streaming = *patch.Streaming
+	}
+	return s
+}
+
+func (s Settings) CameraSettings() *camera.CameraSettings {
+	return &camera.CameraSettings{
+		AutoFocusRange: s.AutoFocusRange,
+		AutoFocusMode:  s.AutoFocusMode,
+
+		Quality:  s.Quality,
+		HDR:      s.Hdr,
+		VFlip:    s.VFlip,
+		HFlip:    s.HFlip,
+		Encoding: s.Encoding,
+		Denoise:  s.Denoise,
+	}
+}
+
+// Store keeps settings in a json file, environment variables are used only until the first update
+type Store struct {
+	path      string
+	mu        sync.RWMutex
+	settings  Settings
+	listeners []func(settings Settings)
+}
+
+func NewStore(path string, defaults Settings) (*Store, error) {
+	store := &Store{path: path, settings: defaults}
+
+	by, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, defaults.Validate()
+	} else if err != nil {
+		return nil, fmt.Errorf("read settings: %w", err)
+	}
+
+	// fields missing in the file keep values from the environment
+	loaded := defaults
+	if err = json.Unmarshal(by, &loaded); err != nil {
+		return nil, fmt.Errorf("unmarshal settings: %w", err)
+	}
+	if err = loaded.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid settings in %s: %w", path, err)
+	}
+
+	store.settings = loaded
+	return store, nil
+}
+
+func (s *Store) Get() Settings {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.settings
+}
+
+// Update validates and persists patched settings, then notifies listeners
+func (s *Store) Update(patch Patch) (Settings, error) {
+	s.mu.Lock()
+	updated := s.settings.Apply(patch)
+	if err := updated.Validate(); err != nil {
+		s.mu.Unlock()
+		return s.settings, err
+	}
+
+	by, err := json.MarshalIndent(updated, "", "  ")
+	if err != nil {
+		s.mu.Unlock()
+		return s.settings, fmt.Errorf("json marshal: %w", err)
+	}
+	if err = os.WriteFile(s.path, by, 0644); err != nil {
+		s.mu.Unlock()
+		return s.settings, fmt.Errorf("write settings: %w", err)
+	}
+
+	s.settings = updated
+	listeners := s.listeners
+	s.mu.Unlock()
+
+	for _, listener := range listeners {
+		listener(updated)
+	}
+	return updated, nil
+}
+
+// OnChange registers function called with new settings after every successful update
+func (s *Store) OnChange(listener func(settings Settings)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, listener)
+}
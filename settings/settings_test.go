@@ -0,0 +1,76 @@
+package settings
+
+import (
+	"errors"
+	"github.com/macrosiak/rspi-timelaps-manager-go/camera"
+	"github.com/macrosiak/rspi-timelaps-manager-go/lib"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func defaults() Settings {
+	return Settings{
+		Quality:        95,
+		Denoise:        camera.DenoiseAuto,
+		Encoding:       camera.EncodingJPEG,
+		AutoFocusRange: camera.AutoFocusNormal,
+		AutoFocusMode:  camera.AutoFocusModeAuto,
+		Delay:          lib.Duration(time.Minute),
+	}
+}
+
+func TestStoreUpdate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "settings.json")
+	store, err := NewStore(path, defaults())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var notified *Settings
+	store.OnChange(func(settings Settings) {
+		notified = &settings
+	})
+
+	quality := 80
+	vFlip := true
+	updated, err := store.Update(Patch{Quality: &quality, VFlip: &vFlip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Quality != 80 || !updated.VFlip || updated.Encoding != camera.EncodingJPEG {
+		t.Errorf("unexpected settings after update %+v", updated)
+	}
+	if notified == nil || notified.Quality != 80 {
+		t.Error("expected listener to be notified")
+	}
+
+	reloaded, err := NewStore(path, defaults())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Get() != updated {
+		t.Errorf("expected persisted settings %+v, got %+v", updated, reloaded.Get())
+	}
+}
+
+func TestStoreRejectsInvalidValues(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "settings.json"), defaults())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoding := camera.Encoding("webp")
+	if _, err = store.Update(Patch{Encoding: &encoding}); !errors.Is(err, camera.ErrInvalidSettings) {
+		t.Errorf("expected invalid encoding error, got %v", err)
+	}
+
+	quality := 0
+	if _, err = store.Update(Patch{Quality: &quality}); !errors.Is(err, camera.ErrInvalidSettings) {
+		t.Errorf("expected invalid quality error, got %v", err)
+	}
+
+	if store.Get() != defaults() {
+		t.Error("expected settings to stay unchanged")
+	}
+}
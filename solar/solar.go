@@ -0,0 +1,95 @@
+package solar
+
+import (
+	"math"
+	"time"
+)
+
+// Sun elevations (in degrees) of the events used by the timelapse schedule
+const (
+	ElevationSunrise    = -0.833 // upper limb touching horizon, includes atmospheric refraction
+	ElevationCivil      = -6.0
+	ElevationGoldenLow  = -4.0
+	ElevationGoldenHigh = 6.0
+)
+
+const (
+	julianUnixEpoch = 2440587.5
+	julian2000      = 2451545.0
+	obliquity       = 23.4397
+	// how many days Next looks ahead, polar regions may not see an event for months
+	maxSearchDays = 370
+)
+
+type Location struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"` // east is positive
+}
+
+func toJulian(t time.Time) float64 {
+	return float64(t.Unix())/86400 + julianUnixEpoch
+}
+
+func fromJulian(j float64) time.Time {
+	return time.Unix(int64(math.Round((j-julianUnixEpoch)*86400)), 0)
+}
+
+func sin(deg float64) float64 { return math.Sin(deg * math.Pi / 180) }
+func cos(deg float64) float64 { return math.Cos(deg * math.Pi / 180) }
+
+// solarDay returns julian date of the solar noon and the sun declination (in degrees) for the calendar day of date
+func (l Location) solarDay(date time.Time) (transit float64, declination float64) {
+	noonUtc := time.Date(date.Year(), date.Month(), date.Day(), 12, 0, 0, 0, time.UTC)
+	days := math.Round(toJulian(noonUtc) - julian2000)
+
+	// mean solar noon, solar mean anomaly, equation of the center and ecliptic longitude
+	meanNoon := days - l.Longitude/360
+	anomaly := math.Mod(357.5291+0.98560028*meanNoon, 360)
+	center := 1.9148*sin(anomaly) + 0.02*sin(2*anomaly) + 0.0003*sin(3*anomaly)
+	eclipticLongitude := math.Mod(anomaly+center+180+102.9372, 360)
+
+	transit = julian2000 + meanNoon + 0.0053*sin(anomaly) - 0.0069*sin(2*eclipticLongitude)
+	declination = math.Asin(sin(eclipticLongitude)*sin(obliquity)) * 180 / math.Pi
+	return transit, declination
+}
+
+// EventTime calculates when the sun crosses given elevation on the calendar day of date,
+// ok is false when it doesn't happen that day (polar day or night)
+func (l Location) EventTime(date time.Time, elevation float64, rising bool) (t time.Time, ok bool) {
+	transit, declination := l.solarDay(date)
+
+	cosHourAngle := (sin(elevation) - sin(l.Latitude)*sin(declination)) / (cos(l.Latitude) * cos(declination))
+	if cosHourAngle < -1 || cosHourAngle > 1 {
+		return time.Time{}, false
+	}
+
+	hourAngle := math.Acos(cosHourAngle) * 180 / math.Pi
+	if rising {
+		return fromJulian(transit - hourAngle/360).In(date.Location()), true
+	}
+	return fromJulian(transit + hourAngle/360).In(date.Location()), true
+}
+
+// Next returns the first time after t on which the sun crosses given elevation
+func (l Location) Next(t time.Time, elevation float64, rising bool) (time.Time, bool) {
+	for day := 0; day < maxSearchDays; day++ {
+		event, ok := l.EventTime(t.AddDate(0, 0, day), elevation, rising)
+		if ok && event.After(t) {
+			return event, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// IsAbove reports whether the sun is above given elevation at t
+func (l Location) IsAbove(t time.Time, elevation float64) bool {
+	rise, riseOk := l.EventTime(t, elevation, true)
+	set, setOk := l.EventTime(t, elevation, false)
+	if !riseOk || !setOk {
+		// the sun doesn't cross this elevation today, so it stays on the same side as at noon
+		_, declination := l.solarDay(t)
+		noonElevation := 90 - math.Abs(l.Latitude-declination)
+		return noonElevation > elevation
+	}
+	return !t.Before(rise) && t.Before(set)
+}
@@ -0,0 +1,54 @@
+package solar
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEventTime(t *testing.T) {
+	warsaw, err := time.LoadLocation("Europe/Warsaw")
+	if err != nil {
+		t.Skip("no timezone data")
+	}
+	location := Location{Latitude: 52.23, Longitude: 21.01}
+
+	cases := []struct {
+		date     time.Time
+		rising   bool
+		expected time.Time
+	}{
+		{time.Date(2023, 6, 21, 0, 0, 0, 0, warsaw), true, time.Date(2023, 6, 21, 4, 14, 0, 0, warsaw)},
+		{time.Date(2023, 6, 21, 0, 0, 0, 0, warsaw), false, time.Date(2023, 6, 21, 21, 1, 0, 0, warsaw)},
+		{time.Date(2023, 12, 21, 0, 0, 0, 0, warsaw), true, time.Date(2023, 12, 21, 7, 43, 0, 0, warsaw)},
+		{time.Date(2023, 12, 21, 0, 0, 0, 0, warsaw), false, time.Date(2023, 12, 21, 15, 25, 0, 0, warsaw)},
+	}
+	for _, c := range cases {
+		event, ok := location.EventTime(c.date, ElevationSunrise, c.rising)
+		if !ok {
+			t.Fatalf("%s: expected event", c.expected)
+		}
+		if diff := event.Sub(c.expected); diff > 2*time.Minute || diff < -2*time.Minute {
+			t.Errorf("expected %s, got %s", c.expected, event)
+		}
+	}
+}
+
+func TestPolarDayAndNight(t *testing.T) {
+	svalbard := Location{Latitude: 78.2, Longitude: 15.6}
+
+	midsummer := time.Date(2023, 6, 21, 0, 0, 0, 0, time.UTC)
+	if _, ok := svalbard.EventTime(midsummer, ElevationSunrise, true); ok {
+		t.Error("expected no sunrise during polar day")
+	}
+	if !svalbard.IsAbove(midsummer, ElevationSunrise) {
+		t.Error("expected the sun to be up at midnight during polar day")
+	}
+
+	midwinter := time.Date(2023, 12, 21, 12, 0, 0, 0, time.UTC)
+	if svalbard.IsAbove(midwinter, ElevationSunrise) {
+		t.Error("expected the sun to be down at noon during polar night")
+	}
+	if next, ok := svalbard.Next(midwinter, ElevationSunrise, true); !ok || next.Month() != time.February {
+		t.Errorf("expected next sunrise in february, got %s", next)
+	}
+}
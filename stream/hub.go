@@ -0,0 +1,277 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"time"
+)
+
+const (
+	// viewerBuffer is how many frames wait for a slow viewer, older frames are dropped first
+	viewerBuffer = 2
+	// maxFrameSize limits data kept while looking for the end of a frame, so garbage can't fill the memory
+	maxFrameSize = 8 << 20
+	// restartDelay keeps a camera which fails right away from being restarted in a loop
+	restartDelay = 2 * time.Second
+)
+
+var (
+	ErrDisabled = errors.New("live stream is disabled")
+
+	errIncomplete = errors.New("frame is not complete yet")
+	errCorrupt    = errors.New("frame is not a valid jpeg")
+
+	jpegStart = []byte{0xff, 0xd8}
+)
+
+// Control starts and stops the camera process which writes into the hub, it's implemented by camera.Arbiter
+type Control interface {
+	StartStream() error
+	StopStream()
+}
+
+// Viewer receives frames of the live stream until it's unsubscribed or the stream is disabled
+type Viewer struct {
+	frames chan []byte
+}
+
+// Frames is closed when the stream is disabled
+func (v *Viewer) Frames() <-chan []byte {
+	return v.frames
+}
+
+// Hub splits mjpeg written by the stream process into frames and fans them out to viewers,
+// the process runs only while somebody is watching
+type Hub struct {
+	control      Control
+	stopDelay    time.Duration
+	restartDelay time.Duration
+
+	mu      sync.Mutex
+	enabled bool
+	viewers map[*Viewer]struct{}
+
+	// controlMu serializes starts and stops, running is guarded by it
+	controlMu sync.Mutex
+	running   bool
+
+	// writeMu guards the data of a frame which isn't complete yet
+	writeMu sync.Mutex
+	pending []byte
+}
+
+// NewHub creates a disabled hub, stopDelay keeps the process running for a while after the last viewer left,
+// so reloading a page doesn't restart the camera
+func NewHub(control Control, stopDelay time.Duration) *Hub {
+	return &Hub{
+		control:      control,
+		stopDelay:    stopDelay,
+		restartDelay: restartDelay,
+		viewers:      make(map[*Viewer]struct{}),
+	}
+}
+
+// SetEnabled allows viewers, disabling closes all viewers and stops the stream
+func (h *Hub) SetEnabled(enabled bool) {
+	h.mu.Lock()
+	h.enabled = enabled
+	if !enabled {
+		for viewer := range h.viewers {
+			delete(h.viewers, viewer)
+			close(viewer.frames)
+		}
+	}
+	h.mu.Unlock()
+	h.sync()
+}
+
+// Subscribe adds a viewer, the first one starts the stream
+func (h *Hub) Subscribe() (*Viewer, error) {
+	h.mu.Lock()
+	if !h.enabled {
+		h.mu.Unlock()
+		return nil, ErrDisabled
+	}
+	viewer := &Viewer{frames: make(chan []byte, viewerBuffer)}
+	h.viewers[viewer] = struct{}{}
+	h.mu.Unlock()
+
+	h.sync()
+	return viewer, nil
+}
+
+// Unsubscribe removes the viewer, the stream stops after stopDelay unless somebody else starts watching
+func (h *Hub) Unsubscribe(viewer *Viewer) {
+	h.mu.Lock()
+	if _, ok := h.viewers[viewer]; ok {
+		delete(h.viewers, viewer)
+		close(viewer.frames)
+	}
+	last := len(h.viewers) == 0
+	h.mu.Unlock()
+
+	if last {
+		time.AfterFunc(h.stopDelay, h.sync)
+	}
+}
+
+// Viewers returns how many viewers are watching
+func (h *Hub) Viewers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.viewers)
+}
+
+// StreamExited is called when the stream process exits on its own, it's started again after a while
+// if there are still viewers
+func (h *Hub) StreamExited() {
+	h.controlMu.Lock()
+	h.running = false
+	h.controlMu.Unlock()
+
+	h.writeMu.Lock()
+	h.pending = nil
+	h.writeMu.Unlock()
+	time.AfterFunc(h.restartDelay, h.sync)
+}
+
+// sync starts or stops the stream, so it runs exactly while the hub is enabled and has viewers
+func (h *Hub) sync() {
+	h.controlMu.Lock()
+	defer h.controlMu.Unlock()
+
+	h.mu.Lock()
+	wanted := h.enabled && len(h.viewers) > 0
+	h.mu.Unlock()
+	if wanted == h.running {
+		return
+	}
+
+	h.running = wanted
+	if !wanted {
+		h.control.StopStream()
+		return
+	}
+	if err := h.control.StartStream(); err != nil {
+		log.Err(err).Msg("start live stream")
+		h.running = false
+		time.AfterFunc(h.restartDelay, h.sync)
+	}
+}
+
+// Write receives output of the stream process, it never fails, so the process keeps writing
+func (h *Hub) Write(p []byte) (int, error) {
+	h.writeMu.Lock()
+	defer h.writeMu.Unlock()
+
+	h.pending = append(h.pending, p...)
+	for {
+		start := bytes.Index(h.pending, jpegStart)
+		if start < 0 {
+			// keep the last byte, it may be the first half of the start marker
+			if len(h.pending) > 1 {
+				h.pending = h.pending[len(h.pending)-1:]
+			}
+			break
+		}
+		h.pending = h.pending[start:]
+
+		end, err := frameEnd(h.pending)
+		if errors.Is(err, errIncomplete) {
+			if len(h.pending) > maxFrameSize {
+				h.pending = nil
+			}
+			break
+		} else if err != nil {
+			// not a frame, look for the next start marker
+			h.pending = h.pending[len(jpegStart):]
+			continue
+		}
+
+		frame := make([]byte, end)
+		copy(frame, h.pending[:end])
+		h.pending = h.pending[end:]
+		h.broadcast(frame)
+	}
+	return len(p), nil
+}
+
+// frameEnd returns length of the JPEG frame which starts data, segments are skipped by their lengths,
+// so an end marker of a thumbnail embedded in EXIF doesn't cut the frame
+func frameEnd(data []byte) (int, error) {
+	i := len(jpegStart)
+	for {
+		if i+1 >= len(data) {
+			return 0, errIncomplete
+		}
+		if data[i] != 0xff {
+			return 0, errCorrupt
+		}
+		marker := data[i+1]
+		switch {
+		case marker == 0xff:
+			i++ // fill byte
+			continue
+		case marker == 0xd9:
+			return i + 2, nil
+		case marker == 0x01 || isRestart(marker):
+			i += 2 // markers without a segment
+			continue
+		}
+
+		if i+3 >= len(data) {
+			return 0, errIncomplete
+		}
+		length := int(data[i+2])<<8 | int(data[i+3])
+		if length < 2 {
+			return 0, errCorrupt
+		}
+		i += 2 + length
+		if marker != 0xda {
+			continue
+		}
+
+		// entropy coded data follows the scan header, it ends with the first marker which isn't a restart
+		for {
+			if i >= len(data) {
+				return 0, errIncomplete
+			}
+			next := bytes.IndexByte(data[i:], 0xff)
+			if next < 0 || i+next+1 >= len(data) {
+				return 0, errIncomplete
+			}
+			i += next
+			if data[i+1] != 0 && !isRestart(data[i+1]) {
+				break
+			}
+			i += 2
+		}
+	}
+}
+
+func isRestart(marker byte) bool {
+	return marker >= 0xd0 && marker <= 0xd7
+}
+
+func (h *Hub) broadcast(frame []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for viewer := range h.viewers {
+		select {
+		case viewer.frames <- frame:
+			continue
+		default:
+		}
+		// the viewer is behind, drop its oldest frame to make room for the newest one
+		select {
+		case <-viewer.frames:
+		default:
+		}
+		select {
+		case viewer.frames <- frame:
+		default:
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeControl struct {
+	mu      sync.Mutex
+	started int
+	stopped int
+	// failures is how many starts fail
+	failures int
+}
+
+func (c *fakeControl) StartStream() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.started++
+	if c.started <= c.failures {
+		return errors.New("camera is busy")
+	}
+	return nil
+}
+
+func (c *fakeControl) StopStream() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopped++
+}
+
+func (c *fakeControl) counts() (int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.started, c.stopped
+}
+
+func TestHubSplitsFrames(t *testing.T) {
+	hub := NewHub(&fakeControl{}, 0)
+	hub.SetEnabled(true)
+	viewer, err := hub.Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := []byte{0xff, 0xd8, 0xff, 0xda, 0, 3, 0, 1, 0xff, 0, 2, 0xff, 0xd0, 3, 0xff, 0xd9}
+	// exif thumbnail has its own end marker, it's within the APP1 segment
+	second := []byte{0xff, 0xd8, 0xff, 0xe1, 0, 6, 0xff, 0xd8, 0xff, 0xd9, 0xff, 0xda, 0, 2, 3, 0xff, 0xd9}
+	data := append(append([]byte{9, 9}, first...), second...)
+	// the process output arrives in arbitrary chunks
+	for _, chunk := range [][]byte{data[:3], data[3:7], data[7:]} {
+		_, _ = hub.Write(chunk)
+	}
+
+	for _, expected := range [][]byte{first, second} {
+		if frame := <-viewer.Frames(); !bytes.Equal(frame, expected) {
+			t.Errorf("expected frame %v, got %v", expected, frame)
+		}
+	}
+}
+
+func TestHubStartsForFirstViewerAndStopsAfterLast(t *testing.T) {
+	control := &fakeControl{}
+	hub := NewHub(control, 10*time.Millisecond)
+	if _, err := hub.Subscribe(); err != ErrDisabled {
+		t.Errorf("expected disabled hub to refuse viewers, got %v", err)
+	}
+
+	hub.SetEnabled(true)
+	first, _ := hub.Subscribe()
+	second, _ := hub.Subscribe()
+	if started, _ := control.counts(); started != 1 {
+		t.Errorf("expected one start for two viewers, got %d", started)
+	}
+
+	hub.Unsubscribe(first)
+	hub.Unsubscribe(second)
+	time.Sleep(50 * time.Millisecond)
+	if started, stopped := control.counts(); started != 1 || stopped != 1 {
+		t.Errorf("expected stream to stop after the last viewer, got %d starts and %d stops", started, stopped)
+	}
+
+	viewer, _ := hub.Subscribe()
+	hub.SetEnabled(false)
+	if _, open := <-viewer.Frames(); open {
+		t.Error("expected frames to be closed when the stream is disabled")
+	}
+}
+
+func TestHubRestartsExitedStream(t *testing.T) {
+	control := &fakeControl{}
+	hub := NewHub(control, 0)
+	hub.restartDelay = 10 * time.Millisecond
+	hub.SetEnabled(true)
+	viewer, err := hub.Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hub.StreamExited()
+	time.Sleep(50 * time.Millisecond)
+	if started, _ := control.counts(); started != 2 {
+		t.Fatalf("expected the stream to be started again for the viewer, started %d times", started)
+	}
+
+	// without viewers the exited stream stays stopped
+	hub.Unsubscribe(viewer)
+	time.Sleep(20 * time.Millisecond)
+	hub.StreamExited()
+	time.Sleep(50 * time.Millisecond)
+	if started, _ := control.counts(); started != 2 {
+		t.Errorf("expected no restart without viewers, started %d times", started)
+	}
+}
+
+func TestHubRetriesFailedStart(t *testing.T) {
+	control := &fakeControl{failures: 1}
+	hub := NewHub(control, 0)
+	hub.restartDelay = 10 * time.Millisecond
+	hub.SetEnabled(true)
+	if _, err := hub.Subscribe(); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if started, _ := control.counts(); started != 2 {
+		t.Errorf("expected failed start to be retried once, started %d times", started)
+	}
+}
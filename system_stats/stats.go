@@ -5,20 +5,44 @@ import (
 	"fmt"
 	"github.com/mackerelio/go-osstat/cpu"
 	ram "github.com/mackerelio/go-osstat/memory"
+	"github.com/macrosiak/rspi-timelaps-manager-go/camera"
+	"github.com/macrosiak/rspi-timelaps-manager-go/catalog"
 	"github.com/macrosiak/rspi-timelaps-manager-go/commands"
 	"github.com/macrosiak/rspi-timelaps-manager-go/config"
+	"github.com/macrosiak/rspi-timelaps-manager-go/lib"
+	"github.com/macrosiak/rspi-timelaps-manager-go/safeguard"
+	"github.com/macrosiak/rspi-timelaps-manager-go/session"
+	"github.com/macrosiak/rspi-timelaps-manager-go/settings"
+	"github.com/macrosiak/rspi-timelaps-manager-go/solar"
+	"github.com/macrosiak/rspi-timelaps-manager-go/upload"
 	"github.com/rs/zerolog/log"
 	"math"
-	"os"
 	"runtime"
-	"sort"
+	"sync"
 	"time"
 )
 
 type StatisticsService struct {
 	cfg          *config.Config
 	cmdSrv       *commands.CommendsService
+	catalog      *catalog.Catalog
+	settings     *settings.Store
+	sessions     *session.Manager
+	arbiter      *camera.Arbiter
+	guard        *safeguard.Guard
+	uploads      *upload.Spooler
 	lastCpuStats *cpu.Stats
+
+	photosMu sync.Mutex
+	photos   *sessionPhotos
+}
+
+// sessionPhotos summarizes photos of a session after given amount of its frames was captured,
+// the catalog is listed again only after another frame
+type sessionPhotos struct {
+	id      string
+	frames  int
+	summary catalog.Summary
 }
 
 type CpuInfo struct {
@@ -33,20 +57,42 @@ type MemoryInfo struct {
 	TimeRemainingForTimelapse string
 }
 
+// SessionStats describes the current session, photos are counted from the catalog
+type SessionStats struct {
+	Id             string          `json:"id"`
+	Name           string          `json:"name"`
+	State          session.State   `json:"state"`
+	FramesCaptured int             `json:"framesCaptured"`
+	Photos         catalog.Summary `json:"photos"`
+}
+
 type StatsResponse struct {
-	Ram              *ram.Stats  `json:"ram"`
-	Cpu              *CpuInfo    `json:"cpu"`
-	Memory           *MemoryInfo `json:"memory"`
-	LastPhotoTakenAt *int64      `json:"lastPhotoTakenAt"`
+	Ram              *ram.Stats      `json:"ram"`
+	Cpu              *CpuInfo        `json:"cpu"`
+	Memory           *MemoryInfo     `json:"memory"`
+	LastPhotoTakenAt *int64          `json:"lastPhotoTakenAt"`
+	NextSunrise      *int64          `json:"nextSunrise"`
+	NextSunset       *int64          `json:"nextSunset"`
+	Session          *SessionStats   `json:"session"`
+	Camera           camera.Metrics  `json:"camera"`
+	DiskSafeguard    safeguard.State `json:"diskSafeguard"`
+	// Upload is nil when uploads to remote storage are disabled
+	Upload *upload.Stats `json:"upload"`
 }
 
-func NewSystemStats() *StatisticsService {
+func NewSystemStats(photoCatalog *catalog.Catalog, settingsStore *settings.Store, sessions *session.Manager, arbiter *camera.Arbiter, guard *safeguard.Guard, uploads *upload.Spooler) *StatisticsService {
 	var currentCpuStats *cpu.Stats
 	var err error
 	cfg := config.New()
 	systemStatsSrv := &StatisticsService{
-		cfg:    cfg,
-		cmdSrv: commands.NewCommendsService(cfg),
+		cfg:      cfg,
+		cmdSrv:   commands.NewCommendsService(cfg, photoCatalog, sessions, nil),
+		catalog:  photoCatalog,
+		settings: settingsStore,
+		sessions: sessions,
+		arbiter:  arbiter,
+		guard:    guard,
+		uploads:  uploads,
 	}
 
 	currentCpuStats, err = systemStatsSrv.getCpuStats()
@@ -59,19 +105,12 @@ func NewSystemStats() *StatisticsService {
 	return systemStatsSrv
 }
 
-func min(a, b int) int {
-	if a < b {
-		return a
-	}
-	return b
-}
-
 func (a *StatisticsService) calculateTimeRemainingForTimelapse(freeSpace uint64, avgFileSize uint64) string {
 	// Calculate how many files can fit with free space
 	filesToFit := freeSpace / avgFileSize
 
 	// Calculate total time available in seconds
-	totalSeconds := filesToFit * uint64(a.cfg.Delay.Seconds())
+	totalSeconds := filesToFit * uint64(time.Duration(a.settings.Get().Delay).Seconds())
 
 	// Calculate time in different units
 	w := totalSeconds / (60 * 60 * 24 * 7)
@@ -112,47 +151,28 @@ func pluralize(n uint64) string {
 func (a *StatisticsService) getAveragePhotoSize() (uint64, error) {
 	var filesToRead = 20
 	var totalSize float64
-	var count int
 
-	// Read all files from directory
-	files, err := os.ReadDir(a.cfg.OutputDir)
+	// Consider only up to 20 newest photos
+	photos, err := a.catalog.Newest(filesToRead)
 	if err != nil {
-		return 0, fmt.Errorf("read dir: %w", err)
+		return 0, fmt.Errorf("get newest photos: %w", err)
 	}
 
-	if len(files) == 0 {
+	if len(photos) == 0 {
 		return 8 * 1024 * 1024, nil // Return 8MB if no files are present
 	}
 
-	// Sort files by modification time, newest first
-	sort.Slice(files, func(i, j int) bool {
-		infoI, errI := files[i].Info()
-		infoJ, errJ := files[j].Info()
-		if errI != nil || errJ != nil {
-			return false
-		}
-		return infoI.ModTime().After(infoJ.ModTime())
-	})
-
-	// Consider only up to 20 newest files
-	files = files[:min(len(files), filesToRead)]
-
 	// Calculate average size of the latest files
-	for _, file := range files {
-		fInfo, err := file.Info()
-		if err != nil {
-			return 0, fmt.Errorf("get file info: %w", err)
-		}
-		totalSize += float64(fInfo.Size())
-		count++
+	for _, photo := range photos {
+		totalSize += float64(photo.Size)
 	}
 
-	averageSize := totalSize / float64(count)
+	averageSize := totalSize / float64(len(photos))
 	return uint64(averageSize), nil
 }
 
 func (a *StatisticsService) getDiskInfo() (memoryInfo MemoryInfo, err error) {
-	total, free, err := getDiskUsage(a.cfg.OutputDir)
+	total, free, err := lib.DiskUsage(a.cfg.OutputDir)
 	if err != nil {
 		return MemoryInfo{}, err
 	}
@@ -219,6 +239,47 @@ func (a *StatisticsService) getCpuInfo() (*CpuInfo, error) {
 	return cpuInfo, nil
 }
 
+func (a *StatisticsService) getSessionStats() (*SessionStats, error) {
+	status := a.sessions.Status()
+	if status.Session == nil {
+		return nil, nil
+	}
+
+	stats := &SessionStats{
+		Id:             status.Session.Id,
+		Name:           status.Session.Name,
+		State:          status.State,
+		FramesCaptured: status.Session.FramesCaptured,
+	}
+
+	summary, err := a.sessionPhotos(status.Session)
+	if err != nil {
+		return stats, err
+	}
+	stats.Photos = summary
+	return stats, nil
+}
+
+func (a *StatisticsService) sessionPhotos(s *session.Session) (catalog.Summary, error) {
+	a.photosMu.Lock()
+	defer a.photosMu.Unlock()
+	if a.photos != nil && a.photos.id == s.Id && a.photos.frames == s.FramesCaptured {
+		return a.photos.summary, nil
+	}
+
+	photos, err := a.catalog.SessionRange(s.Id, time.Unix(s.StartedAt, 0), time.Time{})
+	if err != nil {
+		return catalog.Summary{}, fmt.Errorf("list session photos: %w", err)
+	}
+	current := &sessionPhotos{id: s.Id, frames: s.FramesCaptured}
+	for _, photo := range photos {
+		current.summary.Count++
+		current.summary.Size += photo.Size
+	}
+	a.photos = current
+	return current.summary, nil
+}
+
 func (a *StatisticsService) GetStats() (*StatsResponse, error) {
 	ramInfo, err := ram.Get()
 	if err != nil {
@@ -244,18 +305,44 @@ func (a *StatisticsService) GetStats() (*StatsResponse, error) {
 	}
 
 	response := StatsResponse{
-		Ram:    ramInfo,
-		Cpu:    cpuInfo,
-		Memory: &memoryInfo,
+		Ram:           ramInfo,
+		Cpu:           cpuInfo,
+		Memory:        &memoryInfo,
+		Camera:        a.arbiter.Metrics(),
+		DiskSafeguard: a.guard.State(),
+	}
+	if a.uploads != nil {
+		uploadStats := a.uploads.Stats()
+		response.Upload = &uploadStats
 	}
 
 	lastPhotoTakenAt, err := a.cmdSrv.GetLastPhotoTakenDate()
-	if err != nil {
+	if errors.Is(err, catalog.ErrNotFound) {
+		// no photos yet
+	} else if err != nil {
 		log.Err(err).Msg("get last photo taken at")
 	} else {
 		tmp := lastPhotoTakenAt.Unix()
 		response.LastPhotoTakenAt = &tmp
 	}
 
+	sessionStats, err := a.getSessionStats()
+	if err != nil {
+		log.Err(err).Msg("get session stats")
+	}
+	response.Session = sessionStats
+
+	if location := a.cfg.Location(); location != nil {
+		now := time.Now()
+		if sunrise, ok := location.Next(now, solar.ElevationSunrise, true); ok {
+			tmp := sunrise.Unix()
+			response.NextSunrise = &tmp
+		}
+		if sunset, ok := location.Next(now, solar.ElevationSunrise, false); ok {
+			tmp := sunset.Unix()
+			response.NextSunset = &tmp
+		}
+	}
+
 	return &response, nil
 }
@@ -0,0 +1,70 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// DirUploader copies files into a directory, usually a mounted network share or an external drive
+type DirUploader struct {
+	dir string
+}
+
+func NewDirUploader(dir string) (*DirUploader, error) {
+	if dir == "" {
+		return nil, errors.New("upload dir is not configured")
+	}
+	return &DirUploader{dir: dir}, nil
+}
+
+func (u *DirUploader) Name() string {
+	return BackendDir
+}
+
+// Upload writes into a temporary file first, so a half copied file never appears under the final name
+func (u *DirUploader) Upload(ctx context.Context, key string, r io.Reader, _ int64) error {
+	target := filepath.Join(u.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("create dir: %w", err)
+	}
+
+	tmp := target + ".part"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("create file: %w", err)
+	}
+	_, err = io.Copy(file, contextReader{ctx: ctx, r: r})
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("copy file: %w", err)
+	}
+
+	if err = os.Rename(tmp, target); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("rename file: %w", err)
+	}
+	return nil
+}
+
+// contextReader stops copying once the context is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,57 @@
+package upload
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Limiter caps throughput of all readers it wraps together, zero rate means no limit
+type Limiter struct {
+	bytesPerSecond int64
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+func NewLimiter(bytesPerSecond int64) *Limiter {
+	return &Limiter{bytesPerSecond: bytesPerSecond}
+}
+
+func (l *Limiter) Reader(r io.Reader) io.Reader {
+	if l == nil || l.bytesPerSecond <= 0 {
+		return r
+	}
+	return &limitedReader{r: r, limiter: l}
+}
+
+// wait blocks until n more bytes fit into the rate
+func (l *Limiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.bytesPerSecond))
+	until := l.next
+	l.mu.Unlock()
+
+	time.Sleep(time.Until(until))
+}
+
+type limitedReader struct {
+	r       io.Reader
+	limiter *Limiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	// small chunks keep the rate smooth instead of sending a burst and sleeping for long
+	if chunk := int(lr.limiter.bytesPerSecond / 10); chunk > 0 && len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := lr.r.Read(p)
+	if n > 0 {
+		lr.limiter.wait(n)
+	}
+	return n, err
+}
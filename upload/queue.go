@@ -0,0 +1,176 @@
+package upload
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/macrosiak/rspi-timelaps-manager-go/catalog"
+	"sync"
+	"time"
+)
+
+// entries are keyed by file name like photos in the catalog, so the oldest frames are uploaded first
+const queuePrefix = "upload/"
+
+// Entry is a photo waiting for upload
+type Entry struct {
+	FileName    string `json:"fileName"`
+	Session     string `json:"session"`
+	QueuedAt    int64  `json:"queuedAt"`
+	Attempts    int    `json:"attempts"`
+	NextAttempt int64  `json:"nextAttempt"`
+	LastError   string `json:"lastError,omitempty"`
+}
+
+// RelativePath returns slash separated path of the photo relative to the output directory
+func (e Entry) RelativePath() string {
+	return catalog.Photo{FileName: e.FileName, Session: e.Session}.RelativePath()
+}
+
+// Queue keeps photos waiting for upload in the database, so they survive restarts and network outages,
+// their count is kept in memory, so stats don't read the whole queue every second
+type Queue struct {
+	db *badger.DB
+
+	mu      sync.Mutex
+	pending int
+}
+
+// NewQueue counts entries left in the database by the previous run
+func NewQueue(db *badger.DB) (*Queue, error) {
+	q := &Queue{db: db}
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(queuePrefix)
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			q.pending++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("count upload queue: %w", err)
+	}
+	return q, nil
+}
+
+func queueKey(fileName string) []byte {
+	return []byte(queuePrefix + fileName)
+}
+
+func (q *Queue) Add(photo catalog.Photo) error {
+	return q.Update(Entry{FileName: photo.FileName, Session: photo.Session, QueuedAt: time.Now().Unix()})
+}
+
+func (q *Queue) Update(entry Entry) error {
+	by, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("json marshal: %w", err)
+	}
+	added := false
+	err = q.db.Update(func(txn *badger.Txn) error {
+		_, err := txn.Get(queueKey(entry.FileName))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			added = true
+		} else if err != nil {
+			return err
+		}
+		return txn.Set(queueKey(entry.FileName), by)
+	})
+	if err == nil && added {
+		q.adjust(1)
+	}
+	return err
+}
+
+func (q *Queue) Remove(fileName string) error {
+	removed := false
+	err := q.db.Update(func(txn *badger.Txn) error {
+		_, err := txn.Get(queueKey(fileName))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		removed = true
+		return txn.Delete(queueKey(fileName))
+	})
+	if err == nil && removed {
+		q.adjust(-1)
+	}
+	return err
+}
+
+func (q *Queue) adjust(delta int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending += delta
+}
+
+// Pending tells whether the photo is still waiting for upload
+func (q *Queue) Pending(fileName string) bool {
+	err := q.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(queueKey(fileName))
+		return err
+	})
+	return err == nil
+}
+
+func (q *Queue) iterate(fn func(entry Entry) bool) error {
+	return q.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(queuePrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			entry := Entry{}
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &entry)
+			})
+			if err != nil {
+				return err
+			}
+			if !fn(entry) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+var errQueueEmpty = errors.New("upload queue is empty")
+
+// Next returns the oldest entry due at now, when nothing is due it returns nil and when the earliest retry is planned,
+// errQueueEmpty is returned when there is nothing to upload
+func (q *Queue) Next(now time.Time) (*Entry, time.Time, error) {
+	var due *Entry
+	var earliest int64
+	err := q.iterate(func(entry Entry) bool {
+		if entry.NextAttempt <= now.Unix() {
+			due = &entry
+			return false
+		}
+		if earliest == 0 || entry.NextAttempt < earliest {
+			earliest = entry.NextAttempt
+		}
+		return true
+	})
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if due == nil && earliest == 0 {
+		return nil, time.Time{}, errQueueEmpty
+	}
+	return due, time.Unix(earliest, 0), nil
+}
+
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pending
+}
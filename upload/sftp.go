@@ -0,0 +1,155 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+const sftpDialTimeout = 30 * time.Second
+
+// SftpConfig describes an ssh server, at least one of Password and KeyFile must be set,
+// host keys are always verified against KnownHostsFile
+type SftpConfig struct {
+	Address        string
+	User           string
+	Password       string
+	KeyFile        string
+	KnownHostsFile string
+	// Dir on the server files are uploaded to
+	Dir string
+}
+
+// SftpUploader keeps one connection open and reconnects after a failed upload
+type SftpUploader struct {
+	cfg       SftpConfig
+	sshConfig *ssh.ClientConfig
+
+	mu     sync.Mutex
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+func NewSftpUploader(cfg SftpConfig) (*SftpUploader, error) {
+	if cfg.Address == "" || cfg.User == "" {
+		return nil, errors.New("sftp address and user must be configured")
+	}
+	if cfg.KnownHostsFile == "" {
+		return nil, errors.New("sftp known hosts file must be configured")
+	}
+
+	hostKeyCallback, err := knownhosts.New(cfg.KnownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("read known hosts: %w", err)
+	}
+
+	var auth []ssh.AuthMethod
+	if cfg.KeyFile != "" {
+		by, err := os.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("read private key: %w", err)
+		}
+		signer, err := ssh.ParsePrivateKey(by)
+		if err != nil {
+			return nil, fmt.Errorf("parse private key: %w", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if cfg.Password != "" {
+		auth = append(auth, ssh.Password(cfg.Password))
+	}
+	if len(auth) == 0 {
+		return nil, errors.New("sftp password or key file must be configured")
+	}
+
+	return &SftpUploader{cfg: cfg, sshConfig: &ssh.ClientConfig{
+		User:            cfg.User,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         sftpDialTimeout,
+	}}, nil
+}
+
+func (u *SftpUploader) Name() string {
+	return BackendSftp
+}
+
+func (u *SftpUploader) connect() (*sftp.Client, error) {
+	if u.client != nil {
+		return u.client, nil
+	}
+
+	conn, err := ssh.Dial("tcp", u.cfg.Address, u.sshConfig)
+	if err != nil {
+		return nil, fmt.Errorf("ssh dial: %w", err)
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("start sftp: %w", err)
+	}
+	u.conn, u.client = conn, client
+	return client, nil
+}
+
+func (u *SftpUploader) disconnect() {
+	if u.client != nil {
+		_ = u.client.Close()
+		_ = u.conn.Close()
+	}
+	u.conn, u.client = nil, nil
+}
+
+// Upload writes into a temporary file first and renames it once the whole file is on the server
+func (u *SftpUploader) Upload(ctx context.Context, key string, r io.Reader, _ int64) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	client, err := u.connect()
+	if err != nil {
+		return err
+	}
+	if err = u.upload(ctx, client, key, r); err != nil {
+		u.disconnect()
+		return err
+	}
+	return nil
+}
+
+func (u *SftpUploader) upload(ctx context.Context, client *sftp.Client, key string, r io.Reader) error {
+	target := path.Join(u.cfg.Dir, key)
+	if err := client.MkdirAll(path.Dir(target)); err != nil {
+		return fmt.Errorf("create dir: %w", err)
+	}
+
+	tmp := target + ".part"
+	file, err := client.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("create file: %w", err)
+	}
+	_, err = io.Copy(file, contextReader{ctx: ctx, r: r})
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = client.Remove(tmp)
+		return fmt.Errorf("copy file: %w", err)
+	}
+
+	if err = client.PosixRename(tmp, target); err != nil {
+		// servers without the posix-rename extension refuse to overwrite existing files
+		_ = client.Remove(target)
+		if err = client.Rename(tmp, target); err != nil {
+			return fmt.Errorf("rename file: %w", err)
+		}
+	}
+	return nil
+}
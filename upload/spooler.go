@@ -0,0 +1,224 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/macrosiak/rspi-timelaps-manager-go/catalog"
+	"github.com/macrosiak/rspi-timelaps-manager-go/commands"
+	"github.com/macrosiak/rspi-timelaps-manager-go/config"
+	"github.com/rs/zerolog/log"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	uploadTimeout = 10 * time.Minute
+	// idleCheck is how often the queue is looked at when nothing wakes the spooler up
+	idleCheck = time.Minute
+	// minRetryDelay keeps a failing entry from being retried in a loop, next attempts are stored in whole seconds
+	minRetryDelay = time.Second
+)
+
+type Options struct {
+	OutputDir string
+	// Prefix is prepended to keys of uploaded files
+	Prefix string
+	// BandwidthLimit in bytes per second, zero means no limit
+	BandwidthLimit int64
+	// RetryDelay is doubled after every failed attempt up to MaxRetryDelay
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+	// DeleteAfterUpload removes the local file and its catalog entry once it's uploaded
+	DeleteAfterUpload bool
+}
+
+func OptionsFromConfig(cfg *config.Config) Options {
+	return Options{
+		OutputDir:         cfg.OutputDir,
+		Prefix:            cfg.UploadPrefix,
+		BandwidthLimit:    int64(cfg.UploadBandwidthKbps) * 1024 / 8,
+		RetryDelay:        cfg.UploadRetryDelay,
+		MaxRetryDelay:     cfg.UploadMaxRetryDelay,
+		DeleteAfterUpload: cfg.UploadDeleteAfter,
+	}
+}
+
+type Stats struct {
+	Backend      string `json:"backend"`
+	Pending      int    `json:"pending"`
+	Uploaded     int64  `json:"uploaded"`
+	Failed       int64  `json:"failed"`
+	LastError    string `json:"lastError,omitempty"`
+	LastUploadAt int64  `json:"lastUploadAt,omitempty"`
+}
+
+// Spooler uploads queued photos one at a time, failed uploads stay in the queue and are retried with backoff
+type Spooler struct {
+	uploader Uploader
+	queue    *Queue
+	catalog  *catalog.Catalog
+	commands *commands.CommendsService
+	limiter  *Limiter
+	options  Options
+	wake     chan struct{}
+
+	mu    sync.Mutex
+	stats Stats
+}
+
+func NewSpooler(uploader Uploader, queue *Queue, photoCatalog *catalog.Catalog, commandsService *commands.CommendsService, options Options) *Spooler {
+	if options.RetryDelay < minRetryDelay {
+		log.Warn().Dur("delay", options.RetryDelay).Dur("min", minRetryDelay).Msg("upload retry delay too short, using the minimum")
+		options.RetryDelay = minRetryDelay
+	}
+	if options.MaxRetryDelay > 0 && options.MaxRetryDelay < options.RetryDelay {
+		options.MaxRetryDelay = options.RetryDelay
+	}
+	return &Spooler{
+		uploader: uploader,
+		queue:    queue,
+		catalog:  photoCatalog,
+		commands: commandsService,
+		limiter:  NewLimiter(options.BandwidthLimit),
+		options:  options,
+		wake:     make(chan struct{}, 1),
+		stats:    Stats{Backend: uploader.Name()},
+	}
+}
+
+// Enqueue adds the photo to the persistent queue and wakes the spooler up
+func (s *Spooler) Enqueue(photo catalog.Photo) error {
+	if err := s.queue.Add(photo); err != nil {
+		return fmt.Errorf("queue upload: %w", err)
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (s *Spooler) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := s.stats
+	stats.Pending = s.queue.Len()
+	return stats
+}
+
+// Pending tells whether the photo is waiting for upload, retention uses it to keep such photos
+func (s *Spooler) Pending(fileName string) bool {
+	return s.queue.Pending(fileName)
+}
+
+// Run uploads queued photos, it never returns
+func (s *Spooler) Run() {
+	for {
+		wait := s.uploadDue()
+		timer := time.NewTimer(wait)
+		select {
+		case <-s.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// uploadDue uploads all entries due now and returns how long to wait for the next retry
+func (s *Spooler) uploadDue() time.Duration {
+	for {
+		entry, next, err := s.queue.Next(time.Now())
+		if errors.Is(err, errQueueEmpty) {
+			return idleCheck
+		} else if err != nil {
+			log.Err(err).Msg("read upload queue")
+			return idleCheck
+		}
+		if entry == nil {
+			if wait := time.Until(next); wait < idleCheck {
+				return wait
+			}
+			return idleCheck
+		}
+		s.process(*entry)
+	}
+}
+
+func (s *Spooler) process(entry Entry) {
+	err := s.upload(entry)
+	if os.IsNotExist(err) {
+		// retention or the user removed the photo before it was uploaded
+		log.Warn().Str("file", entry.FileName).Msg("queued photo no longer exists, upload skipped")
+		s.dequeue(entry.FileName)
+		return
+	}
+	if err != nil {
+		entry.Attempts++
+		entry.LastError = err.Error()
+		entry.NextAttempt = time.Now().Add(s.retryDelay(entry.Attempts)).Unix()
+		log.Err(err).Str("file", entry.FileName).Int("attempts", entry.Attempts).Msg("upload photo")
+		if err = s.queue.Update(entry); err != nil {
+			log.Err(err).Str("file", entry.FileName).Msg("update upload queue")
+		}
+
+		s.mu.Lock()
+		s.stats.Failed++
+		s.stats.LastError = entry.LastError
+		s.mu.Unlock()
+		return
+	}
+
+	s.dequeue(entry.FileName)
+	s.mu.Lock()
+	s.stats.Uploaded++
+	s.stats.LastUploadAt = time.Now().Unix()
+	s.mu.Unlock()
+	log.Debug().Str("file", entry.FileName).Msg("photo uploaded")
+
+	if s.options.DeleteAfterUpload {
+		photo, err := s.catalog.Get(entry.FileName)
+		if err != nil {
+			photo = &catalog.Photo{FileName: entry.FileName, Session: entry.Session}
+		}
+		if err = s.commands.RemovePhoto(*photo); err != nil {
+			log.Err(err).Str("file", entry.FileName).Msg("remove uploaded photo")
+		}
+	}
+}
+
+func (s *Spooler) upload(entry Entry) error {
+	file, err := os.Open(filepath.Join(s.options.OutputDir, filepath.FromSlash(entry.RelativePath())))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("stat file: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), uploadTimeout)
+	defer cancel()
+	return s.uploader.Upload(ctx, path.Join(s.options.Prefix, entry.RelativePath()), s.limiter.Reader(file), info.Size())
+}
+
+func (s *Spooler) dequeue(fileName string) {
+	if err := s.queue.Remove(fileName); err != nil {
+		log.Err(err).Str("file", fileName).Msg("remove from upload queue")
+	}
+}
+
+func (s *Spooler) retryDelay(attempts int) time.Duration {
+	delay := s.options.RetryDelay
+	for i := 1; i < attempts && delay < s.options.MaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if s.options.MaxRetryDelay > 0 && delay > s.options.MaxRetryDelay {
+		delay = s.options.MaxRetryDelay
+	}
+	return delay
+}
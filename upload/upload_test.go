@@ -0,0 +1,146 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"github.com/macrosiak/rspi-timelaps-manager-go/catalog"
+	"github.com/macrosiak/rspi-timelaps-manager-go/commands"
+	"github.com/macrosiak/rspi-timelaps-manager-go/config"
+	"github.com/macrosiak/rspi-timelaps-manager-go/database"
+	"github.com/macrosiak/rspi-timelaps-manager-go/derivatives"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 stores objects put into it in memory, like a minimal MinIO
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if r.Method != http.MethodPut || !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=key/") || r.Header.Get("x-amz-date") == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	f.mu.Lock()
+	f.objects[r.URL.Path] = string(body)
+	f.mu.Unlock()
+}
+
+func TestS3Uploader(t *testing.T) {
+	fake := &fakeS3{objects: make(map[string]string)}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	uploader, err := NewS3Uploader(S3Config{Endpoint: server.URL, Bucket: "frames", AccessKey: "key", SecretKey: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = uploader.Upload(context.Background(), "garden/2023-10-01__10-00-00.jpg", strings.NewReader("frame"), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := fake.objects["/frames/garden/2023-10-01__10-00-00.jpg"]; body != "frame" {
+		t.Errorf("unexpected objects %v", fake.objects)
+	}
+
+	uploader.cfg.AccessKey = "other"
+	if err = uploader.Upload(context.Background(), "a.jpg", strings.NewReader("frame"), 5); err == nil {
+		t.Error("expected rejected upload to fail")
+	}
+}
+
+// flakyUploader fails the first upload and stores the rest in the directory uploader
+type flakyUploader struct {
+	*DirUploader
+	failed bool
+}
+
+func (f *flakyUploader) Upload(ctx context.Context, key string, r io.Reader, size int64) error {
+	if !f.failed {
+		f.failed = true
+		return errors.New("network is down")
+	}
+	return f.DirUploader.Upload(ctx, key, r, size)
+}
+
+func TestSpoolerRetriesAndDeletes(t *testing.T) {
+	db, err := database.OpenInMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	outputDir, remoteDir := t.TempDir(), t.TempDir()
+	photoCatalog := catalog.New(db)
+	photo := catalog.Photo{FileName: "2023-10-01__10-00-00.jpg", Session: "garden"}
+	if err = os.MkdirAll(filepath.Join(outputDir, "garden"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(outputDir, "garden", photo.FileName), []byte("frame"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = photoCatalog.Add(photo); err != nil {
+		t.Fatal(err)
+	}
+
+	queue, err := NewQueue(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirUploader, _ := NewDirUploader(remoteDir)
+	cfg := &config.Config{OutputDir: outputDir, DerivativesDir: t.TempDir()}
+	spooler := NewSpooler(&flakyUploader{DirUploader: dirUploader}, queue, photoCatalog, commands.NewCommendsService(cfg, photoCatalog, nil, derivatives.NewCache(cfg)), Options{
+		OutputDir:         outputDir,
+		Prefix:            "pi",
+		RetryDelay:        time.Hour,
+		DeleteAfterUpload: true,
+	})
+	if err = spooler.Enqueue(photo); err != nil {
+		t.Fatal(err)
+	}
+
+	if wait := spooler.uploadDue(); wait <= 0 || !spooler.Pending(photo.FileName) {
+		t.Fatalf("expected failed upload to wait for retry, got %s", wait)
+	}
+	if stats := spooler.Stats(); stats.Failed != 1 || stats.Pending != 1 || stats.LastError == "" {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// the retry is due right away
+	entry, _, _ := spooler.queue.Next(time.Now().Add(time.Hour))
+	entry.NextAttempt = 0
+	_ = spooler.queue.Update(*entry)
+	spooler.uploadDue()
+
+	if by, err := os.ReadFile(filepath.Join(remoteDir, "pi", "garden", photo.FileName)); err != nil || string(by) != "frame" {
+		t.Fatalf("expected uploaded file, got %q, %v", by, err)
+	}
+	if spooler.Pending(photo.FileName) || spooler.Stats().Pending != 0 {
+		t.Error("expected uploaded photo to leave the queue")
+	}
+	if _, err = os.Stat(filepath.Join(outputDir, "garden", photo.FileName)); !os.IsNotExist(err) {
+		t.Error("expected local file to be deleted after upload")
+	}
+	if _, err = photoCatalog.Get(photo.FileName); !errors.Is(err, catalog.ErrNotFound) {
+		t.Error("expected catalog entry to be deleted after upload")
+	}
+}
+
+func TestRetryDelayHasMinimum(t *testing.T) {
+	dirUploader, _ := NewDirUploader(t.TempDir())
+	spooler := NewSpooler(dirUploader, nil, nil, nil, Options{RetryDelay: 0, MaxRetryDelay: 500 * time.Millisecond})
+	if delay := spooler.retryDelay(3); delay < time.Second {
+		t.Errorf("expected at least a second between retries, got %s", delay)
+	}
+}
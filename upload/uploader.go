@@ -0,0 +1,52 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/macrosiak/rspi-timelaps-manager-go/config"
+	"io"
+)
+
+const (
+	BackendDir  = "dir"
+	BackendS3   = "s3"
+	BackendSftp = "sftp"
+)
+
+var ErrUnknownBackend = errors.New("unknown upload backend")
+
+// Uploader stores a file under the slash separated key on remote storage,
+// an existing file with the same key is overwritten
+type Uploader interface {
+	Upload(ctx context.Context, key string, r io.Reader, size int64) error
+	Name() string
+}
+
+// New returns uploader selected by configuration, nil when uploads are disabled
+func New(cfg *config.Config) (Uploader, error) {
+	switch cfg.UploadBackend {
+	case "":
+		return nil, nil
+	case BackendDir:
+		return NewDirUploader(cfg.UploadDir)
+	case BackendS3:
+		return NewS3Uploader(S3Config{
+			Endpoint:  cfg.UploadS3Endpoint,
+			Region:    cfg.UploadS3Region,
+			Bucket:    cfg.UploadS3Bucket,
+			AccessKey: cfg.UploadS3AccessKey,
+			SecretKey: cfg.UploadS3SecretKey,
+		})
+	case BackendSftp:
+		return NewSftpUploader(SftpConfig{
+			Address:        cfg.UploadSftpAddress,
+			User:           cfg.UploadSftpUser,
+			Password:       cfg.UploadSftpPassword,
+			KeyFile:        cfg.UploadSftpKeyFile,
+			KnownHostsFile: cfg.UploadSftpKnownHostsFile,
+			Dir:            cfg.UploadDir,
+		})
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownBackend, cfg.UploadBackend)
+}